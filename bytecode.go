@@ -0,0 +1,124 @@
+// Copyright 2013-2015 Oliver Eilhard.
+// Use of this source code is governed by the MIT LICENSE that
+// can be found in the MIT-LICENSE file included in the project.
+
+package mruby
+
+/*
+#cgo pkg-config: mruby
+#include "mruby_go.h"
+*/
+import "C"
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"unsafe"
+)
+
+var (
+	// ErrInvalidBytecode is returned when loading bytecode that is not
+	// a valid RITE binary for the linked version of mruby.
+	ErrInvalidBytecode = errors.New("invalid bytecode")
+)
+
+// Bytecode returns the parsed Ruby code as mruby bytecode (RITE binary),
+// including debug information, i.e. the same format that mrbc writes to
+// .mrb files. Use Context.LoadBytecode to run it.
+func (p *Parser) Bytecode() ([]byte, error) {
+	p.ctx.enter()
+	defer p.ctx.leave()
+
+	if p.proc == nil {
+		return nil, fmt.Errorf("%w: no code", ErrInvalidBytecode)
+	}
+
+	var bin *C.uint8_t
+	var size C.size_t
+	if C.my_dump_irep(p.ctx.mrb, p.proc, &bin, &size) != C.my_dump_ok() {
+		return nil, errors.New("cannot dump bytecode")
+	}
+	defer C.mrb_free(p.ctx.mrb, unsafe.Pointer(bin))
+
+	return C.GoBytes(unsafe.Pointer(bin), C.int(size)), nil
+}
+
+// LoadBytecode runs mruby bytecode (RITE binary), e.g. as created by
+// Parser.Bytecode or by mrbc, and returns its output. The header of
+// the binary is validated first, and an error wrapping
+// ErrInvalidBytecode is returned if it is truncated or has been
+// compiled for a different version of the bytecode format.
+//
+// If the context has been configured with SetNoExec, the code is not
+// run and a Proc is returned instead.
+func (ctx *Context) LoadBytecode(bin []byte, args ...interface{}) (Value, error) {
+	if err := checkBytecode(bin); err != nil {
+		return NilValue(ctx), err
+	}
+	if ctx.isRecording() {
+		prog := &Program{bytecode: append([]byte(nil), bin...)}
+		return ctx.recordLoad(setupStep{prog: prog, args: args}, func() (Value, error) {
+			return ctx.LoadBytecode(bin, args...)
+		})
+	}
+
+	ctx.enter()
+	defer ctx.leave()
+
+	cbin := C.CBytes(bin)
+	defer C.free(cbin)
+
+	ai := C.mrb_gc_arena_save(ctx.mrb)
+	defer C.mrb_gc_arena_restore(ctx.mrb, ai)
+
+	proc := C.my_read_irep(ctx.mrb, (*C.uint8_t)(cbin))
+	if proc == nil {
+		return NilValue(ctx), fmt.Errorf("%w: cannot read instructions", ErrInvalidBytecode)
+	}
+	return ctx.runProc(proc, args)
+}
+
+// runProc runs proc as a top-level script with the given arguments in
+// ARGV. If the context has been configured with SetNoExec, the proc is
+// returned instead.
+func (ctx *Context) runProc(proc *C.struct_RProc, args []interface{}) (Value, error) {
+	if ctx.noExec {
+		return Value{ctx: ctx, v: C.my_proc_value(proc)}, nil
+	}
+
+	restoreArgv, err := ctx.setArgv(args)
+	if err != nil {
+		return NilValue(ctx), err
+	}
+	defer restoreArgv()
+	defer ctx.preserveLocals()()
+
+	result := C.my_run_protected(ctx.mrb, proc)
+	if C.has_exception(ctx.mrb) != 0 {
+		return NilValue(ctx), newScriptError(ctx)
+	}
+
+	return Value{ctx: ctx, v: result}, nil
+}
+
+// checkBytecode validates the RITE header of bin. mruby itself only
+// checks the CRC of the binary and reads beyond the end of the buffer
+// for truncated binaries.
+func checkBytecode(bin []byte) error {
+	headerSize := int(C.my_rite_header_size())
+	if len(bin) < headerSize {
+		return fmt.Errorf("%w: too short", ErrInvalidBytecode)
+	}
+	if ident := C.GoString(C.my_rite_ident()); string(bin[0:4]) != ident {
+		return fmt.Errorf("%w: expected identifier %q, got %q", ErrInvalidBytecode, ident, bin[0:4])
+	}
+	if version := C.GoString(C.my_rite_version()); string(bin[4:8]) != version {
+		return fmt.Errorf("%w: expected format version %q, got %q", ErrInvalidBytecode, version, bin[4:8])
+	}
+	// Header: ident[4], version[4], crc[2], size[4], compiler name[4], compiler version[4]
+	if size := binary.BigEndian.Uint32(bin[10:14]); int64(size) > int64(len(bin)) || int(size) < headerSize {
+		return fmt.Errorf("%w: binary size %d does not match length %d", ErrInvalidBytecode, size, len(bin))
+	}
+	return nil
+}
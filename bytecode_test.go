@@ -0,0 +1,109 @@
+// Copyright 2013-2015 Oliver Eilhard.
+// Use of this source code is governed by the MIT LICENSE that
+// can be found in the MIT-LICENSE file included in the project.
+
+package mruby
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestBytecode(t *testing.T) {
+	ctx := NewContext()
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	parser, err := ctx.Parse("def greet(name)\n  \"Hello, #{name}\"\nend\ngreet(ARGV[0])")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin, err := parser.Bytecode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bin) < 4 || string(bin[0:4]) != "RITE" {
+		t.Fatalf("expected RITE binary; got: %q", bin)
+	}
+
+	// Load in a fresh context without the parser
+	other := NewContext()
+	if other == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+	val, err := other.LoadBytecode(bin, "Oliver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := val.ToString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "Hello, Oliver" {
+		t.Errorf("expected %q; got: %q", "Hello, Oliver", s)
+	}
+}
+
+func TestBytecodeRunError(t *testing.T) {
+	ctx := NewContext()
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	parser, err := ctx.Parse("raise 'kaboom'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin, err := parser.Bytecode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ctx.LoadBytecode(bin)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if _, ok := err.(*RunError); !ok {
+		t.Fatalf("expected RunError; got: %T", err)
+	}
+}
+
+func TestLoadBytecodeInvalid(t *testing.T) {
+	ctx := NewContext()
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	parser, err := ctx.Parse("1 + 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin, err := parser.Bytecode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrongIdent := append([]byte("EVIL"), bin[4:]...)
+	wrongVersion := append(append([]byte{}, bin[0:4]...), append([]byte("9999"), bin[8:]...)...)
+
+	tests := []struct {
+		Name string
+		Bin  []byte
+	}{
+		{"empty", nil},
+		{"truncated header", bin[0:10]},
+		{"truncated body", bin[0 : len(bin)-1]},
+		{"wrong identifier", wrongIdent},
+		{"wrong version", wrongVersion},
+	}
+	for _, test := range tests {
+		_, err := ctx.LoadBytecode(test.Bin)
+		if err == nil {
+			t.Errorf("%s: expected error", test.Name)
+			continue
+		}
+		if !errors.Is(err, ErrInvalidBytecode) {
+			t.Errorf("%s: expected ErrInvalidBytecode; got: %v", test.Name, err)
+		}
+	}
+}
@@ -28,6 +28,11 @@ type Class struct {
 // in the context.
 // If super is nil, ObjectClass is used by default.
 func NewClass(ctx *Context, name string, super *Class) (*Class, error) {
+	ctx.enter()
+	defer ctx.leave()
+
+	ctx.recordNewClass(name, super, nil)
+
 	if super == nil {
 		super = ctx.ObjectClass()
 	}
@@ -38,6 +43,11 @@ func NewClass(ctx *Context, name string, super *Class) (*Class, error) {
 }
 
 func NewClassUnder(ctx *Context, name string, super *Class, outer RClass) (*Class, error) {
+	ctx.enter()
+	defer ctx.leave()
+
+	ctx.recordNewClass(name, super, outer)
+
 	if super == nil {
 		super = ctx.ObjectClass()
 	}
@@ -74,6 +84,9 @@ func (ctx *Context) DefineClassUnder(name string, super *Class, outer RClass) (*
 
 // HasClass tests if the context has a class with the given name.
 func (ctx *Context) HasClass(name string, outer RClass) bool {
+	ctx.enter()
+	defer ctx.leave()
+
 	cname := C.CString(name)
 	defer C.free(unsafe.Pointer(cname))
 	var klass *C.struct_RClass
@@ -86,6 +99,9 @@ func (ctx *Context) HasClass(name string, outer RClass) bool {
 
 // GetClass returns the given class.
 func (ctx *Context) GetClass(name string, outer RClass) (*Class, bool) {
+	ctx.enter()
+	defer ctx.leave()
+
 	if !ctx.HasClass(name, outer) {
 		return nil, false
 	}
@@ -107,6 +123,10 @@ func (ctx *Context) GetClass(name string, outer RClass) (*Class, bool) {
 // DefineMethod registers an instance method with the name in the class.
 // The function is called when executed in Ruby.
 func (c *Class) DefineMethod(name string, f Function) {
+	c.ctx.enter()
+	defer c.ctx.leave()
+
+	c.ctx.recordMethod(c.class, false, false, name, f)
 	c.ctx.addMethod(c.class, name, f)
 
 	cname := C.CString(name)
@@ -125,6 +145,10 @@ func (c *Class) DefineMethod(name string, f Function) {
 // DefineMethod registers a class method with the name in the class.
 // The function is called when executed in Ruby.
 func (c *Class) DefineClassMethod(name string, f Function) {
+	c.ctx.enter()
+	defer c.ctx.leave()
+
+	c.ctx.recordMethod(c.class, false, true, name, f)
 	c.ctx.addMethod(c.class.c, name, f)
 
 	cname := C.CString(name)
@@ -0,0 +1,263 @@
+// Copyright 2013-2015 Oliver Eilhard.
+// Use of this source code is governed by the MIT LICENSE that
+// can be found in the MIT-LICENSE file included in the project.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	mruby "github.com/olivere/mruby-go"
+)
+
+// debugHelp lists the commands of the debugger.
+const debugHelp = `Commands:
+  b, break [file:]line   set a breakpoint at a line
+  b, break method        set a breakpoint at a method, e.g. Greeter#greet
+  d, delete id           delete a breakpoint
+  i, info                list breakpoints
+  c, continue            run until the next breakpoint
+  s, step                step to the next line, entering methods
+  n, next                step to the next line of the current method
+  f, finish              run until the current method returns
+  l, list                show the source around the current line
+  locals                 show local variables
+  self                   show self
+  bt, backtrace          show the call stack
+  p, print name          show a local or instance variable
+  q, quit                abort the script
+  h, help                show this help`
+
+// runDebug implements "mruby-go debug" and returns the exit code.
+func runDebug(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("debug", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: mruby-go debug [flags] file [args...]")
+		fs.PrintDefaults()
+	}
+	var requires fileList
+	fs.Var(&requires, "r", "load `file` before running the script (may be repeated)")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	argv := fs.Args()
+	if len(argv) == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+	filename, argv := argv[0], argv[1:]
+	source, err := ioutil.ReadFile(filename)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+
+	ctx, err := mruby.OpenContext(mruby.SetStdout(stdout), mruby.SetStderr(stderr))
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitRunError
+	}
+	defer ctx.Close()
+	for _, name := range requires {
+		if _, err := ctx.LoadFile(name); err != nil {
+			return printError(stderr, err)
+		}
+	}
+
+	s := &debugSession{
+		filename: filename,
+		in:       bufio.NewScanner(stdin),
+		out:      stdout,
+		sources:  map[string][]string{filename: strings.Split(string(source), "\n")},
+	}
+	s.dbg, err = mruby.NewDebugger(ctx, s.pause)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitRunError
+	}
+	s.dbg.Pause()
+
+	scriptArgs := make([]interface{}, 0, len(argv))
+	for _, arg := range argv {
+		scriptArgs = append(scriptArgs, arg)
+	}
+	if _, err := ctx.LoadReader(filename, bytes.NewReader(source), scriptArgs...); err != nil {
+		if s.quit {
+			return exitOK
+		}
+		return printError(stderr, err)
+	}
+	return exitOK
+}
+
+// debugSession is the line-oriented front-end of the debugger.
+type debugSession struct {
+	dbg      *mruby.Debugger
+	filename string // script being debugged
+	in       *bufio.Scanner
+	out      io.Writer
+	sources  map[string][]string // lines by filename, for list
+	quit     bool
+}
+
+// pause shows where the script has been paused and reads commands
+// until one of them continues the script.
+func (s *debugSession) pause(p *mruby.Pause) mruby.DebugCommand {
+	if p.Breakpoint != nil {
+		fmt.Fprintf(s.out, "Breakpoint %d, ", p.Breakpoint.ID)
+	}
+	fmt.Fprintf(s.out, "%s at %s:%d\n", p.Function, p.Filename, p.Line)
+	s.list(p, p.Line, p.Line)
+
+	for {
+		fmt.Fprint(s.out, "(mruby-go) ")
+		if !s.in.Scan() {
+			// No more commands: run the script to its end
+			fmt.Fprintln(s.out)
+			s.dbg.Close()
+			return mruby.DebugContinue
+		}
+		fields := strings.Fields(s.in.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		cmd, arg := fields[0], strings.Join(fields[1:], " ")
+		switch cmd {
+		case "c", "continue":
+			return mruby.DebugContinue
+		case "s", "step":
+			return mruby.DebugStepIn
+		case "n", "next":
+			return mruby.DebugStepOver
+		case "f", "finish":
+			return mruby.DebugStepOut
+		case "q", "quit":
+			s.quit = true
+			return mruby.DebugAbort
+		case "b", "break":
+			s.setBreakpoint(p, arg)
+		case "d", "delete":
+			id, err := strconv.Atoi(arg)
+			if err == nil {
+				err = s.dbg.Delete(id)
+			}
+			if err != nil {
+				fmt.Fprintf(s.out, "cannot delete breakpoint %q: %v\n", arg, err)
+			}
+		case "i", "info":
+			for _, bp := range s.dbg.Breakpoints() {
+				fmt.Fprintf(s.out, "%d\t%s\n", bp.ID, bp)
+			}
+		case "l", "list":
+			s.list(p, p.Line-5, p.Line+5)
+		case "locals":
+			locals := p.Locals()
+			names := make([]string, 0, len(locals))
+			for name := range locals {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				fmt.Fprintf(s.out, "%s = %s\n", name, inspect(locals[name]))
+			}
+		case "self":
+			fmt.Fprintln(s.out, inspect(p.Self()))
+		case "bt", "backtrace":
+			for i, line := range p.Backtrace() {
+				fmt.Fprintf(s.out, "#%d %s\n", i, line)
+			}
+		case "p", "print":
+			s.print(p, arg)
+		case "h", "help":
+			fmt.Fprintln(s.out, debugHelp)
+		default:
+			fmt.Fprintf(s.out, "unknown command %q; try help\n", cmd)
+		}
+	}
+}
+
+// setBreakpoint sets a breakpoint given as "file:line", "line" (in the
+// current file), or a method name.
+func (s *debugSession) setBreakpoint(p *mruby.Pause, arg string) {
+	if arg == "" {
+		fmt.Fprintln(s.out, "usage: break [file:]line | method")
+		return
+	}
+	filename, lineStr := p.Filename, arg
+	if i := strings.LastIndex(arg, ":"); i > 0 {
+		filename, lineStr = arg[:i], arg[i+1:]
+	}
+	var id int
+	if line, err := strconv.Atoi(lineStr); err == nil {
+		if filename == "" {
+			filename = s.filename
+		}
+		id = s.dbg.Break(filename, line)
+	} else {
+		id = s.dbg.BreakMethod(arg)
+	}
+	bps := s.dbg.Breakpoints()
+	fmt.Fprintf(s.out, "Breakpoint %d at %s\n", id, bps[len(bps)-1])
+}
+
+// print prints a local variable, or an instance variable of self.
+func (s *debugSession) print(p *mruby.Pause, name string) {
+	var v mruby.Value
+	var err error
+	if strings.HasPrefix(name, "@") {
+		v, err = p.Self().Call("instance_variable_get", name)
+	} else {
+		v, err = p.Local(name)
+	}
+	if err != nil {
+		fmt.Fprintln(s.out, err)
+		return
+	}
+	fmt.Fprintln(s.out, inspect(v))
+}
+
+// list prints the lines from..to of the current file, if available.
+func (s *debugSession) list(p *mruby.Pause, from, to int) {
+	lines, found := s.sources[p.Filename]
+	if !found {
+		if data, err := ioutil.ReadFile(p.Filename); err == nil {
+			lines = strings.Split(string(data), "\n")
+		}
+		s.sources[p.Filename] = lines
+	}
+	if from < 1 {
+		from = 1
+	}
+	if to > len(lines) {
+		to = len(lines)
+	}
+	for n := from; n <= to; n++ {
+		marker := " "
+		if n == p.Line {
+			marker = ">"
+		}
+		fmt.Fprintf(s.out, "%s %4d  %s\n", marker, n, lines[n-1])
+	}
+}
+
+// inspect returns the result of calling inspect on v.
+func inspect(v mruby.Value) string {
+	res, err := v.Call("inspect")
+	if err != nil {
+		return err.Error()
+	}
+	s, err := res.ToString()
+	if err != nil {
+		return err.Error()
+	}
+	return s
+}
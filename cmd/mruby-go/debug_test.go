@@ -0,0 +1,67 @@
+// Copyright 2013-2015 Oliver Eilhard.
+// Use of this source code is governed by the MIT LICENSE that
+// can be found in the MIT-LICENSE file included in the project.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunDebug(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mruby-go-debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := filepath.Join(dir, "sum.rb")
+	code := "def sum(list)\n  total = 0\n  list.each { |x| total += x }\n  total\nend\nputs sum(ARGV.map(&:to_i))\n"
+	if err := ioutil.WriteFile(script, []byte(code), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	commands := "break 4\ninfo\ncontinue\nlocals\np total\nbt\nfinish\nnext\n"
+	var stdout, stderr bytes.Buffer
+	exit := runDebug([]string{script, "1", "2", "3"}, strings.NewReader(commands), &stdout, &stderr)
+	if strings.Contains(stderr.String(), "hooks unavailable") {
+		t.Skip(stderr.String())
+	}
+	if exit != exitOK {
+		t.Fatalf("expected exit code %d; got: %d (%s)", exitOK, exit, stderr.String())
+	}
+
+	out := stdout.String()
+	for _, s := range []string{
+		"<main> at " + script + ":1\n",
+		"Breakpoint 1 at " + script + ":4\n",
+		"1\t" + script + ":4\n",
+		"Breakpoint 1, Object#sum at " + script + ":4\n",
+		">    4    total\n",
+		"list = [1, 2, 3]\n",
+		"total = 6\n",
+		"#0 " + script + ":4:in Object#sum\n",
+		"#1 " + script + ":6:in <main>\n",
+		"<main> at " + script + ":6\n",
+		"6\n",
+	} {
+		if !strings.Contains(out, s) {
+			t.Errorf("expected output to contain %q; got:\n%s", s, out)
+		}
+	}
+
+	// Quitting aborts the script
+	stdout.Reset()
+	exit = runDebug([]string{script}, strings.NewReader("quit\n"), &stdout, &stderr)
+	if exit != exitOK {
+		t.Errorf("expected exit code %d; got: %d", exitOK, exit)
+	}
+	if strings.Contains(stdout.String(), "\n0\n") {
+		t.Errorf("expected script to be aborted; got:\n%s", stdout.String())
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2013-2015 Oliver Eilhard.
+// Use of this source code is governed by the MIT LICENSE that
+// can be found in the MIT-LICENSE file included in the project.
+
+// Command mruby-go runs Ruby code with mruby-go.
+//
+// Usage:
+//
+//	mruby-go [repl] [-r file]... [-history file]
+//	mruby-go run [-c] [-o file] [-r file]... [file | -e code] [args...]
+//	mruby-go debug [-r file]... file [args...]
+//
+// Without a command, or with the repl command, mruby-go starts an
+// interactive shell. Files given via -r are loaded before the first
+// prompt. To use the shell with your own Go-defined modules, build a
+// command that sets up a Context and runs it with package repl.
+//
+// The run command runs a script, given as a file ("-" for standard
+// input), or as code via -e. The remaining arguments are passed to the
+// script in ARGV. Files containing bytecode, e.g. as written by -o, are
+// run as well. Flags:
+//
+//	-c       check the syntax only
+//	-e code  run code instead of a file
+//	-o file  compile the script to bytecode and write it to file
+//	-r file  load file before running the script (may be repeated)
+//
+// Errors are printed as "file:line: Class: message", followed by the
+// backtrace. The exit code is 1 if the script raised an exception,
+// 2 for invalid usage, and 3 if the script could not be parsed.
+//
+// The debug command runs a script in the debugger, paused at its first
+// line. Set breakpoints by line or method, step through the script, and
+// inspect local variables and the call stack; type help for a list of
+// commands. The debugger requires mruby to be compiled with
+// MRB_ENABLE_DEBUG_HOOK, and mruby-go to be built with the
+// mruby_debug_hook tag.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	mruby "github.com/olivere/mruby-go"
+	"github.com/olivere/mruby-go/repl"
+)
+
+func main() {
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "run" {
+		os.Exit(runScript(args[1:], os.Stdin, os.Stdout, os.Stderr))
+	}
+	if len(args) > 0 && args[0] == "debug" {
+		os.Exit(runDebug(args[1:], os.Stdin, os.Stdout, os.Stderr))
+	}
+	if len(args) > 0 && args[0] == "repl" {
+		args = args[1:]
+	}
+	os.Exit(runREPL(args))
+}
+
+// fileList is a flag that may be given more than once.
+type fileList []string
+
+func (l *fileList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *fileList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// runREPL starts the interactive shell and returns the exit code.
+func runREPL(args []string) int {
+	fs := flag.NewFlagSet("repl", flag.ContinueOnError)
+	var requires fileList
+	fs.Var(&requires, "r", "load `file` before the first prompt (may be repeated)")
+	history := fs.String("history", defaultHistoryFile(), "history `file`; empty to disable")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	ctx, err := mruby.OpenContext(
+		mruby.SetStdout(os.Stdout),
+		mruby.SetStderr(os.Stderr),
+		mruby.SetKeepLocals(true),
+	)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	for _, filename := range requires {
+		if _, err := ctx.LoadFile(filename); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", filename, err)
+			return 1
+		}
+	}
+
+	r := repl.New(ctx, repl.SetHistoryFile(*history))
+	if err := r.Run(os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// defaultHistoryFile returns the name of the history file in the home
+// directory of the user, or an empty string if there is none.
+func defaultHistoryFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".mruby_go_history")
+}
@@ -0,0 +1,137 @@
+// Copyright 2013-2015 Oliver Eilhard.
+// Use of this source code is governed by the MIT LICENSE that
+// can be found in the MIT-LICENSE file included in the project.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	mruby "github.com/olivere/mruby-go"
+)
+
+// Exit codes of the run command.
+const (
+	exitOK         = 0
+	exitRunError   = 1 // the script raised an exception
+	exitUsage      = 2 // invalid command line
+	exitParseError = 3 // the script could not be parsed
+)
+
+// runScript implements "mruby-go run" and returns the exit code.
+func runScript(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: mruby-go run [flags] [file | -e code] [args...]")
+		fs.PrintDefaults()
+	}
+	code := fs.String("e", "", "run `code` instead of a file; all arguments are passed to ARGV")
+	check := fs.Bool("c", false, "check syntax only")
+	output := fs.String("o", "", "compile to bytecode and write it to `file` instead of running")
+	var requires fileList
+	fs.Var(&requires, "r", "load `file` before running the script (may be repeated)")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	var filename string
+	var source []byte
+	argv := fs.Args()
+	if *code != "" {
+		filename, source = "-e", []byte(*code)
+	} else {
+		if len(argv) == 0 {
+			fs.Usage()
+			return exitUsage
+		}
+		var err error
+		filename, argv = argv[0], argv[1:]
+		if filename == "-" {
+			source, err = ioutil.ReadAll(stdin)
+		} else {
+			source, err = ioutil.ReadFile(filename)
+		}
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitUsage
+		}
+	}
+
+	if *output != "" {
+		prog, err := mruby.Compile(string(source), filename)
+		if err != nil {
+			return printError(stderr, err)
+		}
+		if err := ioutil.WriteFile(*output, prog.Bytecode(), 0644); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitRunError
+		}
+		return exitOK
+	}
+
+	ctx, err := mruby.OpenContext(
+		mruby.SetNoExec(*check),
+		mruby.SetStdout(stdout),
+		mruby.SetStderr(stderr),
+		mruby.SetStdin(stdin),
+	)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitRunError
+	}
+	defer ctx.Close()
+
+	if !*check {
+		for _, name := range requires {
+			if _, err := ctx.LoadFile(name); err != nil {
+				return printError(stderr, err)
+			}
+		}
+	}
+
+	scriptArgs := make([]interface{}, 0, len(argv))
+	for _, arg := range argv {
+		scriptArgs = append(scriptArgs, arg)
+	}
+
+	if bytes.HasPrefix(source, []byte("RITE")) {
+		_, err = ctx.LoadBytecode(source, scriptArgs...)
+	} else {
+		_, err = ctx.LoadReader(filename, bytes.NewReader(source), scriptArgs...)
+	}
+	if err != nil {
+		return printError(stderr, err)
+	}
+	if *check {
+		fmt.Fprintln(stdout, "Syntax OK")
+	}
+	return exitOK
+}
+
+// printError prints err in the format "file:line: Class: message",
+// followed by the backtrace, and returns the matching exit code.
+func printError(w io.Writer, err error) int {
+	switch e := err.(type) {
+	case *mruby.ParseError:
+		fmt.Fprintf(w, "%s:%d: SyntaxError: %s\n", e.Filename, e.Line, e.Message)
+		return exitParseError
+	case *mruby.RunError:
+		if e.Filename != "" {
+			fmt.Fprintf(w, "%s:%d: %s: %s\n", e.Filename, e.Line, e.Class, e.Message)
+		} else {
+			fmt.Fprintf(w, "%s: %s\n", e.Class, e.Message)
+		}
+		for _, line := range e.Backtrace {
+			fmt.Fprintf(w, "\tfrom %s\n", line)
+		}
+		return exitRunError
+	default:
+		fmt.Fprintln(w, err)
+		return exitRunError
+	}
+}
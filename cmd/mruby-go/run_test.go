@@ -0,0 +1,67 @@
+// Copyright 2013-2015 Oliver Eilhard.
+// Use of this source code is governed by the MIT LICENSE that
+// can be found in the MIT-LICENSE file included in the project.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunScript(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mruby-go-run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, code string) string {
+		filename := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(filename, []byte(code), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+	hello := write("hello.rb", "puts \"Hello, #{ARGV.join(' ')}#{$suffix}\"")
+	lib := write("lib.rb", "$suffix = '!'")
+	broken := write("broken.rb", "1 +\n)")
+	raise := write("raise.rb", "\nraise ArgumentError, 'kaboom'")
+	bytecode := filepath.Join(dir, "hello.mrb")
+
+	tests := []struct {
+		Args   []string
+		Code   int
+		Stdout string
+		Stderr string
+	}{
+		{[]string{hello, "Oliver", "Eilhard"}, exitOK, "Hello, Oliver Eilhard\n", ""},
+		{[]string{"-r", lib, hello, "Oliver"}, exitOK, "Hello, Oliver!\n", ""},
+		{[]string{"-e", "puts ARGV.size", "a", "b"}, exitOK, "2\n", ""},
+		{[]string{"-c", hello}, exitOK, "Syntax OK\n", ""},
+		{[]string{"-c", broken}, exitParseError, "", broken + ":2: SyntaxError: "},
+		{[]string{broken}, exitParseError, "", broken + ":2: SyntaxError: "},
+		{[]string{raise}, exitRunError, "", raise + ":2: ArgumentError: kaboom\n"},
+		{[]string{"-o", bytecode, hello}, exitOK, "", ""},
+		{[]string{bytecode, "bytecode"}, exitOK, "Hello, bytecode\n", ""},
+		{[]string{}, exitUsage, "", "usage: "},
+		{[]string{"-unknown"}, exitUsage, "", ""},
+	}
+	for _, test := range tests {
+		var stdout, stderr bytes.Buffer
+		code := runScript(test.Args, strings.NewReader(""), &stdout, &stderr)
+		if code != test.Code {
+			t.Errorf("%v: expected exit code %d; got: %d (%s)", test.Args, test.Code, code, stderr.String())
+		}
+		if stdout.String() != test.Stdout {
+			t.Errorf("%v: expected output %q; got: %q", test.Args, test.Stdout, stdout.String())
+		}
+		if !strings.HasPrefix(stderr.String(), test.Stderr) {
+			t.Errorf("%v: expected error output to start with %q; got: %q", test.Args, test.Stderr, stderr.String())
+		}
+	}
+}
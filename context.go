@@ -11,8 +11,14 @@ package mruby
 import "C"
 
 import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
 	"reflect"
 	"runtime"
+	"strconv"
 	"sync"
 	"unsafe"
 )
@@ -30,24 +36,59 @@ type Context struct {
 	methodsMu       sync.Mutex // guards the next variables
 	methodsByRClass map[*C.struct_RClass]methodMap
 
-	noExec   bool   // automatically "run" the scripts given to the context
-	filename string // filename used internally
+	noExec          bool      // automatically "run" the scripts given to the context
+	filename        string    // filename used internally
+	lenientIntegers bool      // accept integral Floats in Value.ToInt and friends
+	keepLocals      bool      // keep top-level locals between LoadString calls
+	stdout          io.Writer // destination of $stdout, puts, print, and p
+	stderr          io.Writer // destination of $stderr and warn
+	stdin           io.Reader // source of $stdin and gets
+	sandbox         *Sandbox  // policy applied before any user code runs
+	loader          *loader   // implements require and load, if enabled
+
+	argvDepth int                          // number of scripts running with ARGV set
+	programs  map[*Program]*C.struct_RProc // programs loaded by Run
+	failed    bool                         // a script raised an exception
+
+	options     []func(*Context) // options given to NewContext
+	recordSetup bool             // record setup after NewContext returns
+	recording   bool             // setup is being recorded
+	recordDepth int              // number of recorded scripts running
+	setupSteps  []setupStep      // recorded setup
+	recordErr   error            // setup that cannot be recorded
+
+	raceDetection bool       // panic on concurrent use
+	raceMu        sync.Mutex // protects owner and active
+	owner         uint64     // goroutine calling into the VM, see enter
+	active        int        // number of calls into the VM by owner
+
+	traceHook     func(TraceEvent)   // see SetTraceHook
+	coverage      *Coverage          // see SetCoverage
+	coverageIreps map[irepLines]bool // code whose lines are known to coverage
+	profiler      *profiler          // see StartProfile
+	debugger      *Debugger          // see NewDebugger
 }
 
 // NewContext creates a new mruby context. Use the options to handle
-// configuration.
+// configuration. It returns nil if the context cannot be set up, e.g.
+// if the sandbox cannot be applied; use OpenContext to get the error.
 //
 // Examples:
-//   ctx := mruby.NewContext()
-//   ctx := mruby.NewContext(mruby.SetNoExec(true), mruby.SetFilename("simple.rb"))
+//
+//	ctx := mruby.NewContext()
+//	ctx := mruby.NewContext(mruby.SetNoExec(true), mruby.SetFilename("simple.rb"))
 func NewContext(options ...func(*Context)) *Context {
-	contextsFu.Lock()
-	defer contextsFu.Unlock()
-
-	if contexts == nil {
-		contexts = make(map[*C.mrb_state]*Context)
+	ctx, err := OpenContext(options...)
+	if err != nil {
+		return nil
 	}
+	return ctx
+}
 
+// OpenContext is like NewContext, but returns an error if the context
+// cannot be set up, e.g. if the standard streams, the sandbox, or
+// require cannot be set up.
+func OpenContext(options ...func(*Context)) (*Context, error) {
 	ctx := &Context{
 		noExec:   false,
 		filename: "(mruby-go)",
@@ -57,6 +98,7 @@ func NewContext(options ...func(*Context)) *Context {
 	for _, option := range options {
 		option(ctx)
 	}
+	ctx.options = options
 
 	// Finalize setup of MRB context
 	cfilename := C.CString(ctx.filename)
@@ -71,20 +113,63 @@ func NewContext(options ...func(*Context)) *Context {
 
 	ctx.mrb = C.mrb_open()
 	ctx.ctx = C.my_context_new(ctx.mrb, cfilename, captureErrors, noExec)
+	if ctx.keepLocals {
+		C.my_context_keep_locals(ctx.ctx)
+	}
+	C.my_argv_set(ctx.mrb, C.mrb_ary_new(ctx.mrb))
 
 	runtime.SetFinalizer(ctx, func(x *Context) {
-		contextsFu.Lock()
-		delete(contexts, x.mrb)
-		C.mrbc_context_free(x.mrb, x.ctx)
-		C.mrb_close(x.mrb)
-		x.mrb = nil
-		x.ctx = nil
-		contextsFu.Unlock()
+		x.close()
 	})
 
+	contextsFu.Lock()
+	if contexts == nil {
+		contexts = make(map[*C.mrb_state]*Context)
+	}
 	contexts[ctx.mrb] = ctx
+	contextsFu.Unlock()
 
-	return ctx
+	if err := ctx.setup(); err != nil {
+		ctx.Close()
+		return nil, err
+	}
+
+	// Record setup by the caller only, see Snapshot
+	ctx.recording = ctx.recordSetup
+
+	return ctx, nil
+}
+
+// setup prepares the context according to its options, before any
+// user code runs.
+func (ctx *Context) setup() error {
+	// Replace standard streams with Go-backed ones
+	if ctx.stdout != nil || ctx.stderr != nil {
+		if err := ctx.setupStdio(); err != nil {
+			return fmt.Errorf("cannot set up standard streams: %v", err)
+		}
+	}
+	if ctx.stdin != nil {
+		if err := ctx.setupStdin(); err != nil {
+			return fmt.Errorf("cannot set up standard input: %v", err)
+		}
+	}
+
+	// Restrict the context before any user code runs
+	if ctx.sandbox != nil {
+		if err := ctx.applySandbox(ctx.sandbox); err != nil {
+			return fmt.Errorf("cannot apply sandbox: %v", err)
+		}
+	}
+
+	// Loading scripts is set up after the sandbox has been applied,
+	// as the sandbox might remove require and load implemented by gems
+	if ctx.loader != nil && ctx.loader.fsys != nil {
+		if err := ctx.setupLoader(); err != nil {
+			return fmt.Errorf("cannot set up require: %v", err)
+		}
+	}
+	return nil
 }
 
 // SetNoExec indicates whether scripts given to this context, e.g. via
@@ -96,6 +181,17 @@ func SetNoExec(noExec bool) func(*Context) {
 	}
 }
 
+// SetKeepLocals enables a session mode in which top-level local variables
+// are kept between calls of LoadString, like in a REPL. Without it, a
+// variable assigned in one script is undefined in the next. See Locals
+// for reading them from Go.
+// It is used for configuring a Context (see NewContext for details).
+func SetKeepLocals(keep bool) func(*Context) {
+	return func(ctx *Context) {
+		ctx.keepLocals = keep
+	}
+}
+
 // SetFilename sets the filename to be used in the context (default: "(mruby-go)").
 // It is used for configuring a Context (see NewContext for details).
 func SetFilename(filename string) func(*Context) {
@@ -104,13 +200,91 @@ func SetFilename(filename string) func(*Context) {
 	}
 }
 
+// SetLenientIntegers indicates whether Value.ToInt and its siblings accept
+// Ruby Floats without a fractional part, e.g. 3.0. By default, only Ruby
+// Fixnums are converted to Go integer types.
+// It is used for configuring a Context (see NewContext for details).
+func SetLenientIntegers(lenient bool) func(*Context) {
+	return func(ctx *Context) {
+		ctx.lenientIntegers = lenient
+	}
+}
+
+// SetStdout sets the destination of $stdout in the context. Kernel#puts,
+// Kernel#print, and Kernel#p write to $stdout. By default, mruby writes
+// directly to the standard output of the process.
+// It is used for configuring a Context (see NewContext for details).
+func SetStdout(w io.Writer) func(*Context) {
+	return func(ctx *Context) {
+		ctx.stdout = w
+	}
+}
+
+// SetStderr sets the destination of $stderr in the context. Kernel#warn
+// writes to $stderr. By default, mruby writes directly to the standard
+// error of the process.
+// It is used for configuring a Context (see NewContext for details).
+func SetStderr(w io.Writer) func(*Context) {
+	return func(ctx *Context) {
+		ctx.stderr = w
+	}
+}
+
+// SetStdin sets the source of $stdin in the context. $stdin provides
+// a minimal subset of Ruby's IO for reading, i.e. gets, read, each_line,
+// readlines, and eof?. Kernel#gets reads from $stdin.
+// It is used for configuring a Context (see NewContext for details).
+func SetStdin(r io.Reader) func(*Context) {
+	return func(ctx *Context) {
+		ctx.stdin = r
+	}
+}
+
+// Close releases all resources of the context. The context must not be
+// used afterwards. Calling Close is optional, as the resources are
+// released when the context is garbage collected, but it frees them
+// immediately, e.g. for contexts discarded by a Pool.
+func (ctx *Context) Close() {
+	runtime.SetFinalizer(ctx, nil)
+	ctx.close()
+}
+
+// close releases the mruby state of the context, if not done before.
+func (ctx *Context) close() {
+	contextsFu.Lock()
+	defer contextsFu.Unlock()
+	if ctx.mrb == nil {
+		return
+	}
+	delete(contexts, ctx.mrb)
+	if ctx.profiler != nil {
+		// Stop sampling before the hook state is freed
+		close(ctx.profiler.stop)
+		<-ctx.profiler.stopped
+		ctx.profiler = nil
+	}
+	C.my_hooks_free(ctx.mrb)
+	hookContexts.Delete(ctx.mrb)
+	C.mrbc_context_free(ctx.mrb, ctx.ctx)
+	C.mrb_close(ctx.mrb)
+	ctx.mrb = nil
+	ctx.ctx = nil
+	ctx.programs = nil
+}
+
 // GC runs the full MRuby garbage collector.
 func (ctx *Context) GC() {
+	ctx.enter()
+	defer ctx.leave()
+
 	C.mrb_full_gc(ctx.mrb)
 }
 
 // GC runs the incremental MRuby garbage collector.
 func (ctx *Context) IncrementalGC() {
+	ctx.enter()
+	defer ctx.leave()
+
 	C.mrb_incremental_gc(ctx.mrb)
 }
 
@@ -131,33 +305,156 @@ func (ctx *Context) KernelModule() *Module {
 
 // LoadString loads a snippet of Ruby code and returns its output.
 // An error is returned if the interpreter failes or the Ruby code
-// raises an exception of type RunError.
+// raises an exception of type RunError. Syntax errors are returned as
+// ParseError. LoadString may be called from a Go function called by a
+// running script; exceptions of the nested script are returned, too.
 func (ctx *Context) LoadString(code string, args ...interface{}) (Value, error) {
-	ccode := C.CString(code)
-	defer C.free(unsafe.Pointer(ccode))
+	if ctx.isRecording() {
+		step := setupStep{code: code, filename: ctx.filename, args: args}
+		return ctx.recordLoad(step, func() (Value, error) {
+			return ctx.LoadString(code, args...)
+		})
+	}
+
+	ctx.enter()
+	defer ctx.leave()
 
 	ai := C.mrb_gc_arena_save(ctx.mrb)
 	defer C.mrb_gc_arena_restore(ctx.mrb, ai)
 
-	// Create ARGV global variable and push the args into it
-	argv := C.CString("ARGV")
-	defer C.free(unsafe.Pointer(argv))
-	argvAry := C.mrb_ary_new_capa(ctx.mrb, C.mrb_int(len(args)))
+	// Only contexts that keep top-level locals share the compiler
+	// context between scripts, see SetKeepLocals
+	var proc *C.struct_RProc
+	var err error
+	if ctx.keepLocals {
+		proc, err = compileWith(ctx.mrb, ctx.ctx, code, ctx.filename)
+	} else {
+		proc, err = compile(ctx.mrb, code, ctx.filename, ctx.noExec)
+	}
+	if err != nil {
+		return NilValue(ctx), err
+	}
+	if ctx.noExec {
+		return Value{ctx: ctx, v: C.my_proc_value(proc)}, nil
+	}
+
+	restoreArgv, err := ctx.setArgv(args)
+	if err != nil {
+		return NilValue(ctx), err
+	}
+	defer restoreArgv()
+
+	result := C.my_run_protected_keep(ctx.mrb, proc, C.my_context_stack_keep(ctx.ctx))
+	if C.has_exception(ctx.mrb) != 0 {
+		return NilValue(ctx), newScriptError(ctx)
+	}
+
+	return Value{ctx: ctx, v: result}, nil
+}
+
+// LoadFile loads the Ruby script in the given file and returns its output.
+// Other than LoadString, the name of the file is used in error messages,
+// backtraces, and __FILE__. Parse errors are returned as ParseError,
+// exceptions raised by the script as RunError.
+func (ctx *Context) LoadFile(filename string, args ...interface{}) (Value, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return NilValue(ctx), err
+	}
+	defer f.Close()
+	return ctx.LoadReader(filename, f, args...)
+}
+
+// LoadReader loads a Ruby script from r and returns its output.
+// The name is used as the filename in error messages, backtraces,
+// and __FILE__. Parse errors are returned as ParseError, exceptions
+// raised by the script as RunError.
+func (ctx *Context) LoadReader(name string, r io.Reader, args ...interface{}) (Value, error) {
+	code, err := ioutil.ReadAll(r)
+	if err != nil {
+		return NilValue(ctx), err
+	}
+	if ctx.isRecording() {
+		step := setupStep{code: string(code), filename: name, args: args}
+		return ctx.recordLoad(step, func() (Value, error) {
+			return ctx.LoadReader(name, bytes.NewReader(code), args...)
+		})
+	}
+
+	ctx.enter()
+	defer ctx.leave()
+
+	ai := C.mrb_gc_arena_save(ctx.mrb)
+	defer C.mrb_gc_arena_restore(ctx.mrb, ai)
+
+	proc, err := compile(ctx.mrb, string(code), name, ctx.noExec)
+	if err != nil {
+		return NilValue(ctx), err
+	}
+	if ctx.noExec {
+		return Value{ctx: ctx, v: C.my_proc_value(proc)}, nil
+	}
+
+	restoreArgv, err := ctx.setArgv(args)
+	if err != nil {
+		return NilValue(ctx), err
+	}
+	defer restoreArgv()
+	defer ctx.preserveLocals()()
+
+	result := C.my_run_protected(ctx.mrb, proc)
+	if C.has_exception(ctx.mrb) != 0 {
+		return NilValue(ctx), newScriptError(ctx)
+	}
+
+	return Value{ctx: ctx, v: result}, nil
+}
+
+// setArgv makes ARGV refer to a new array with args for running a
+// script. Each script gets its own array, so scripts holding on to
+// ARGV don't see the arguments of later scripts. Call the returned
+// function when the script has finished. For scripts run while another
+// script is running, e.g. by a Go function called from Ruby, it
+// restores the ARGV of the outer script. Otherwise ARGV keeps referring
+// to the array, so the script may return it.
+func (ctx *Context) setArgv(args []interface{}) (func(), error) {
+	argv := C.mrb_ary_new_capa(ctx.mrb, C.mrb_int(len(args)))
 	for i := 0; i < len(args); i++ {
 		val, err := ctx.ToValue(args[i])
 		if err != nil {
-			return NilValue(ctx), err
+			return nil, err
 		}
-		C.mrb_ary_push(ctx.mrb, argvAry, val.v)
+		C.mrb_ary_push(ctx.mrb, argv, val.v)
 	}
-	C.mrb_define_global_const(ctx.mrb, argv, argvAry)
 
-	result := C.mrb_load_string_cxt(ctx.mrb, ccode, ctx.ctx)
-	if C.has_exception(ctx.mrb) != 0 {
-		return NilValue(ctx), newRunError(ctx, true)
+	ctx.argvDepth++
+	prev := C.my_argv_set(ctx.mrb, argv)
+	if ctx.argvDepth == 1 {
+		return func() { ctx.argvDepth-- }, nil
 	}
+	C.mrb_gc_register(ctx.mrb, prev)
+	return func() {
+		C.my_argv_set(ctx.mrb, prev)
+		C.mrb_gc_unregister(ctx.mrb, prev)
+		ctx.argvDepth--
+	}, nil
+}
 
-	return Value{ctx: ctx, v: result}, nil
+// loadInternal runs a snippet of Ruby code used by the package itself,
+// e.g. to set up the context. The code is always executed, regardless
+// of the SetNoExec option.
+func (ctx *Context) loadInternal(code string) error {
+	ccode := C.CString(code)
+	defer C.free(unsafe.Pointer(ccode))
+
+	ai := C.mrb_gc_arena_save(ctx.mrb)
+	defer C.mrb_gc_arena_restore(ctx.mrb, ai)
+
+	C.mrb_load_string(ctx.mrb, ccode)
+	if C.has_exception(ctx.mrb) != 0 {
+		return newRunError(ctx, true)
+	}
+	return nil
 }
 
 // LoadStringResult invokes LoadString and returns the Go value immediately.
@@ -171,19 +468,43 @@ func (ctx *Context) LoadStringResult(code string, args ...interface{}) (interfac
 }
 
 // ToValue stores the given value for encoding/decoding from/to Go and MRuby.
+//
+// Go integers are converted to Ruby Fixnums. As mruby has no Bignum,
+// an OverflowError is returned if an integer does not fit into a Fixnum,
+// e.g. a uint64 greater than the maximum mrb_int. Values are returned
+// as is. ErrForeignValue is returned for Values of another context;
+// convert them with ToInterface first.
 func (ctx *Context) ToValue(value interface{}) (Value, error) {
+	ctx.enter()
+	defer ctx.leave()
+
+	if v, ok := value.(Value); ok {
+		if v.ctx != ctx {
+			return NilValue(ctx), ErrForeignValue
+		}
+		return v, nil
+	}
 	valof := reflect.ValueOf(value)
 	switch valof.Kind() {
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		return Value{ctx: ctx, v: C.mrb_fixnum_value(C.mrb_int(valof.Int()))}, nil
+		i := valof.Int()
+		if i < int64(C.get_int_min()) || i > int64(C.get_int_max()) {
+			return NilValue(ctx), &OverflowError{Value: strconv.FormatInt(i, 10), Type: "Fixnum"}
+		}
+		return Value{ctx: ctx, v: C.mrb_fixnum_value(C.mrb_int(i))}, nil
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
-		return Value{ctx: ctx, v: C.mrb_fixnum_value(C.mrb_int(valof.Uint()))}, nil
+		u := valof.Uint()
+		if u > uint64(C.get_int_max()) {
+			return NilValue(ctx), &OverflowError{Value: strconv.FormatUint(u, 10), Type: "Fixnum"}
+		}
+		return Value{ctx: ctx, v: C.mrb_fixnum_value(C.mrb_int(u))}, nil
 	case reflect.Float32, reflect.Float64:
 		return Value{ctx: ctx, v: C.get_float_value(ctx.mrb, C.mrb_float(valof.Float()))}, nil
 	case reflect.String:
-		cs := C.CString(valof.String())
+		s := valof.String()
+		cs := C.CString(s)
 		defer C.free(unsafe.Pointer(cs))
-		return Value{ctx: ctx, v: C.mrb_str_new_cstr(ctx.mrb, cs)}, nil
+		return Value{ctx: ctx, v: C.mrb_str_new(ctx.mrb, cs, C.size_t(len(s)))}, nil
 	case reflect.Bool:
 		if valof.Bool() {
 			return Value{ctx: ctx, v: C.mrb_true_value()}, nil
@@ -193,26 +514,42 @@ func (ctx *Context) ToValue(value interface{}) (Value, error) {
 	case reflect.Array, reflect.Slice:
 		ary := C.mrb_ary_new(ctx.mrb)
 		for i := 0; i < valof.Len(); i++ {
-			elem, err := ctx.ToValue(valof.Index(i).Interface())
+			// Each element is reachable via ary once pushed, so there is
+			// no need to keep it in the arena.
+			_, err := ctx.WithArena(func() (Value, error) {
+				elem, err := ctx.ToValue(valof.Index(i).Interface())
+				if err != nil {
+					return NilValue(ctx), err
+				}
+				C.mrb_ary_push(ctx.mrb, ary, elem.v)
+				return NilValue(ctx), nil
+			})
 			if err != nil {
 				return NilValue(ctx), err
 			}
-			C.mrb_ary_push(ctx.mrb, ary, elem.v)
 		}
 		return Value{ctx: ctx, v: ary}, nil
 	case reflect.Map:
 		hsh := C.mrb_hash_new(ctx.mrb)
 		for _, key := range valof.MapKeys() {
 			mapvalue := valof.MapIndex(key)
-			keyv, err := ctx.ToValue(key.String())
-			if err != nil {
-				return NilValue(ctx), err
-			}
-			valv, err := ctx.ToValue(mapvalue.Interface())
+			// Keys and values are reachable via hsh once set, so there is
+			// no need to keep them in the arena.
+			_, err := ctx.WithArena(func() (Value, error) {
+				keyv, err := ctx.ToValue(key.String())
+				if err != nil {
+					return NilValue(ctx), err
+				}
+				valv, err := ctx.ToValue(mapvalue.Interface())
+				if err != nil {
+					return NilValue(ctx), err
+				}
+				C.mrb_hash_set(ctx.mrb, hsh, keyv.v, valv.v)
+				return NilValue(ctx), nil
+			})
 			if err != nil {
 				return NilValue(ctx), err
 			}
-			C.mrb_hash_set(ctx.mrb, hsh, keyv.v, valv.v)
 		}
 		return Value{ctx: ctx, v: hsh}, nil
 	case reflect.Interface:
@@ -229,6 +566,27 @@ func (ctx *Context) ToValue(value interface{}) (Value, error) {
 	return NilValue(ctx), nil
 }
 
+// WithArena runs f and restores the GC arena of the context afterwards,
+// so that temporary objects created in f can be collected. The Value
+// returned by f is protected in the restored arena and therefore stays
+// alive until the arena of the surrounding call is restored.
+//
+// Use WithArena in long-running Go functions that create lots of objects,
+// e.g. by calling ToValue in a loop, to avoid overflowing the GC arena.
+func (ctx *Context) WithArena(f func() (Value, error)) (Value, error) {
+	ctx.enter()
+	defer ctx.leave()
+
+	ai := C.mrb_gc_arena_save(ctx.mrb)
+	val, err := f()
+	C.mrb_gc_arena_restore(ctx.mrb, ai)
+	if err != nil {
+		return NilValue(ctx), err
+	}
+	C.mrb_gc_protect(ctx.mrb, val.v)
+	return val, nil
+}
+
 /*
 // GetArgs extracts the arguments from args.
 func (ctx *Context) GetArgs(format string, args Value) (Value, error) {
@@ -241,6 +599,9 @@ func (ctx *Context) GetArgs(format string, args Value) (Value, error) {
 
 // GetArgs extracts the arguments from args.
 func (ctx *Context) GetArgs() ([]Value, error) {
+	ctx.enter()
+	defer ctx.leave()
+
 	getArgLock.Lock()
 	defer getArgLock.Unlock()
 
@@ -5,7 +5,15 @@
 package mruby
 
 import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"testing/fstest"
 	"time"
 )
 
@@ -29,6 +37,26 @@ func TestNewContextWithOptions(t *testing.T) {
 	}
 }
 
+func TestOpenContextError(t *testing.T) {
+	// Setting up require needs Module#const_defined?
+	options := []func(*Context){
+		SetLoadFS(fstest.MapFS{}),
+		SetSandbox(&Sandbox{
+			DenyMethods: map[string][]string{"Module": {"const_defined?"}},
+		}),
+	}
+	ctx, err := OpenContext(options...)
+	if err == nil {
+		t.Fatal("expected error setting up require")
+	}
+	if ctx != nil {
+		t.Errorf("expected no context; got: %v", ctx)
+	}
+	if ctx := NewContext(options...); ctx != nil {
+		t.Error("expected NewContext() to be nil")
+	}
+}
+
 func TestLoadString(t *testing.T) {
 	ctx := NewContext()
 	if ctx == nil {
@@ -109,6 +137,118 @@ func TestLoadStringWithArgs(t *testing.T) {
 	}
 }
 
+func TestArgvPerScript(t *testing.T) {
+	ctx := NewContext()
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	if _, err := ctx.LoadString("$argv = ARGV", "first"); err != nil {
+		t.Fatal(err)
+	}
+	res, err := ctx.LoadStringResult("[$argv[0], ARGV.size, ARGV[0]]", "second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := res.([]interface{})
+	if !ok || len(got) != 3 || got[0] != "first" || got[1] != 1 || got[2] != "second" {
+		t.Errorf("expected each script to have its own ARGV; got: %v", res)
+	}
+
+	// Scripts without arguments see an empty ARGV
+	res, err = ctx.LoadStringResult("ARGV.size")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != 0 {
+		t.Errorf("expected %d, got %v", 0, res)
+	}
+}
+
+func TestArgvIsRestoredAfterNestedScript(t *testing.T) {
+	ctx := NewContext()
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	mod, err := ctx.DefineModule("Nested", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mod.DefineClassMethod("run", func(ctx *Context) (Value, error) {
+		return ctx.LoadString("ARGV[0]", "inner")
+	})
+
+	res, err := ctx.LoadStringResult("[Nested.run, ARGV[0]]", "outer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := res.([]interface{})
+	if !ok || len(got) != 2 || got[0] != "inner" || got[1] != "outer" {
+		t.Errorf("expected %v; got: %v", []interface{}{"inner", "outer"}, res)
+	}
+}
+
+func TestNestedScriptRaises(t *testing.T) {
+	ctx := NewContext()
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	var loadErr, runErr error
+	mod, err := ctx.DefineModule("Nested", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mod.DefineClassMethod("load", func(ctx *Context) (Value, error) {
+		_, loadErr = ctx.LoadString(`raise ArgumentError, "inner"`)
+		return ctx.ToValue("loaded")
+	})
+	mod.DefineClassMethod("run", func(ctx *Context) (Value, error) {
+		parser, err := ctx.Parse(`raise ArgumentError, "parsed"`)
+		if err != nil {
+			return NilValue(ctx), err
+		}
+		_, runErr = parser.Run()
+		return ctx.ToValue("run")
+	})
+
+	// The outer script continues after the nested scripts have raised
+	res, err := ctx.LoadStringResult(`[Nested.load, Nested.run, 1 + 2]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := res.([]interface{})
+	if !ok || len(got) != 3 || got[0] != "loaded" || got[1] != "run" || got[2] != 3 {
+		t.Errorf("expected %v; got: %v", []interface{}{"loaded", "run", 3}, res)
+	}
+	for _, test := range []struct {
+		err     error
+		message string
+	}{
+		{loadErr, "inner"},
+		{runErr, "parsed"},
+	} {
+		e, ok := test.err.(*RunError)
+		if !ok {
+			t.Errorf("expected RunError; got: %v", test.err)
+			continue
+		}
+		if e.Class != "ArgumentError" || e.Message != test.message {
+			t.Errorf("expected ArgumentError %q; got: %s %q", test.message, e.Class, e.Message)
+		}
+	}
+
+	// The context is still usable
+	res, err = ctx.LoadStringResult(`40 + 2`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != 42 {
+		t.Errorf("expected %d; got: %v", 42, res)
+	}
+}
+
 func TestNoExec(t *testing.T) {
 	ctx := NewContext(SetNoExec(true))
 	if ctx == nil {
@@ -171,10 +311,17 @@ func TestTimeout(t *testing.T) {
 		t.Fatal("expected NewContext() to be != nil")
 	}
 
+	// The script loops until the test has timed out, so it doesn't
+	// keep running inside the context after the test.
+	var stopped int32
+	ctx.KernelModule().DefineMethod("stopped?", func(ctx *Context) (Value, error) {
+		return ctx.ToValue(atomic.LoadInt32(&stopped) != 0)
+	})
+
 	done := make(chan bool, 1)
 
 	go func() {
-		ctx.LoadString("loop {}")
+		ctx.LoadString("loop { break if stopped? }")
 		done <- true
 	}()
 
@@ -187,6 +334,11 @@ func TestTimeout(t *testing.T) {
 		completed = false
 	}
 
+	atomic.StoreInt32(&stopped, 1)
+	if !completed {
+		<-done
+	}
+
 	if completed {
 		t.Fatal("expected to time out, but script completed")
 	}
@@ -455,3 +607,172 @@ func TestPtrValuesInHash(t *testing.T) {
 		t.Errorf("expected got=%v; got: %v", nil, got)
 	}
 }
+
+func TestWithArena(t *testing.T) {
+	ctx := NewContext()
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	val, err := ctx.WithArena(func() (Value, error) {
+		for i := 0; i < 10000; i++ {
+			if _, err := ctx.ToValue("garbage"); err != nil {
+				return NilValue(ctx), err
+			}
+		}
+		return ctx.ToValue([]string{"Oliver", "Sandra"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx.GC()
+
+	got, err := val.ToArray()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []interface{}{"Oliver", "Sandra"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v; got: %v", expected, got)
+	}
+
+	_, err = ctx.WithArena(func() (Value, error) {
+		return NilValue(ctx), errors.New("kaboom")
+	})
+	if err == nil || err.Error() != "kaboom" {
+		t.Errorf("expected error %q; got: %v", "kaboom", err)
+	}
+}
+
+func TestLargeArrayFromFunction(t *testing.T) {
+	ctx := NewContext()
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	module, err := ctx.DefineModule("Data", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	module.DefineClassMethod("rows", func(ctx *Context) (Value, error) {
+		rows := make([][]string, 10000)
+		for i := range rows {
+			rows[i] = []string{"a", "b", "c"}
+		}
+		return ctx.ToValue(rows)
+	})
+
+	res, err := ctx.LoadStringResult("Data.rows.size")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != 10000 {
+		t.Errorf("expected %d; got: %v", 10000, res)
+	}
+}
+
+func TestLoadReader(t *testing.T) {
+	ctx := NewContext()
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	res, err := ctx.LoadReader("greet.rb", strings.NewReader("[__FILE__, ARGV[0]]"), "Oliver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := res.ToInterface()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []interface{}{"greet.rb", "Oliver"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v; got: %v", expected, got)
+	}
+}
+
+func TestLoadReaderParseError(t *testing.T) {
+	ctx := NewContext()
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	_, err := ctx.LoadReader("broken.rb", strings.NewReader("1 +\n.fail here!"))
+	if err == nil {
+		t.Fatal("expected parse error")
+	}
+	parseErr, ok := err.(*ParseError)
+	if !ok {
+		t.Fatalf("expected ParseError; got: %T", err)
+	}
+	if parseErr.Filename != "broken.rb" {
+		t.Errorf("expected filename %q; got: %q", "broken.rb", parseErr.Filename)
+	}
+	if parseErr.Line != 2 {
+		t.Errorf("expected error in line %d; got: %d", 2, parseErr.Line)
+	}
+	if !strings.HasPrefix(parseErr.Error(), "parse error: broken.rb:2: ") {
+		t.Errorf("expected error to contain filename and line; got: %q", parseErr.Error())
+	}
+}
+
+func TestLoadReaderRunError(t *testing.T) {
+	ctx := NewContext()
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	_, err := ctx.LoadReader("raise.rb", strings.NewReader("x = 1\n\nraise ArgumentError, 'kaboom'\n"))
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	runErr, ok := err.(*RunError)
+	if !ok {
+		t.Fatalf("expected RunError; got: %T", err)
+	}
+	if runErr.Message != "kaboom" {
+		t.Errorf("expected message %q; got: %q", "kaboom", runErr.Message)
+	}
+	if runErr.Class != "ArgumentError" {
+		t.Errorf("expected class %q; got: %q", "ArgumentError", runErr.Class)
+	}
+	if runErr.Filename != "raise.rb" {
+		t.Errorf("expected filename %q; got: %q", "raise.rb", runErr.Filename)
+	}
+	if runErr.Line != 3 {
+		t.Errorf("expected line %d; got: %d", 3, runErr.Line)
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mruby-go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "script.rb")
+	if err := ioutil.WriteFile(filename, []byte("__FILE__"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := NewContext()
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+	val, err := ctx.LoadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := val.ToString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != filename {
+		t.Errorf("expected %q; got: %q", filename, s)
+	}
+
+	if _, err := ctx.LoadFile(filepath.Join(dir, "missing.rb")); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2013-2015 Oliver Eilhard.
+// Use of this source code is governed by the MIT LICENSE that
+// can be found in the MIT-LICENSE file included in the project.
+
+package mruby
+
+/*
+#cgo pkg-config: mruby
+#include "mruby_go.h"
+*/
+import "C"
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Coverage collects the lines of Ruby scripts executed in one or more
+// contexts. Attach it to a Context with SetCoverage, run the scripts,
+// then write a report, e.g. with WriteLCOV.
+//
+// Lines are identified by the filename of the script, as given to e.g.
+// LoadFile, LoadReader, or SetFilename. Lines of a script that have
+// instructions are reported with zero hits until executed. A line is
+// counted each time execution reaches it from another line, so a loop
+// written in a single line counts once per pass of the surrounding code.
+//
+// A Coverage is safe for concurrent use by multiple contexts.
+type Coverage struct {
+	mu    sync.Mutex
+	files map[string]map[int]int // filename -> line -> hits
+}
+
+// NewCoverage creates a new, empty Coverage.
+func NewCoverage() *Coverage {
+	return &Coverage{files: make(map[string]map[int]int)}
+}
+
+// SetCoverage attaches cov to the context, so that all lines executed
+// in the context are recorded in cov. A nil Coverage detaches it.
+// ErrHooksUnavailable is returned if mruby-go has been built without
+// the mruby_debug_hook tag.
+func (ctx *Context) SetCoverage(cov *Coverage) error {
+	ctx.enter()
+	defer ctx.leave()
+
+	if C.my_hooks_available() == 0 {
+		return ErrHooksUnavailable
+	}
+	ctx.coverage = cov
+	ctx.coverageIreps = nil
+	ctx.updateHooks()
+	return nil
+}
+
+// Files returns the names of all files with coverage data, sorted.
+func (cov *Coverage) Files() []string {
+	cov.mu.Lock()
+	defer cov.mu.Unlock()
+
+	files := make([]string, 0, len(cov.files))
+	for filename := range cov.files {
+		files = append(files, filename)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// Lines returns the number of hits by line for the given file.
+// Lines with instructions that have not been executed have zero hits.
+func (cov *Coverage) Lines(filename string) map[int]int {
+	cov.mu.Lock()
+	defer cov.mu.Unlock()
+
+	lines := make(map[int]int, len(cov.files[filename]))
+	for line, hits := range cov.files[filename] {
+		lines[line] = hits
+	}
+	return lines
+}
+
+// WriteLCOV writes the coverage data in the LCOV tracefile format, as
+// understood by e.g. genhtml and most CI services.
+func (cov *Coverage) WriteLCOV(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "TN:")
+	for _, filename := range cov.Files() {
+		lines := cov.Lines(filename)
+		numbers := make([]int, 0, len(lines))
+		for line := range lines {
+			numbers = append(numbers, line)
+		}
+		sort.Ints(numbers)
+
+		var hit int
+		fmt.Fprintf(bw, "SF:%s\n", filename)
+		for _, line := range numbers {
+			fmt.Fprintf(bw, "DA:%d,%d\n", line, lines[line])
+			if lines[line] > 0 {
+				hit++
+			}
+		}
+		fmt.Fprintf(bw, "LH:%d\n", hit)
+		fmt.Fprintf(bw, "LF:%d\n", len(numbers))
+		fmt.Fprintln(bw, "end_of_record")
+	}
+	return bw.Flush()
+}
+
+// found records a line with instructions.
+func (cov *Coverage) found(filename string, line int) {
+	cov.mu.Lock()
+	defer cov.mu.Unlock()
+
+	lines, ok := cov.files[filename]
+	if !ok {
+		lines = make(map[int]int)
+		cov.files[filename] = lines
+	}
+	if _, ok := lines[line]; !ok {
+		lines[line] = 0
+	}
+}
+
+// hit records the execution of a line.
+func (cov *Coverage) hit(filename string, line int) {
+	cov.mu.Lock()
+	defer cov.mu.Unlock()
+
+	lines, ok := cov.files[filename]
+	if !ok {
+		lines = make(map[int]int)
+		cov.files[filename] = lines
+	}
+	lines[line]++
+}
+
+//export go_hook_irep
+func go_hook_irep(mrb *C.mrb_state, irep *C.struct_mrb_irep) {
+	ctx, found := hookContext(mrb)
+	if !found || ctx.coverage == nil {
+		return
+	}
+
+	// Record all lines of new code, including methods not called yet.
+	// Code is identified by its lines rather than by the irep, as the
+	// memory of freed ireps is reused.
+	var file *C.char
+	var first, last C.int32_t
+	C.my_irep_lines(irep, &file, &first, &last)
+	if file == nil {
+		return
+	}
+	key := irepLines{filename: C.GoString(file), first: int(first), last: int(last)}
+	if ctx.coverageIreps == nil {
+		ctx.coverageIreps = make(map[irepLines]bool)
+	}
+	if !ctx.coverageIreps[key] {
+		ctx.coverageIreps[key] = true
+		C.my_irep_walk_lines(mrb, irep)
+	}
+}
+
+// irepLines identifies code by its file and range of lines.
+type irepLines struct {
+	filename    string
+	first, last int
+}
+
+//export go_hook_line_found
+func go_hook_line_found(mrb *C.mrb_state, file *C.char, line C.int) {
+	ctx, found := hookContext(mrb)
+	if !found || ctx.coverage == nil {
+		return
+	}
+	ctx.coverage.found(C.GoString(file), int(line))
+}
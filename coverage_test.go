@@ -0,0 +1,94 @@
+// Copyright 2013-2015 Oliver Eilhard.
+// Use of this source code is governed by the MIT LICENSE that
+// can be found in the MIT-LICENSE file included in the project.
+
+package mruby
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCoverage(t *testing.T) {
+	ctx := newHookContext(t)
+
+	cov := NewCoverage()
+	if err := ctx.SetCoverage(cov); err != nil {
+		t.Fatal(err)
+	}
+
+	code := strings.Join([]string{
+		"def used(x)",   // 1
+		"  x * 2",       // 2
+		"end",           // 3
+		"def unused(x)", // 4
+		"  x * 3",       // 5
+		"end",           // 6
+		"used(1)",       // 7
+		"used(2)",       // 8
+	}, "\n")
+	if _, err := ctx.LoadReader("rules.rb", strings.NewReader(code)); err != nil {
+		t.Fatal(err)
+	}
+
+	if files := cov.Files(); len(files) != 1 || files[0] != "rules.rb" {
+		t.Fatalf("expected coverage for %q; got: %v", "rules.rb", files)
+	}
+	lines := cov.Lines("rules.rb")
+	if lines[2] != 2 {
+		t.Errorf("expected line %d to be hit %d times; got: %d", 2, 2, lines[2])
+	}
+	if hits, found := lines[5]; !found || hits != 0 {
+		t.Errorf("expected line %d to be found with %d hits; got: %d (found=%v)", 5, 0, hits, found)
+	}
+	if lines[7] == 0 || lines[8] == 0 {
+		t.Errorf("expected lines %d and %d to be hit; got: %v", 7, 8, lines)
+	}
+
+	var buf bytes.Buffer
+	if err := cov.WriteLCOV(&buf); err != nil {
+		t.Fatal(err)
+	}
+	report := buf.String()
+	for _, s := range []string{"TN:\nSF:rules.rb\n", "DA:2,2\n", "DA:5,0\n", "end_of_record\n"} {
+		if !strings.Contains(report, s) {
+			t.Errorf("expected report to contain %q; got:\n%s", s, report)
+		}
+	}
+
+	// Detaching stops recording
+	if err := ctx.SetCoverage(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ctx.LoadReader("rules.rb", strings.NewReader("used(3)")); err != nil {
+		t.Fatal(err)
+	}
+	if lines := cov.Lines("rules.rb"); lines[2] != 2 {
+		t.Errorf("expected line %d to be hit %d times; got: %d", 2, 2, lines[2])
+	}
+}
+
+func TestCoverageOfReloadedCode(t *testing.T) {
+	ctx := newHookContext(t)
+
+	cov := NewCoverage()
+	if err := ctx.SetCoverage(cov); err != nil {
+		t.Fatal(err)
+	}
+
+	// Code loaded again is known to coverage by file and lines, even
+	// if its ireps have been freed and their memory reused
+	for i := 0; i < 100; i++ {
+		if _, err := ctx.LoadReader("rules.rb", strings.NewReader("x = 1\ny = x + 1")); err != nil {
+			t.Fatal(err)
+		}
+		ctx.GC()
+	}
+	if n := len(ctx.coverageIreps); n != 1 {
+		t.Errorf("expected %d known code; got: %d", 1, n)
+	}
+	if lines := cov.Lines("rules.rb"); lines[1] != 100 || lines[2] != 100 {
+		t.Errorf("expected lines %d and %d to be hit %d times; got: %v", 1, 2, 100, lines)
+	}
+}
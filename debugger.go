@@ -0,0 +1,316 @@
+// Copyright 2013-2015 Oliver Eilhard.
+// Use of this source code is governed by the MIT LICENSE that
+// can be found in the MIT-LICENSE file included in the project.
+
+package mruby
+
+/*
+#cgo pkg-config: mruby
+#include "mruby_go.h"
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// DebugCommand tells a paused script how to continue, see NewDebugger.
+type DebugCommand int
+
+const (
+	// DebugContinue runs the script until the next breakpoint.
+	DebugContinue DebugCommand = iota
+	// DebugStepIn pauses at the next line, entering called methods.
+	DebugStepIn
+	// DebugStepOver pauses at the next line of the current method.
+	DebugStepOver
+	// DebugStepOut pauses when the current method has returned.
+	DebugStepOut
+	// DebugAbort terminates the script by raising an Exception.
+	// Ensure clauses still run.
+	DebugAbort
+)
+
+// Breakpoint pauses a script when execution reaches a line or a method.
+type Breakpoint struct {
+	ID       int
+	Filename string // Name of the file, for line breakpoints
+	Line     int    // Line, for line breakpoints
+	Method   string // Method, e.g. "greet", "Greeter#greet", or "Helpers.escape"
+}
+
+// String returns the location of the breakpoint, e.g. "app.rb:12".
+func (bp Breakpoint) String() string {
+	if bp.Method != "" {
+		return bp.Method
+	}
+	return fmt.Sprintf("%s:%d", bp.Filename, bp.Line)
+}
+
+// matchesLine returns true if the breakpoint is set at the given line.
+// Breakpoints without a directory match files of the same name in any
+// directory.
+func (bp Breakpoint) matchesLine(filename string, line int) bool {
+	if bp.Method != "" || bp.Line != line {
+		return false
+	}
+	if bp.Filename == filename {
+		return true
+	}
+	return !strings.ContainsRune(bp.Filename, filepath.Separator) && bp.Filename == filepath.Base(filename)
+}
+
+// matchesFunction returns true if the breakpoint is set at the method
+// with the given display name, e.g. "Greeter#greet".
+func (bp Breakpoint) matchesFunction(function string) bool {
+	if bp.Method == "" {
+		return false
+	}
+	if bp.Method == function {
+		return true
+	}
+	return strings.HasSuffix(function, "#"+bp.Method) || strings.HasSuffix(function, "."+bp.Method)
+}
+
+// Debugger pauses scripts running in a context at breakpoints, or step
+// by step. Create one with NewDebugger.
+type Debugger struct {
+	ctx         *Context
+	onPause     func(*Pause) DebugCommand
+	breakpoints []Breakpoint
+	nextID      int
+	command     DebugCommand // how to continue after the last pause
+	pauseDepth  int          // depth of the call stack at the last pause
+	pauseLine   TraceEvent   // line of the last pause
+	callDepth   int          // depth of the call stack at the last call, or 0
+}
+
+// Pause describes where a script has been paused, see NewDebugger.
+// Its methods may only be used while the script is paused, i.e. before
+// the function passed to NewDebugger returns.
+type Pause struct {
+	Filename   string      // Name of the file, if available
+	Line       int         // Line, if available
+	Function   string      // Current method, e.g. "Greeter#greet" or "<main>"
+	Breakpoint *Breakpoint // Breakpoint that has been hit, nil when stepping
+
+	ctx *Context
+}
+
+// NewDebugger attaches a debugger to the context. Whenever a script
+// reaches a breakpoint, or a line while stepping, it is paused and
+// onPause is called. The script continues as told by the returned
+// DebugCommand. While paused, onPause can inspect the state of the
+// script via Pause, and set or delete breakpoints.
+//
+// A context has at most one debugger; the previous one is detached.
+// ErrHooksUnavailable is returned if mruby-go has been built without
+// the mruby_debug_hook tag.
+func NewDebugger(ctx *Context, onPause func(*Pause) DebugCommand) (*Debugger, error) {
+	ctx.enter()
+	defer ctx.leave()
+
+	if C.my_hooks_available() == 0 {
+		return nil, ErrHooksUnavailable
+	}
+	d := &Debugger{
+		ctx:     ctx,
+		onPause: onPause,
+		nextID:  1,
+	}
+	ctx.debugger = d
+	ctx.updateHooks()
+	return d, nil
+}
+
+// Close detaches the debugger from its context. Scripts continue
+// without pausing.
+func (d *Debugger) Close() {
+	d.ctx.enter()
+	defer d.ctx.leave()
+
+	if d.ctx.debugger == d {
+		d.ctx.debugger = nil
+		d.ctx.updateHooks()
+	}
+}
+
+// Break sets a breakpoint at a line of a file and returns its ID. If the
+// filename has no directory, it matches files of that name in any
+// directory.
+func (d *Debugger) Break(filename string, line int) int {
+	return d.add(Breakpoint{Filename: filename, Line: line})
+}
+
+// BreakMethod sets a breakpoint at the first line of a method and
+// returns its ID. The method may be qualified with its class, e.g.
+// "Greeter#greet" for an instance method or "Helpers.escape" for a
+// class method. Only methods written in Ruby can be paused.
+func (d *Debugger) BreakMethod(method string) int {
+	return d.add(Breakpoint{Method: method})
+}
+
+func (d *Debugger) add(bp Breakpoint) int {
+	bp.ID = d.nextID
+	d.nextID++
+	d.breakpoints = append(d.breakpoints, bp)
+	return bp.ID
+}
+
+// Delete deletes the breakpoint with the given ID.
+func (d *Debugger) Delete(id int) error {
+	for i, bp := range d.breakpoints {
+		if bp.ID == id {
+			d.breakpoints = append(d.breakpoints[:i], d.breakpoints[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no breakpoint %d", id)
+}
+
+// Breakpoints returns all breakpoints, ordered by ID.
+func (d *Debugger) Breakpoints() []Breakpoint {
+	bps := make([]Breakpoint, len(d.breakpoints))
+	copy(bps, d.breakpoints)
+	return bps
+}
+
+// Pause pauses the script at the next line, e.g. to start debugging at
+// the first line of a script.
+func (d *Debugger) Pause() {
+	d.command = DebugStepIn
+}
+
+// call is called before a method is called.
+func (d *Debugger) call() {
+	d.callDepth = int(C.my_stack_depth(d.ctx.mrb))
+}
+
+// line is called when execution reaches a new line.
+func (d *Debugger) line(ev TraceEvent) {
+	mrb := d.ctx.mrb
+	depth := int(C.my_stack_depth(mrb))
+	entered := d.callDepth > 0 && depth > d.callDepth
+	d.callDepth = 0
+
+	var pause bool
+	switch d.command {
+	case DebugStepIn:
+		pause = true
+	case DebugStepOver:
+		// Skip the line of the last pause when a method called there returns
+		samePlace := ev.Filename == d.pauseLine.Filename && ev.Line == d.pauseLine.Line
+		pause = depth < d.pauseDepth || (depth == d.pauseDepth && !samePlace)
+	case DebugStepOut:
+		pause = depth < d.pauseDepth
+	}
+
+	var hit *Breakpoint
+	for i := range d.breakpoints {
+		if d.breakpoints[i].matchesLine(ev.Filename, ev.Line) {
+			hit = &d.breakpoints[i]
+			break
+		}
+	}
+	var function string
+	if hit == nil && entered {
+		// The first line of a called method
+		function = d.currentFunction()
+		for i := range d.breakpoints {
+			if d.breakpoints[i].matchesFunction(function) {
+				hit = &d.breakpoints[i]
+				break
+			}
+		}
+	}
+	if !pause && hit == nil {
+		return
+	}
+
+	if function == "" {
+		function = d.currentFunction()
+	}
+	p := &Pause{
+		Filename: ev.Filename,
+		Line:     ev.Line,
+		Function: function,
+		ctx:      d.ctx,
+	}
+	if hit != nil {
+		bp := *hit
+		p.Breakpoint = &bp
+	}
+	d.command = d.onPause(p)
+	d.pauseDepth = depth
+	d.pauseLine = ev
+	if d.command == DebugAbort {
+		d.command = DebugContinue
+		C.my_hooks_abort(mrb)
+	}
+}
+
+// currentFunction returns the display name of the current method.
+func (d *Debugger) currentFunction() string {
+	stack := d.ctx.callStack(nil)
+	if len(stack) == 0 {
+		return "<main>"
+	}
+	return stack[0].Function
+}
+
+// Self returns self of the current method or block.
+func (p *Pause) Self() Value {
+	p.ctx.enter()
+	defer p.ctx.leave()
+
+	return Value{ctx: p.ctx, v: C.my_stack_self(p.ctx.mrb)}
+}
+
+// Locals returns the local variables of the current method or block
+// by name. Variables of enclosing scopes are not included.
+func (p *Pause) Locals() map[string]Value {
+	p.ctx.enter()
+	defer p.ctx.leave()
+
+	mrb := p.ctx.mrb
+	n := int(C.my_local_count(mrb))
+	locals := make(map[string]Value, n)
+	for i := 0; i < n; i++ {
+		var name C.mrb_sym
+		var value C.mrb_value
+		if C.my_local_get(mrb, C.int(i), &name, &value) == C.mrb_bool(0) {
+			continue
+		}
+		locals[C.GoString(C.mrb_sym2name(mrb, name))] = Value{ctx: p.ctx, v: value}
+	}
+	return locals
+}
+
+// Local returns the local variable with the given name.
+func (p *Pause) Local(name string) (Value, error) {
+	if v, found := p.Locals()[name]; found {
+		return v, nil
+	}
+	return NilValue(p.ctx), errors.New("undefined local variable " + name)
+}
+
+// Backtrace returns the call stack, innermost frame first, in the same
+// format as the backtrace of RunError, e.g. "app.rb:12:in Greeter#greet".
+func (p *Pause) Backtrace() []string {
+	p.ctx.enter()
+	defer p.ctx.leave()
+
+	stack := p.ctx.callStack(C.my_hooks_pc(p.ctx.mrb))
+	lines := make([]string, 0, len(stack))
+	for _, frame := range stack {
+		if frame.Filename == "" {
+			lines = append(lines, "in "+frame.Function)
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s:%d:in %s", frame.Filename, frame.Line, frame.Function))
+	}
+	return lines
+}
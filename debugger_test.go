@@ -0,0 +1,152 @@
+// Copyright 2013-2015 Oliver Eilhard.
+// Use of this source code is governed by the MIT LICENSE that
+// can be found in the MIT-LICENSE file included in the project.
+
+package mruby
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const debuggerScript = `class Greeter
+  def initialize(name)
+    @name = name
+  end
+  def greet(greeting)
+    message = "#{greeting}, #{@name}"
+    message
+  end
+end
+g = Greeter.new("Oliver")
+g.greet("Hello")
+done = true
+`
+
+func TestDebuggerBreakpoint(t *testing.T) {
+	ctx := newHookContext(t)
+
+	var pauses []string
+	var locals map[string]interface{}
+	var self string
+	var backtrace []string
+	dbg, err := NewDebugger(ctx, func(p *Pause) DebugCommand {
+		pauses = append(pauses, fmt.Sprintf("%s:%d:%s", p.Filename, p.Line, p.Function))
+		if p.Line == 7 {
+			locals = make(map[string]interface{})
+			for name, v := range p.Locals() {
+				locals[name], _ = v.ToInterface()
+			}
+			s, _ := p.Self().Call("inspect")
+			self, _ = s.ToString()
+			backtrace = p.Backtrace()
+			return DebugStepOut
+		}
+		return DebugStepOver
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := dbg.Break("greeter.rb", 6); id != 1 {
+		t.Errorf("expected breakpoint ID %d; got: %d", 1, id)
+	}
+
+	if _, err := ctx.LoadReader("lib/greeter.rb", strings.NewReader(debuggerScript)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"lib/greeter.rb:6:Greeter#greet",
+		"lib/greeter.rb:7:Greeter#greet",
+		"lib/greeter.rb:11:<main>",
+		"lib/greeter.rb:12:<main>",
+	}
+	if strings.Join(pauses, " ") != strings.Join(want, " ") {
+		t.Errorf("expected pauses %v; got: %v", want, pauses)
+	}
+	if locals["greeting"] != "Hello" || locals["message"] != "Hello, Oliver" {
+		t.Errorf("expected locals greeting and message; got: %v", locals)
+	}
+	if !strings.Contains(self, "Greeter") {
+		t.Errorf("expected self to be a Greeter; got: %s", self)
+	}
+	if len(backtrace) != 2 || backtrace[0] != "lib/greeter.rb:7:in Greeter#greet" || backtrace[1] != "lib/greeter.rb:11:in <main>" {
+		t.Errorf("unexpected backtrace: %v", backtrace)
+	}
+}
+
+func TestDebuggerMethodBreakpoint(t *testing.T) {
+	ctx := newHookContext(t)
+
+	var pauses []string
+	dbg, err := NewDebugger(ctx, func(p *Pause) DebugCommand {
+		if p.Breakpoint == nil {
+			t.Errorf("expected to pause at a breakpoint; got: %s:%d", p.Filename, p.Line)
+			return DebugContinue
+		}
+		pauses = append(pauses, fmt.Sprintf("%d:%s", p.Breakpoint.ID, p.Function))
+		return DebugContinue
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbg.BreakMethod("Greeter#initialize")
+	dbg.BreakMethod("greet")
+	if bps := dbg.Breakpoints(); len(bps) != 2 || bps[1].String() != "greet" {
+		t.Fatalf("unexpected breakpoints: %v", bps)
+	}
+
+	if _, err := ctx.LoadReader("greeter.rb", strings.NewReader(debuggerScript)); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(pauses, " "); got != "1:Greeter#initialize 2:Greeter#greet" {
+		t.Errorf("expected pauses %q; got: %q", "1:Greeter#initialize 2:Greeter#greet", got)
+	}
+
+	// Deleted breakpoints and closed debuggers do not pause
+	if err := dbg.Delete(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := dbg.Delete(1); err == nil {
+		t.Error("expected error when deleting a breakpoint twice")
+	}
+	pauses = nil
+	if _, err := ctx.LoadString(`Greeter.new("Eilhard").greet("Hi")`); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(pauses, " "); got != "2:Greeter#greet" {
+		t.Errorf("expected pauses %q; got: %q", "2:Greeter#greet", got)
+	}
+	dbg.Close()
+	pauses = nil
+	if _, err := ctx.LoadString(`Greeter.new("Eilhard").greet("Hi")`); err != nil {
+		t.Fatal(err)
+	}
+	if len(pauses) != 0 {
+		t.Errorf("expected no pauses after Close; got: %v", pauses)
+	}
+}
+
+func TestDebuggerAbort(t *testing.T) {
+	ctx := newHookContext(t)
+
+	dbg, err := NewDebugger(ctx, func(p *Pause) DebugCommand {
+		return DebugAbort
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbg.Pause()
+
+	_, err = ctx.LoadString("$reached = true")
+	if err == nil {
+		t.Fatal("expected error when aborting the script")
+	}
+	if rerr, ok := err.(*RunError); !ok || rerr.Message != "aborted by debugger" {
+		t.Errorf("expected RunError %q; got: %v", "aborted by debugger", err)
+	}
+	if v, _ := ctx.LoadString("$reached"); !v.IsNil() {
+		t.Error("expected the script to be aborted before its first line")
+	}
+}
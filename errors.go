@@ -13,40 +13,177 @@ import "C"
 import (
 	"errors"
 	"fmt"
+	"unsafe"
 )
 
 var (
 	// ErrInvalidType is returned when the package cannot convert a Ruby
 	// type to the Go equivalent.
 	ErrInvalidType = errors.New("invalid type")
+
+	// ErrCyclicValue is returned when converting a Ruby object that
+	// references itself, e.g. via an instance variable, to Go.
+	ErrCyclicValue = errors.New("cyclic value")
+
+	// ErrForeignValue is returned when passing a Value of one Context
+	// to another Context, e.g. via SetGlobal.
+	ErrForeignValue = errors.New("value of another context")
 )
 
 // RunError is used to indicate errors while running Ruby code.
 type RunError struct {
-	Message string // Message details
+	Message   string   // Message details
+	Class     string   // Class of the exception, e.g. RuntimeError
+	Filename  string   // Name of the file where the exception was raised, if available
+	Line      int      // Line where the exception was raised, if available
+	Backtrace []string // Backtrace, if available
 }
 
+// newRunError creates a RunError from the pending exception of the
+// context. Use newScriptError for exceptions of code run on behalf of
+// the caller.
 func newRunError(ctx *Context, resetException bool) *RunError {
+	ctx.reportUnhandledRaise()
 	err := &RunError{}
 	err.Message = C.GoString(C.get_exception_message(ctx.mrb))
+	err.Class = C.GoString(C.mrb_obj_classname(ctx.mrb, C.get_exception(ctx.mrb)))
+	if file := C.get_exception_file(ctx.mrb); file != nil {
+		err.Filename = C.GoString(file)
+	}
+	err.Line = int(C.get_exception_line(ctx.mrb))
+	bt := Value{ctx: ctx, v: C.get_exception_backtrace(ctx.mrb)}
+	if bt.IsArray() {
+		for i := 0; i < int(C.mrb_ary_len(ctx.mrb, bt.v)); i++ {
+			line := Value{ctx: ctx, v: C.get_ary_entry(bt.v, C.int(i))}
+			if s, e := line.ToString(); e == nil {
+				err.Backtrace = append(err.Backtrace, s)
+			}
+		}
+	}
 	if resetException {
 		C.reset_exception(ctx.mrb)
 	}
 	return err
 }
 
+// newScriptError is like newRunError, but also marks the context as
+// failed, so that a Pool discards it. It is used for exceptions raised
+// by scripts or methods run by the caller, e.g. via LoadString, as
+// opposed to those of methods the package calls internally.
+func newScriptError(ctx *Context) *RunError {
+	ctx.failed = true
+	return newRunError(ctx, true)
+}
+
 // Error returns the error as a string.
 func (e *RunError) Error() string {
 	return e.Message
 }
 
+// raiseError is returned by Go functions of the package that need
+// to raise an exception in the calling script, e.g. require.
+type raiseError struct {
+	exc     C.mrb_value // Ruby exception
+	message string      // Message details
+}
+
+// newRaiseError creates a raiseError with an exception of the class
+// with the given name, e.g. "LoadError". If the class does not exist,
+// a RuntimeError is created instead.
+func newRaiseError(ctx *Context, className, message string) *raiseError {
+	class, found := ctx.lookupClassPath(className)
+	if !found {
+		class = C.my_runtime_error_class(ctx.mrb)
+	}
+	cmsg := C.CString(message)
+	defer C.free(unsafe.Pointer(cmsg))
+	exc := C.my_exc_new(ctx.mrb, class, cmsg, C.size_t(len(message)))
+	return &raiseError{exc: exc, message: message}
+}
+
+// newRaiseErrorFromException creates a raiseError with the pending
+// exception of the context, and resets it.
+func newRaiseErrorFromException(ctx *Context) *raiseError {
+	exc := C.get_exception(ctx.mrb)
+	message := C.GoString(C.get_exception_message(ctx.mrb))
+	C.reset_exception(ctx.mrb)
+	return &raiseError{exc: exc, message: message}
+}
+
+// Error returns the error as a string.
+func (e *raiseError) Error() string {
+	return e.message
+}
+
 // ParseError is used to indicate errors while parsing Ruby code.
 type ParseError struct {
-	Line    int    // Line number
-	Message string // Message details
+	Filename string // Name of the file, if parsed via LoadFile or LoadReader
+	Line     int    // Line number
+	Message  string // Message details
 }
 
 // Error returns the error as a string.
 func (e *ParseError) Error() string {
+	if e.Filename != "" {
+		return fmt.Sprintf("parse error: %s:%d: %s", e.Filename, e.Line, e.Message)
+	}
 	return fmt.Sprintf("parse error: line %d: %s", e.Line, e.Message)
 }
+
+// OverflowError is used to indicate that a number does not fit into
+// the Go or Ruby type it is converted to.
+type OverflowError struct {
+	Value string // Value that overflows, formatted as a string
+	Type  string // Type that the value does not fit into
+}
+
+// Error returns the error as a string.
+func (e *OverflowError) Error() string {
+	return fmt.Sprintf("value %s overflows %s", e.Value, e.Type)
+}
+
+// Exception is the Go representation of a Ruby exception, as returned
+// by Value.ToInterface.
+type Exception struct {
+	Class     string   // Class name, e.g. RuntimeError
+	Message   string   // Message details
+	Backtrace []string // Backtrace, if available
+}
+
+// Error returns the error as a string.
+func (e *Exception) Error() string {
+	return e.Message
+}
+
+// mrbExceptionToException takes the value (which has to be a Ruby
+// Exception) and returns it as an *Exception.
+func (v Value) mrbExceptionToException() (*Exception, error) {
+	e := &Exception{
+		Class: C.GoString(C.mrb_obj_classname(v.ctx.mrb, v.v)),
+	}
+
+	msg, err := v.funcall("message")
+	if err != nil {
+		return nil, err
+	}
+	if e.Message, err = msg.ToString(); err != nil {
+		return nil, err
+	}
+
+	bt, err := v.funcall("backtrace")
+	if err != nil {
+		return nil, err
+	}
+	if bt.IsArray() {
+		lines, err := bt.ToArray()
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range lines {
+			if s, ok := line.(string); ok {
+				e.Backtrace = append(e.Backtrace, s)
+			}
+		}
+	}
+	return e, nil
+}
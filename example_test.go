@@ -5,6 +5,7 @@
 package mruby_test
 
 import (
+	"bytes"
 	"fmt"
 
 	"github.com/olivere/mruby-go"
@@ -156,3 +157,18 @@ func ExampleFunction() {
 	fmt.Println(greeting)
 	// Output: Hello Matz!
 }
+
+func Example_captureOutput() {
+	// Create a new context that writes the output of puts, print, and p
+	// into a buffer instead of the standard output of the process
+	var buf bytes.Buffer
+	ctx := mruby.NewContext(mruby.SetStdout(&buf))
+
+	_, err := ctx.LoadString(`puts "Hello from MRuby"`)
+	if err != nil {
+		fmt.Println("LoadString failed")
+		return
+	}
+	fmt.Printf("%q\n", buf.String())
+	// Output: "Hello from MRuby\n"
+}
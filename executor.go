@@ -0,0 +1,199 @@
+// Copyright 2013-2015 Oliver Eilhard.
+// Use of this source code is governed by the MIT LICENSE that
+// can be found in the MIT-LICENSE file included in the project.
+
+package mruby
+
+import (
+	"bytes"
+	"errors"
+	"runtime"
+	"strconv"
+	"sync"
+)
+
+var (
+	// ErrExecutorClosed is returned by Executor.Do after the executor
+	// has been closed.
+	ErrExecutorClosed = errors.New("executor closed")
+)
+
+// Executor confines a Context to a single goroutine, locked to an OS
+// thread. Jobs submitted via Do are run one after another on that
+// goroutine, so the Context is never used concurrently.
+//
+// An Executor is safe for concurrent use. Jobs must not call Do of the
+// same Executor, as that would deadlock.
+type Executor struct {
+	jobs    chan executorJob
+	done    chan struct{} // closed by Close
+	stopped chan struct{} // closed when the goroutine has finished
+	once    sync.Once
+	err     error // error setting up the Context, see OpenContext
+}
+
+// executorJob is a function submitted to an Executor.
+type executorJob struct {
+	f      func(*Context) error
+	result chan executorResult
+}
+
+// executorResult is the outcome of an executorJob.
+type executorResult struct {
+	err       error
+	panicked  bool
+	recovered interface{}
+}
+
+// NewExecutor creates a new Context with the given options on a new
+// goroutine and returns an Executor for it. If the Context cannot be
+// set up, Do returns the error.
+//
+// Example:
+//
+//	exec := mruby.NewExecutor(mruby.SetFilename("worker.rb"))
+//	defer exec.Close()
+//	err := exec.Do(func(ctx *mruby.Context) error {
+//		_, err := ctx.LoadString("puts 'Hello'")
+//		return err
+//	})
+func NewExecutor(options ...func(*Context)) *Executor {
+	e := &Executor{
+		jobs:    make(chan executorJob),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	ready := make(chan struct{})
+	go e.loop(options, ready)
+	<-ready
+	return e
+}
+
+// loop runs the jobs until the executor is closed.
+func (e *Executor) loop(options []func(*Context), ready chan struct{}) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	ctx, err := OpenContext(options...)
+	e.err = err
+	close(ready)
+	if err != nil {
+		<-e.done
+		close(e.stopped)
+		return
+	}
+
+	for {
+		select {
+		case job := <-e.jobs:
+			job.result <- e.run(ctx, job.f)
+		case <-e.done:
+			ctx.Close()
+			close(e.stopped)
+			return
+		}
+	}
+}
+
+// run runs f with ctx and recovers from panics, so they can be passed
+// on to the goroutine that submitted the job.
+func (e *Executor) run(ctx *Context, f func(*Context) error) (res executorResult) {
+	defer func() {
+		if r := recover(); r != nil {
+			res = executorResult{panicked: true, recovered: r}
+		}
+	}()
+	return executorResult{err: f(ctx)}
+}
+
+// Do runs f with the Context of the executor and waits for it to
+// complete. It returns the error returned by f, or ErrExecutorClosed
+// if the executor has been closed. If f panics, Do panics with the
+// same value. Values of the Context must not be used after f returns.
+func (e *Executor) Do(f func(*Context) error) error {
+	if e.err != nil {
+		return e.err
+	}
+	job := executorJob{f: f, result: make(chan executorResult, 1)}
+	select {
+	case e.jobs <- job:
+	case <-e.done:
+		return ErrExecutorClosed
+	}
+	res := <-job.result
+	if res.panicked {
+		panic(res.recovered)
+	}
+	return res.err
+}
+
+// Close waits for the running job, if any, and closes the Context.
+// Subsequent calls to Do return ErrExecutorClosed.
+func (e *Executor) Close() {
+	e.once.Do(func() {
+		close(e.done)
+	})
+	<-e.stopped
+}
+
+// SetRaceDetection makes the Context panic when it is used by more than
+// one goroutine at the same time, e.g. when calling LoadString while
+// another goroutine is still running a script. Use it to find code that
+// must use an Executor or a Pool. All methods that use the VM are
+// checked, e.g. those of Context, Value, Class, and Module. Calls made
+// from Go functions invoked by a running script are allowed. Detection is best-effort: it catches
+// overlapping calls, but not all unsynchronized access.
+// It is used for configuring a Context (see NewContext for details).
+func SetRaceDetection(enabled bool) func(*Context) {
+	return func(ctx *Context) {
+		ctx.raceDetection = enabled
+	}
+}
+
+// enter marks the beginning of a call into the VM. It panics if race
+// detection is enabled and another goroutine is using the context.
+// Nested calls of the goroutine using the context, e.g. from Go
+// functions called by a running script, are allowed.
+func (ctx *Context) enter() {
+	if ctx.profiler != nil {
+		ctx.profiler.enter(ctx)
+	}
+	if !ctx.raceDetection {
+		return
+	}
+	id := goroutineID()
+	ctx.raceMu.Lock()
+	defer ctx.raceMu.Unlock()
+	if ctx.active > 0 && ctx.owner != id {
+		panic("mruby: concurrent use of Context detected; a Context must only be used by one goroutine at a time (use an Executor or a Pool)")
+	}
+	ctx.owner = id
+	ctx.active++
+}
+
+// leave marks the end of a call into the VM started with enter.
+func (ctx *Context) leave() {
+	if !ctx.raceDetection {
+		return
+	}
+	ctx.raceMu.Lock()
+	defer ctx.raceMu.Unlock()
+	ctx.active--
+	if ctx.active == 0 {
+		ctx.owner = 0
+	}
+}
+
+// goroutineID returns the id of the calling goroutine. Go doesn't
+// expose it, so it is taken from the header of the stack trace, e.g.
+// "goroutine 18 [running]:". It is only used for race detection.
+func goroutineID() uint64 {
+	var buf [64]byte
+	b := buf[:runtime.Stack(buf[:], false)]
+	b = bytes.TrimPrefix(b, []byte("goroutine "))
+	if i := bytes.IndexByte(b, ' '); i >= 0 {
+		b = b[:i]
+	}
+	id, _ := strconv.ParseUint(string(b), 10, 64)
+	return id
+}
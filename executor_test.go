@@ -0,0 +1,234 @@
+// Copyright 2013-2015 Oliver Eilhard.
+// Use of this source code is governed by the MIT LICENSE that
+// can be found in the MIT-LICENSE file included in the project.
+
+package mruby
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+)
+
+func TestExecutor(t *testing.T) {
+	exec := NewExecutor()
+	defer exec.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := exec.Do(func(ctx *Context) error {
+				_, err := ctx.LoadString("$counter = ($counter || 0) + 1")
+				return err
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var got interface{}
+	err := exec.Do(func(ctx *Context) error {
+		var err error
+		got, err = ctx.LoadStringResult("$counter")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 20 {
+		t.Errorf("expected %d; got: %v", 20, got)
+	}
+}
+
+func TestExecutorError(t *testing.T) {
+	exec := NewExecutor()
+	defer exec.Close()
+
+	err := exec.Do(func(ctx *Context) error {
+		_, err := ctx.LoadString("raise 'kaboom'")
+		return err
+	})
+	if _, ok := err.(*RunError); !ok {
+		t.Fatalf("expected RunError; got: %v", err)
+	}
+}
+
+func TestExecutorPanic(t *testing.T) {
+	exec := NewExecutor()
+	defer exec.Close()
+
+	defer func() {
+		if r := recover(); r != "kaboom" {
+			t.Errorf("expected panic %q; got: %v", "kaboom", r)
+		}
+	}()
+	exec.Do(func(ctx *Context) error {
+		panic("kaboom")
+	})
+	t.Fatal("expected Do to panic")
+}
+
+func TestExecutorClose(t *testing.T) {
+	exec := NewExecutor()
+	exec.Close()
+	exec.Close()
+
+	err := exec.Do(func(ctx *Context) error {
+		return errors.New("must not be called")
+	})
+	if err != ErrExecutorClosed {
+		t.Errorf("expected ErrExecutorClosed; got: %v", err)
+	}
+}
+
+func TestRaceDetection(t *testing.T) {
+	ctx := NewContext(SetRaceDetection(true))
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	if _, err := ctx.LoadString("$obj = Object.new"); err != nil {
+		t.Fatal(err)
+	}
+	obj, err := ctx.GetGlobal("$obj")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	ctx.KernelModule().DefineMethod("wait", func(ctx *Context) (Value, error) {
+		close(entered)
+		<-release
+		return NilValue(ctx), nil
+	})
+	finished := make(chan error)
+	go func() {
+		_, err := ctx.LoadString("wait")
+		finished <- err
+	}()
+	<-entered
+
+	// Other goroutines use the context while a script is running
+	tests := []struct {
+		name string
+		use  func()
+	}{
+		{"SetGlobal", func() { ctx.SetGlobal("$x", 1) }},
+		{"GetGlobal", func() { ctx.GetGlobal("$obj") }},
+		{"SetConst", func() { ctx.ObjectClass().SetConst("X", 1) }},
+		{"ToValue", func() { ctx.ToValue("hello") }},
+		{"Locals", func() { ctx.Locals() }},
+		{"Value.Call", func() { obj.Call("inspect") }},
+		{"Value.SetIvar", func() { obj.SetIvar("@x", 1) }},
+		{"Value.ToInterface", func() { obj.ToInterface() }},
+		{"Classes", func() { ctx.Classes() }},
+	}
+	for _, test := range tests {
+		done := make(chan interface{})
+		go func() {
+			defer func() {
+				done <- recover()
+			}()
+			test.use()
+		}()
+		r := <-done
+		msg, ok := r.(string)
+		if !ok || !strings.Contains(msg, "concurrent use of Context") {
+			t.Errorf("%s: expected panic on concurrent use; got: %v", test.name, r)
+		}
+	}
+
+	close(release)
+	if err := <-finished; err != nil {
+		t.Fatal(err)
+	}
+
+	// The context can be used by another goroutine afterwards
+	done := make(chan error)
+	go func() {
+		done <- ctx.SetGlobal("$x", 1)
+	}()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRaceDetectionDuringCallback(t *testing.T) {
+	ctx := NewContext(SetRaceDetection(true))
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	ctx.KernelModule().DefineMethod("wait", func(ctx *Context) (Value, error) {
+		close(entered)
+		<-release
+		return NilValue(ctx), nil
+	})
+	finished := make(chan error)
+	go func() {
+		_, err := ctx.LoadString("wait")
+		finished <- err
+	}()
+	<-entered
+
+	// Another goroutine uses the context while the first one is
+	// running a Go function called from Ruby
+	done := make(chan interface{})
+	go func() {
+		defer func() {
+			done <- recover()
+		}()
+		ctx.LoadString("1 + 2")
+	}()
+	r := <-done
+	msg, ok := r.(string)
+	if !ok || !strings.Contains(msg, "concurrent use of Context") {
+		t.Errorf("expected panic on concurrent use; got: %v", r)
+	}
+
+	close(release)
+	if err := <-finished; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRaceDetectionAllowsCallbacks(t *testing.T) {
+	ctx := NewContext(SetRaceDetection(true))
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	ctx.KernelModule().DefineMethod("nested", func(ctx *Context) (Value, error) {
+		return ctx.LoadString("40 + 2")
+	})
+	got, err := ctx.LoadStringResult("nested")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 42 {
+		t.Errorf("expected %d; got: %v", 42, got)
+	}
+}
+
+func TestExecutorSetupError(t *testing.T) {
+	// Setting up require needs Module#const_defined?
+	exec := NewExecutor(
+		SetLoadFS(fstest.MapFS{}),
+		SetSandbox(&Sandbox{
+			DenyMethods: map[string][]string{"Module": {"const_defined?"}},
+		}),
+	)
+	defer exec.Close()
+	if err := exec.Do(func(*Context) error { return nil }); err == nil {
+		t.Error("expected Executor.Do to return the setup error")
+	}
+}
@@ -25,43 +25,54 @@ type methodMap map[C.mrb_sym]Function
 type Function func(ctx *Context) (Value, error)
 
 //export my_mrb_func_call
-func my_mrb_func_call(mrb *C.mrb_state, v C.mrb_value) C.mrb_value {
-	contextsFu.Lock()
-	defer contextsFu.Unlock()
-
+func my_mrb_func_call(mrb *C.mrb_state, v C.mrb_value, exc *C.mrb_value) C.mrb_value {
 	// Find the context by mrb.
+	contextsFu.Lock()
 	ctx, found := contexts[mrb]
+	contextsFu.Unlock()
 	if !found {
 		return C.mrb_nil_value()
 	}
 
-	// Find the function in the ctx.
-	ctx.methodsMu.Lock()
-	defer ctx.methodsMu.Unlock()
+	// Find the function in the ctx. Locks are not held while calling it,
+	// so the function may call back into the context, e.g. via LoadString.
+	method, found := ctx.lookupMethod(mrb.c.ci)
+	if !found {
+		return C.mrb_nil_value()
+	}
 
-	if ctx.methodsByRClass == nil {
+	// Restore the arena after the call, but keep the output alive.
+	output, err := ctx.WithArena(func() (Value, error) {
+		return method(ctx)
+	})
+	if err != nil {
+		// Errors are turned into a Ruby exception only if requested
+		// by the package itself; all others return nil.
+		if e, ok := err.(*raiseError); ok {
+			C.mrb_gc_protect(mrb, e.exc)
+			*exc = e.exc
+		}
 		return C.mrb_nil_value()
 	}
+	return output.v
+}
 
-	//input := Value{ctx: ctx, v: v}
+// lookupMethod finds the function registered for the given callinfo.
+func (ctx *Context) lookupMethod(callinfo *C.mrb_callinfo) (Function, bool) {
+	ctx.methodsMu.Lock()
+	defer ctx.methodsMu.Unlock()
 
-	callinfo := mrb.c.ci
+	if ctx.methodsByRClass == nil {
+		return nil, false
+	}
 
 	methods, found := ctx.methodsByRClass[callinfo.proc.target_class]
 	if !found {
-		return C.mrb_nil_value()
+		return nil, false
 	}
 
 	method, found := methods[callinfo.mid]
-	if !found {
-		return C.mrb_nil_value()
-	}
-
-	output, err := method(ctx)
-	if err != nil {
-		return C.mrb_nil_value()
-	}
-	return output.v
+	return method, found
 }
 
 // addMethod inserts a method to the given class.
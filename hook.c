@@ -0,0 +1,72 @@
+// Copyright 2013-2015 Oliver Eilhard.
+// Use of this source code is governed by the MIT LICENSE that
+// can be found in the MIT-LICENSE file included in the project.
+
+#include "mruby_go.h"
+
+#ifdef MRB_ENABLE_DEBUG_HOOK
+
+#include <pthread.h>
+
+// The hook states of all mrb_states with hooks. They are not kept in
+// mrb->ud, as it belongs to the embedder.
+static pthread_mutex_t my_hook_states_mu = PTHREAD_MUTEX_INITIALIZER;
+static my_hook_state *my_hook_states;    // linked via next
+static unsigned long my_hook_states_gen; // incremented when a state is freed
+
+// The last state looked up by a thread. It is valid as long as no state
+// has been freed, so the hook looks up the state without locking.
+static __thread mrb_state *my_hook_cached_mrb;
+static __thread my_hook_state *my_hook_cached;
+static __thread unsigned long my_hook_cached_gen;
+
+my_hook_state *my_hooks_state(mrb_state *mrb) {
+	my_hook_state *st;
+	unsigned long gen = __atomic_load_n(&my_hook_states_gen, __ATOMIC_ACQUIRE);
+
+	if (my_hook_cached_mrb == mrb && my_hook_cached_gen == gen) {
+		return my_hook_cached;
+	}
+
+	pthread_mutex_lock(&my_hook_states_mu);
+	for (st = my_hook_states; st != NULL && st->mrb != mrb; st = st->next) {
+	}
+	gen = my_hook_states_gen;
+	pthread_mutex_unlock(&my_hook_states_mu);
+
+	if (st != NULL) {
+		my_hook_cached_mrb = mrb;
+		my_hook_cached = st;
+		my_hook_cached_gen = gen;
+	}
+	return st;
+}
+
+my_hook_state *my_hooks_state_new(mrb_state *mrb) {
+	my_hook_state *st = (my_hook_state *)calloc(1, sizeof(my_hook_state));
+
+	st->mrb = mrb;
+	pthread_mutex_lock(&my_hook_states_mu);
+	st->next = my_hook_states;
+	my_hook_states = st;
+	pthread_mutex_unlock(&my_hook_states_mu);
+	return st;
+}
+
+void my_hooks_state_free(mrb_state *mrb) {
+	my_hook_state **p, *st = NULL;
+
+	pthread_mutex_lock(&my_hook_states_mu);
+	for (p = &my_hook_states; *p != NULL; p = &(*p)->next) {
+		if ((*p)->mrb == mrb) {
+			st = *p;
+			*p = st->next;
+			break;
+		}
+	}
+	__atomic_add_fetch(&my_hook_states_gen, 1, __ATOMIC_RELEASE);
+	pthread_mutex_unlock(&my_hook_states_mu);
+	free(st);
+}
+
+#endif // MRB_ENABLE_DEBUG_HOOK
@@ -0,0 +1,185 @@
+// Copyright 2013-2015 Oliver Eilhard.
+// Use of this source code is governed by the MIT LICENSE that
+// can be found in the MIT-LICENSE file included in the project.
+
+package mruby
+
+/*
+#cgo pkg-config: mruby
+#include "mruby_go.h"
+*/
+import "C"
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	// ErrHooksUnavailable is returned when installing a hook, e.g. via
+	// SetTraceHook, but mruby-go has been built without the
+	// mruby_debug_hook tag (see hook_debug.go).
+	ErrHooksUnavailable = errors.New("hooks unavailable: build with -tags mruby_debug_hook and mruby compiled with MRB_ENABLE_DEBUG_HOOK")
+)
+
+// hookContexts maps the mrb_state of each context to the context for
+// the hooks. They are called e.g. for every line, so they look up the
+// context without taking contextsFu.
+var hookContexts sync.Map
+
+// hookContext returns the context of mrb, see hookContexts.
+func hookContext(mrb *C.mrb_state) (*Context, bool) {
+	ctx, found := hookContexts.Load(mrb)
+	if !found {
+		return nil, false
+	}
+	return ctx.(*Context), true
+}
+
+// TraceEventKind is the kind of a TraceEvent.
+type TraceEventKind int
+
+const (
+	// TraceLine is reported when execution reaches a new line.
+	TraceLine TraceEventKind = iota
+	// TraceCall is reported before a method is called.
+	TraceCall
+	// TraceReturn is reported when a method or block returns.
+	TraceReturn
+	// TraceRaise is reported when an exception has been raised.
+	TraceRaise
+)
+
+// String returns the name of the kind, e.g. "line".
+func (k TraceEventKind) String() string {
+	switch k {
+	case TraceLine:
+		return "line"
+	case TraceCall:
+		return "call"
+	case TraceReturn:
+		return "return"
+	case TraceRaise:
+		return "raise"
+	default:
+		return "unknown"
+	}
+}
+
+// TraceEvent describes what a script is doing, see SetTraceHook.
+type TraceEvent struct {
+	Kind     TraceEventKind
+	Filename string // Name of the file, if available
+	Line     int    // Line, if available
+	Method   string // Called, returning, or current method, if any
+	Class    string // Receiver class of calls, exception class of raises, or class of the current method
+}
+
+// SetTraceHook installs a function that is called while scripts run in
+// the context: when execution reaches a new line, before a method is
+// called, when a method returns, and when an exception is raised. Use
+// it e.g. for tracing or audit logs. Calls to Go functions from Ruby
+// are reported, but not the code running inside C functions. A nil
+// hook removes the hook.
+//
+// The hook must not use the context. ErrHooksUnavailable is returned if
+// mruby-go has been built without the mruby_debug_hook tag. Note that the
+// hook slows down scripts considerably.
+func (ctx *Context) SetTraceHook(hook func(TraceEvent)) error {
+	ctx.enter()
+	defer ctx.leave()
+
+	if C.my_hooks_available() == 0 {
+		return ErrHooksUnavailable
+	}
+	ctx.traceHook = hook
+	ctx.updateHooks()
+	return nil
+}
+
+// updateHooks tells the C hook which events to report, depending on
+// the hooks installed in the context.
+func (ctx *Context) updateHooks() {
+	var mask C.int
+	if ctx.traceHook != nil {
+		mask |= C.MY_HOOK_LINE | C.MY_HOOK_CALL | C.MY_HOOK_RETURN | C.MY_HOOK_RAISE
+	}
+	if ctx.coverage != nil {
+		mask |= C.MY_HOOK_LINE | C.MY_HOOK_IREP
+	}
+	if ctx.profiler != nil {
+		mask |= C.MY_HOOK_SAMPLE
+	}
+	if ctx.debugger != nil {
+		mask |= C.MY_HOOK_LINE | C.MY_HOOK_CALL
+	}
+	if mask != 0 {
+		hookContexts.Store(ctx.mrb, ctx)
+	}
+	C.my_hooks_set_mask(ctx.mrb, mask)
+}
+
+// dispatchHookEvent passes an event to the hooks installed in the context.
+func (ctx *Context) dispatchHookEvent(ev TraceEvent) {
+	if ctx.traceHook != nil {
+		ctx.traceHook(ev)
+	}
+	if ctx.coverage != nil && ev.Kind == TraceLine && ev.Filename != "" {
+		ctx.coverage.hit(ev.Filename, ev.Line)
+	}
+	if ctx.debugger != nil {
+		switch ev.Kind {
+		case TraceCall:
+			ctx.debugger.call()
+		case TraceLine:
+			ctx.debugger.line(ev)
+		}
+	}
+}
+
+// reportUnhandledRaise reports the pending exception to the hooks, if
+// it has not been seen by the VM, e.g. when it terminates the script.
+func (ctx *Context) reportUnhandledRaise() {
+	if C.my_hooks_take_raise(ctx.mrb) == C.mrb_bool(0) {
+		return
+	}
+	ev := TraceEvent{
+		Kind:  TraceRaise,
+		Line:  int(C.get_exception_line(ctx.mrb)),
+		Class: C.GoString(C.mrb_obj_classname(ctx.mrb, C.get_exception(ctx.mrb))),
+	}
+	if file := C.get_exception_file(ctx.mrb); file != nil {
+		ev.Filename = C.GoString(file)
+	}
+	ctx.dispatchHookEvent(ev)
+}
+
+//export go_hook_event
+func go_hook_event(mrb *C.mrb_state, kind C.int, file *C.char, line C.int, mid C.mrb_sym, class *C.struct_RClass) {
+	ctx, found := hookContext(mrb)
+	if !found {
+		return
+	}
+
+	ev := TraceEvent{Line: int(line)}
+	switch kind {
+	case C.MY_HOOK_LINE:
+		ev.Kind = TraceLine
+	case C.MY_HOOK_CALL:
+		ev.Kind = TraceCall
+	case C.MY_HOOK_RETURN:
+		ev.Kind = TraceReturn
+	case C.MY_HOOK_RAISE:
+		ev.Kind = TraceRaise
+	}
+	if file != nil {
+		ev.Filename = C.GoString(file)
+	}
+	if mid != 0 {
+		ev.Method = C.GoString(C.mrb_sym2name(mrb, mid))
+	}
+	if class != nil {
+		ev.Class = C.GoString(C.mrb_class_name(mrb, class))
+	}
+	ctx.dispatchHookEvent(ev)
+}
@@ -0,0 +1,19 @@
+// Copyright 2013-2015 Oliver Eilhard.
+// Use of this source code is governed by the MIT LICENSE that
+// can be found in the MIT-LICENSE file included in the project.
+
+//go:build mruby_debug_hook
+// +build mruby_debug_hook
+
+package mruby
+
+// Build with the mruby_debug_hook tag if mruby has been compiled with
+// MRB_ENABLE_DEBUG_HOOK, e.g. "go build -tags mruby_debug_hook". The
+// define changes the layout of mrb_state, so it must match the build
+// of mruby. It enables hooks, e.g. SetTraceHook, SetCoverage,
+// StartProfile, and NewDebugger.
+
+/*
+#cgo CFLAGS: -DMRB_ENABLE_DEBUG_HOOK
+*/
+import "C"
@@ -0,0 +1,116 @@
+// Copyright 2013-2015 Oliver Eilhard.
+// Use of this source code is governed by the MIT LICENSE that
+// can be found in the MIT-LICENSE file included in the project.
+
+package mruby
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// newHookContext returns a new context, or skips the test if mruby has
+// been compiled without hooks.
+func newHookContext(t *testing.T, options ...func(*Context)) *Context {
+	ctx := NewContext(options...)
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+	if err := ctx.SetTraceHook(nil); err == ErrHooksUnavailable {
+		t.Skip(err)
+	}
+	return ctx
+}
+
+func TestTraceHook(t *testing.T) {
+	ctx := newHookContext(t)
+
+	var events []TraceEvent
+	if err := ctx.SetTraceHook(func(ev TraceEvent) {
+		events = append(events, ev)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	code := "def add(a, b)\n  a + b\nend\nadd(1, 2)\n"
+	if _, err := ctx.LoadReader("trace.rb", strings.NewReader(code)); err != nil {
+		t.Fatal(err)
+	}
+
+	var lines []int
+	var call, ret bool
+	for _, ev := range events {
+		if ev.Filename != "trace.rb" {
+			t.Errorf("expected filename %q; got: %q", "trace.rb", ev.Filename)
+		}
+		switch ev.Kind {
+		case TraceLine:
+			lines = append(lines, ev.Line)
+		case TraceCall:
+			if ev.Method == "add" && ev.Class == "Object" && ev.Line == 4 {
+				call = true
+			}
+		case TraceReturn:
+			if ev.Method == "add" && ev.Line == 2 {
+				ret = true
+			}
+		}
+	}
+	if got := joinInts(lines); !strings.Contains(got, "1 4 2") {
+		t.Errorf("expected lines to contain %q; got: %q", "1 4 2", got)
+	}
+	if !call {
+		t.Errorf("expected call event for add; got: %v", events)
+	}
+	if !ret {
+		t.Errorf("expected return event for add; got: %v", events)
+	}
+
+	// Removing the hook stops events
+	if err := ctx.SetTraceHook(nil); err != nil {
+		t.Fatal(err)
+	}
+	events = nil
+	if _, err := ctx.LoadString("1 + 2"); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 0 {
+		t.Errorf("expected no events; got: %v", events)
+	}
+}
+
+func TestTraceHookRaise(t *testing.T) {
+	ctx := newHookContext(t)
+
+	var raised []TraceEvent
+	if err := ctx.SetTraceHook(func(ev TraceEvent) {
+		if ev.Kind == TraceRaise {
+			raised = append(raised, ev)
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	code := "begin\n  raise ArgumentError, 'rescued'\nrescue\nend\nraise 'unhandled'\n"
+	if _, err := ctx.LoadReader("raise.rb", strings.NewReader(code)); err == nil {
+		t.Fatal("expected error")
+	}
+	if len(raised) != 2 {
+		t.Fatalf("expected %d raise events; got: %v", 2, raised)
+	}
+	if raised[0].Class != "ArgumentError" {
+		t.Errorf("expected %q; got: %q", "ArgumentError", raised[0].Class)
+	}
+	if raised[1].Class != "RuntimeError" || raised[1].Line != 5 {
+		t.Errorf("expected RuntimeError in line %d; got: %v", 5, raised[1])
+	}
+}
+
+func joinInts(values []int) string {
+	s := make([]string, len(values))
+	for i, v := range values {
+		s[i] = strconv.Itoa(v)
+	}
+	return strings.Join(s, " ")
+}
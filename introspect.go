@@ -0,0 +1,235 @@
+// Copyright 2013-2015 Oliver Eilhard.
+// Use of this source code is governed by the MIT LICENSE that
+// can be found in the MIT-LICENSE file included in the project.
+
+package mruby
+
+/*
+#cgo pkg-config: mruby
+#include "mruby_go.h"
+*/
+import "C"
+
+import (
+	"sort"
+	"unsafe"
+)
+
+// Classes returns all named classes of the context, i.e. all classes
+// that can be reached via constants from Object, sorted by name.
+// Nested classes are included, e.g. "Net::HTTP".
+func (ctx *Context) Classes() ([]*Class, error) {
+	classes, _, err := ctx.namedClasses()
+	return classes, err
+}
+
+// Modules returns all named modules of the context, i.e. all modules
+// that can be reached via constants from Object, sorted by name.
+// Nested modules are included.
+func (ctx *Context) Modules() ([]*Module, error) {
+	_, modules, err := ctx.namedClasses()
+	return modules, err
+}
+
+// namedClasses walks the constants of Object and of all classes and
+// modules found there.
+func (ctx *Context) namedClasses() ([]*Class, []*Module, error) {
+	ctx.enter()
+	defer ctx.leave()
+
+	classes := []*Class{ctx.ObjectClass()}
+	var modules []*Module
+	seen := map[*C.struct_RClass]bool{ctx.mrb.object_class: true}
+	queue := []*C.struct_RClass{ctx.mrb.object_class}
+	for len(queue) > 0 {
+		outer := queue[0]
+		queue = queue[1:]
+		names, err := ctx.constants(outer, false)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, name := range names {
+			cname := C.CString(name)
+			var v C.mrb_value
+			found := C.my_const_get_at(ctx.mrb, outer, cname, &v)
+			C.free(unsafe.Pointer(cname))
+			if found == C.mrb_bool(0) {
+				continue
+			}
+			switch C.my_type(v) {
+			case C.MRB_TT_CLASS:
+				class := C.my_mrb_class_ptr(v)
+				if !seen[class] {
+					seen[class] = true
+					classes = append(classes, &Class{ctx: ctx, class: class})
+					queue = append(queue, class)
+				}
+			case C.MRB_TT_MODULE:
+				module := C.my_mrb_class_ptr(v)
+				if !seen[module] {
+					seen[module] = true
+					modules = append(modules, &Module{ctx: ctx, module: module})
+					queue = append(queue, module)
+				}
+			}
+		}
+	}
+	sort.Sort(classesByName(classes))
+	sort.Sort(modulesByName(modules))
+	return classes, modules, nil
+}
+
+type classesByName []*Class
+
+func (c classesByName) Len() int           { return len(c) }
+func (c classesByName) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c classesByName) Less(i, j int) bool { return c[i].Name() < c[j].Name() }
+
+type modulesByName []*Module
+
+func (m modulesByName) Len() int           { return len(m) }
+func (m modulesByName) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+func (m modulesByName) Less(i, j int) bool { return m[i].Name() < m[j].Name() }
+
+// constants returns the names of the constants of a class or module.
+// If inherit is true, constants of superclasses are included.
+func (ctx *Context) constants(class *C.struct_RClass, inherit bool) ([]string, error) {
+	ctx.enter()
+	defer ctx.leave()
+
+	inheritVal, err := ctx.ToValue(inherit)
+	if err != nil {
+		return nil, err
+	}
+	self := Value{ctx: ctx, v: C.my_mrb_class_value(class)}
+	names, err := self.funcall("constants", inheritVal)
+	if err != nil {
+		return nil, err
+	}
+	return names.toSortedStrings()
+}
+
+// instanceMethods returns the names of the instance methods of a class
+// or module.
+func (ctx *Context) instanceMethods(class *C.struct_RClass, inherited bool) ([]string, error) {
+	ctx.enter()
+	defer ctx.leave()
+
+	inheritedVal, err := ctx.ToValue(inherited)
+	if err != nil {
+		return nil, err
+	}
+	self := Value{ctx: ctx, v: C.my_mrb_class_value(class)}
+	names, err := self.funcall("instance_methods", inheritedVal)
+	if err != nil {
+		return nil, err
+	}
+	return names.toSortedStrings()
+}
+
+// ancestors returns the class or module, followed by its included
+// modules and superclasses, in method lookup order.
+func (ctx *Context) ancestors(class *C.struct_RClass) ([]RClass, error) {
+	ctx.enter()
+	defer ctx.leave()
+
+	self := Value{ctx: ctx, v: C.my_mrb_class_value(class)}
+	ary, err := self.funcall("ancestors")
+	if err != nil {
+		return nil, err
+	}
+	values, err := ary.ToArray()
+	if err != nil {
+		return nil, err
+	}
+	ancestors := make([]RClass, 0, len(values))
+	for _, v := range values {
+		if rc, ok := v.(RClass); ok {
+			ancestors = append(ancestors, rc)
+		}
+	}
+	return ancestors, nil
+}
+
+// toSortedStrings converts an array of symbols or strings to a sorted
+// slice of strings.
+func (v Value) toSortedStrings() ([]string, error) {
+	values, err := v.ToArray()
+	if err != nil {
+		return nil, err
+	}
+	strs := make([]string, 0, len(values))
+	for _, value := range values {
+		if s, ok := value.(string); ok {
+			strs = append(strs, s)
+		}
+	}
+	sort.Strings(strs)
+	return strs, nil
+}
+
+// Name returns the name of the class, including the names of the
+// modules it is nested in, e.g. "Net::HTTP".
+func (c *Class) Name() string {
+	c.ctx.enter()
+	defer c.ctx.leave()
+
+	return C.GoString(C.mrb_class_name(c.ctx.mrb, c.class))
+}
+
+// Superclass returns the superclass, or nil for BasicObject.
+func (c *Class) Superclass() *Class {
+	super := C.my_class_superclass(c.class)
+	if super == nil {
+		return nil
+	}
+	return &Class{ctx: c.ctx, class: super}
+}
+
+// Ancestors returns the class, followed by its included modules and
+// superclasses in method lookup order. The elements are of type *Class
+// or *Module.
+func (c *Class) Ancestors() ([]RClass, error) {
+	return c.ctx.ancestors(c.class)
+}
+
+// Constants returns the names of the constants defined in the class and
+// its superclasses, except Object, sorted.
+func (c *Class) Constants() ([]string, error) {
+	return c.ctx.constants(c.class, true)
+}
+
+// InstanceMethods returns the names of the instance methods, sorted.
+// If inherited is true, methods of superclasses and included modules
+// are included.
+func (c *Class) InstanceMethods(inherited bool) ([]string, error) {
+	return c.ctx.instanceMethods(c.class, inherited)
+}
+
+// Name returns the name of the module, including the names of the
+// modules it is nested in, e.g. "Admin::Helpers".
+func (m *Module) Name() string {
+	m.ctx.enter()
+	defer m.ctx.leave()
+
+	return C.GoString(C.mrb_class_name(m.ctx.mrb, m.module))
+}
+
+// Ancestors returns the module, followed by the modules it includes.
+// The elements are of type *Module.
+func (m *Module) Ancestors() ([]RClass, error) {
+	return m.ctx.ancestors(m.module)
+}
+
+// Constants returns the names of the constants defined in the module,
+// sorted.
+func (m *Module) Constants() ([]string, error) {
+	return m.ctx.constants(m.module, true)
+}
+
+// InstanceMethods returns the names of the instance methods of the
+// module, sorted. If inherited is true, methods of included modules are
+// included.
+func (m *Module) InstanceMethods(inherited bool) ([]string, error) {
+	return m.ctx.instanceMethods(m.module, inherited)
+}
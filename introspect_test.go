@@ -0,0 +1,146 @@
+// Copyright 2013-2015 Oliver Eilhard.
+// Use of this source code is governed by the MIT LICENSE that
+// can be found in the MIT-LICENSE file included in the project.
+
+package mruby
+
+import (
+	"strings"
+	"testing"
+)
+
+const introspectScript = `
+module Plugin
+  VERSION = "1.0"
+  module Helpers
+    def helper; end
+  end
+  class Base
+    LIMIT = 10
+    def run; end
+  end
+  class Exporter < Base
+    include Helpers
+    def export; end
+    def name; end
+  end
+end
+`
+
+func TestIntrospection(t *testing.T) {
+	ctx := NewContext()
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+	if _, err := ctx.LoadString(introspectScript); err != nil {
+		t.Fatal(err)
+	}
+
+	classes, err := ctx.Classes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]*Class)
+	for _, class := range classes {
+		names[class.Name()] = class
+	}
+	for _, name := range []string{"Object", "String", "Plugin::Base", "Plugin::Exporter"} {
+		if names[name] == nil {
+			t.Errorf("expected class %q in Classes", name)
+		}
+	}
+	if names["Plugin::Helpers"] != nil {
+		t.Errorf("expected module %q not to be in Classes", "Plugin::Helpers")
+	}
+
+	modules, err := ctx.Modules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, module := range modules {
+		if module.Name() == "Plugin::Helpers" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected module %q in Modules", "Plugin::Helpers")
+	}
+
+	plugin, ok := ctx.GetModule("Plugin", nil)
+	if !ok {
+		t.Fatalf("expected to find module %q", "Plugin")
+	}
+	consts, err := plugin.Constants()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(consts, ","); got != "Base,Exporter,Helpers,VERSION" {
+		t.Errorf("expected constants %q; got: %q", "Base,Exporter,Helpers,VERSION", got)
+	}
+
+	exporter := names["Plugin::Exporter"]
+	if exporter == nil {
+		t.Fatalf("expected to find class %q", "Plugin::Exporter")
+	}
+	if super := exporter.Superclass(); super == nil || super.Name() != "Plugin::Base" {
+		t.Errorf("expected superclass %q; got: %v", "Plugin::Base", super)
+	}
+	if super := names["BasicObject"].Superclass(); super != nil {
+		t.Errorf("expected BasicObject to have no superclass; got: %q", super.Name())
+	}
+
+	methods, err := exporter.InstanceMethods(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(methods, ","); got != "export,name" {
+		t.Errorf("expected methods %q; got: %q", "export,name", got)
+	}
+	methods, err = exporter.InstanceMethods(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"export", "helper", "run", "inspect"} {
+		if !contains(methods, name) {
+			t.Errorf("expected inherited methods to contain %q; got: %v", name, methods)
+		}
+	}
+
+	ancestors, err := exporter.Ancestors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ancestors) < 4 {
+		t.Fatalf("expected at least %d ancestors; got: %d", 4, len(ancestors))
+	}
+	var ancestorNames []string
+	for _, a := range ancestors[:4] {
+		switch a := a.(type) {
+		case *Class:
+			ancestorNames = append(ancestorNames, a.Name())
+		case *Module:
+			ancestorNames = append(ancestorNames, a.Name())
+		}
+	}
+	if got := strings.Join(ancestorNames, ","); got != "Plugin::Exporter,Plugin::Helpers,Plugin::Base,Object" {
+		t.Errorf("expected ancestors %q; got: %q", "Plugin::Exporter,Plugin::Helpers,Plugin::Base,Object", got)
+	}
+
+	consts, err = exporter.Constants()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !contains(consts, "LIMIT") {
+		t.Errorf("expected inherited constant %q; got: %v", "LIMIT", consts)
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,306 @@
+// Copyright 2013-2015 Oliver Eilhard.
+// Use of this source code is governed by the MIT LICENSE that
+// can be found in the MIT-LICENSE file included in the project.
+
+package mruby
+
+/*
+#cgo pkg-config: mruby
+#include "mruby_go.h"
+*/
+import "C"
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"unsafe"
+)
+
+// ioErrorPrelude defines IOError, which is raised for errors of the Go
+// readers and writers, unless mruby has been compiled with mruby-io.
+const ioErrorPrelude = `
+IOError = Class.new(StandardError) unless Object.const_defined?(:IOError)
+`
+
+// stdioPrelude defines the Ruby side of the Go-backed standard streams.
+// Instances of MrubyGo::Writer get a singleton method __write__ that
+// writes a String to the Go io.Writer.
+const stdioPrelude = `
+module MrubyGo
+  class Writer
+    def write(*args)
+      n = 0
+      args.each { |a| n += __write__(a.to_s) }
+      n
+    end
+
+    def print(*args)
+      args.each { |a| __write__(a.to_s) }
+      nil
+    end
+
+    def puts(*args)
+      if args.empty?
+        __write__("\n")
+        return nil
+      end
+      args.each do |a|
+        if a.is_a?(Array)
+          if a.empty?
+            __write__("\n")
+          else
+            a.each { |e| puts(e) }
+          end
+        else
+          s = a.to_s
+          __write__(s)
+          __write__("\n") unless s[-1] == "\n"
+        end
+      end
+      nil
+    end
+
+    def <<(s)
+      __write__(s.to_s)
+      self
+    end
+
+    def flush
+      self
+    end
+
+    def sync
+      true
+    end
+
+    def sync=(v)
+      v
+    end
+  end
+end
+
+module Kernel
+  def print(*args)
+    $stdout.print(*args)
+  end
+
+  def puts(*args)
+    $stdout.puts(*args)
+  end
+
+  def p(*args)
+    args.each { |a| $stdout.write(a.inspect, "\n") }
+    args.size <= 1 ? args.first : args
+  end
+
+  def warn(*msgs)
+    msgs.each { |m| $stderr.puts(m) }
+    nil
+  end
+end
+`
+
+// stdinPrelude defines the Ruby side of the Go-backed standard input.
+// Instances of MrubyGo::Reader get singleton methods __gets__, __read__,
+// and __eof__ that read from the Go io.Reader.
+const stdinPrelude = `
+module MrubyGo
+  class Reader
+    def gets
+      __gets__
+    end
+
+    def read(length = nil)
+      __read__(length)
+    end
+
+    def eof?
+      __eof__
+    end
+
+    def eof
+      __eof__
+    end
+
+    def each_line
+      while line = __gets__
+        yield line
+      end
+      self
+    end
+
+    def each(&block)
+      each_line(&block)
+    end
+
+    def readlines
+      lines = []
+      while line = __gets__
+        lines << line
+      end
+      lines
+    end
+  end
+end
+
+module Kernel
+  def gets
+    $stdin.gets
+  end
+end
+`
+
+// setupStdio replaces $stdout, $stderr, and the Kernel methods writing
+// to them with implementations that write to the Go writers configured
+// with SetStdout and SetStderr. If only one of them is configured, the
+// other one writes to the standard stream of the process.
+func (ctx *Context) setupStdio() error {
+	if err := ctx.loadInternal(ioErrorPrelude); err != nil {
+		return err
+	}
+	if err := ctx.loadInternal(stdioPrelude); err != nil {
+		return err
+	}
+
+	stdout := ctx.stdout
+	if stdout == nil {
+		stdout = os.Stdout
+	}
+	if err := ctx.setWriter("$stdout", stdout); err != nil {
+		return err
+	}
+
+	stderr := ctx.stderr
+	if stderr == nil {
+		stderr = os.Stderr
+	}
+	return ctx.setWriter("$stderr", stderr)
+}
+
+// newInternalObject creates an instance of the class with the given
+// name in the MrubyGo module.
+func (ctx *Context) newInternalObject(name string) (Value, error) {
+	module, found := ctx.GetModule("MrubyGo", nil)
+	if !found {
+		return NilValue(ctx), errors.New("module MrubyGo not found")
+	}
+	class, found := ctx.GetClass(name, module)
+	if !found {
+		return NilValue(ctx), fmt.Errorf("class MrubyGo::%s not found", name)
+	}
+	return Value{ctx: ctx, v: C.my_mrb_class_value(class.class)}.funcall("new")
+}
+
+// setWriter creates a MrubyGo::Writer that writes to w and assigns it
+// to the global variable with the given name. Errors of w are raised
+// as IOError.
+func (ctx *Context) setWriter(global string, w io.Writer) error {
+	obj, err := ctx.newInternalObject("Writer")
+	if err != nil {
+		return err
+	}
+
+	// Define __write__ on the singleton class of the new object,
+	// so that it writes to w.
+	singleton := &Class{ctx: ctx, class: C.my_singleton_class(ctx.mrb, obj.v)}
+	singleton.DefineMethod("__write__", func(ctx *Context) (Value, error) {
+		args, err := ctx.GetArgs()
+		if err != nil {
+			return NilValue(ctx), err
+		}
+		n := 0
+		for _, arg := range args {
+			if !arg.IsString() {
+				continue
+			}
+			p := C.GoStringN(C.my_str_ptr(arg.v), C.int(C.my_str_len(arg.v)))
+			written, err := io.WriteString(w, p)
+			n += written
+			if err != nil {
+				return NilValue(ctx), newRaiseError(ctx, "IOError", err.Error())
+			}
+		}
+		return ctx.ToValue(n)
+	})
+
+	cglobal := C.CString(global)
+	defer C.free(unsafe.Pointer(cglobal))
+	C.mrb_gv_set(ctx.mrb, C.mrb_intern_cstr(ctx.mrb, cglobal), obj.v)
+	return nil
+}
+
+// setupStdin creates a MrubyGo::Reader that reads from the Go reader
+// configured with SetStdin and assigns it to $stdin. Errors of the
+// reader are raised as IOError.
+func (ctx *Context) setupStdin() error {
+	if err := ctx.loadInternal(ioErrorPrelude); err != nil {
+		return err
+	}
+	if err := ctx.loadInternal(stdinPrelude); err != nil {
+		return err
+	}
+
+	obj, err := ctx.newInternalObject("Reader")
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(ctx.stdin)
+
+	// Define the methods reading from r on the singleton class of
+	// the new object.
+	singleton := &Class{ctx: ctx, class: C.my_singleton_class(ctx.mrb, obj.v)}
+	singleton.DefineMethod("__gets__", func(ctx *Context) (Value, error) {
+		line, err := r.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return NilValue(ctx), nil
+		}
+		if err != nil && err != io.EOF {
+			return NilValue(ctx), newRaiseError(ctx, "IOError", err.Error())
+		}
+		return ctx.ToValue(line)
+	})
+	singleton.DefineMethod("__read__", func(ctx *Context) (Value, error) {
+		args, err := ctx.GetArgs()
+		if err != nil {
+			return NilValue(ctx), err
+		}
+		if len(args) == 0 || args[0].IsNil() {
+			// Read everything; returns an empty string at EOF
+			data, err := ioutil.ReadAll(r)
+			if err != nil {
+				return NilValue(ctx), newRaiseError(ctx, "IOError", err.Error())
+			}
+			return ctx.ToValue(string(data))
+		}
+		length, err := args[0].ToInt()
+		if err != nil {
+			return NilValue(ctx), newRaiseError(ctx, "TypeError", err.Error())
+		}
+		if length < 0 {
+			return NilValue(ctx), newRaiseError(ctx, "ArgumentError", fmt.Sprintf("negative length %d given", length))
+		}
+		buf := make([]byte, length)
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return NilValue(ctx), newRaiseError(ctx, "IOError", err.Error())
+		}
+		if n == 0 && length > 0 {
+			// Read with a length returns nil at EOF
+			return NilValue(ctx), nil
+		}
+		return ctx.ToValue(string(buf[:n]))
+	})
+	singleton.DefineMethod("__eof__", func(ctx *Context) (Value, error) {
+		_, err := r.Peek(1)
+		return ctx.ToValue(err == io.EOF)
+	})
+
+	cglobal := C.CString("$stdin")
+	defer C.free(unsafe.Pointer(cglobal))
+	C.mrb_gv_set(ctx.mrb, C.mrb_intern_cstr(ctx.mrb, cglobal), obj.v)
+	return nil
+}
@@ -0,0 +1,210 @@
+// Copyright 2013-2015 Oliver Eilhard.
+// Use of this source code is governed by the MIT LICENSE that
+// can be found in the MIT-LICENSE file included in the project.
+
+package mruby
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStdout(t *testing.T) {
+	var stdout bytes.Buffer
+	ctx := NewContext(SetStdout(&stdout))
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	script := `
+puts "Hello"
+puts 1, [2, [3]], nil
+print "a", "b"
+print "\n"
+x = p :sym
+$stdout.write("w", 42)
+$stdout << "!" << "\n"
+x
+`
+	res, err := ctx.LoadStringResult(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != "sym" {
+		t.Errorf("expected p to return its argument; got: %v", res)
+	}
+	expected := "Hello\n1\n2\n3\n\nab\n:sym\nw42!\n"
+	if got := stdout.String(); got != expected {
+		t.Errorf("expected %q; got: %q", expected, got)
+	}
+}
+
+func TestStderr(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	ctx := NewContext(SetStdout(&stdout), SetStderr(&stderr))
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	_, err := ctx.LoadString(`warn "careful"; $stderr.puts "oops"; puts "fine"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, expected := stderr.String(), "careful\noops\n"; got != expected {
+		t.Errorf("expected %q; got: %q", expected, got)
+	}
+	if got, expected := stdout.String(), "fine\n"; got != expected {
+		t.Errorf("expected %q; got: %q", expected, got)
+	}
+}
+
+func TestStdoutPerContext(t *testing.T) {
+	var out1, out2 bytes.Buffer
+	ctx1 := NewContext(SetStdout(&out1))
+	ctx2 := NewContext(SetStdout(&out2))
+
+	if _, err := ctx1.LoadString(`puts "one"`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ctx2.LoadString(`puts "two"`); err != nil {
+		t.Fatal(err)
+	}
+	if got, expected := out1.String(), "one\n"; got != expected {
+		t.Errorf("expected %q; got: %q", expected, got)
+	}
+	if got, expected := out2.String(), "two\n"; got != expected {
+		t.Errorf("expected %q; got: %q", expected, got)
+	}
+}
+
+func TestStdin(t *testing.T) {
+	input := "first\nsecond\nthird"
+	ctx := NewContext(SetStdin(strings.NewReader(input)))
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	res, err := ctx.LoadStringResult("gets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != "first\n" {
+		t.Errorf("expected %q; got: %v", "first\n", res)
+	}
+
+	res, err = ctx.LoadStringResult(`
+lines = []
+$stdin.each_line { |line| lines << line.chomp.upcase }
+lines
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []interface{}{"SECOND", "THIRD"}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %v; got: %v", expected, res)
+	}
+
+	res, err = ctx.LoadStringResult("[$stdin.eof?, gets, $stdin.read, $stdin.read(1)]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []interface{}{true, nil, "", nil}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %v; got: %v", expected, res)
+	}
+}
+
+func TestStdinRead(t *testing.T) {
+	ctx := NewContext(SetStdin(strings.NewReader("abcdef")))
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	res, err := ctx.LoadStringResult("[$stdin.read(2), $stdin.eof?, $stdin.read]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []interface{}{"ab", false, "cdef"}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %v; got: %v", expected, res)
+	}
+}
+
+func TestStdinReadInvalidLength(t *testing.T) {
+	ctx := NewContext(SetStdin(strings.NewReader("abcdef")))
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	tests := []struct {
+		code  string
+		class string
+	}{
+		{"$stdin.read(-1)", "ArgumentError"},
+		{`$stdin.read("2")`, "TypeError"},
+	}
+	for _, test := range tests {
+		_, err := ctx.LoadString(test.code)
+		runErr, ok := err.(*RunError)
+		if !ok {
+			t.Errorf("%s: expected RunError; got: %v", test.code, err)
+			continue
+		}
+		if runErr.Class != test.class {
+			t.Errorf("%s: expected %s; got: %s: %s", test.code, test.class, runErr.Class, runErr.Message)
+		}
+	}
+
+	// Nothing has been read
+	res, err := ctx.LoadStringResult("$stdin.read")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != "abcdef" {
+		t.Errorf("expected %q; got: %v", "abcdef", res)
+	}
+}
+
+// failingWriter is an io.Writer that always fails.
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestStdoutWriteError(t *testing.T) {
+	ctx := NewContext(SetStdout(failingWriter{}))
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	for _, code := range []string{`$stdout.write("x")`, `puts "x"`, `print "x"`} {
+		_, err := ctx.LoadString(code)
+		runErr, ok := err.(*RunError)
+		if !ok {
+			t.Errorf("%s: expected RunError; got: %v", code, err)
+			continue
+		}
+		if runErr.Class != "IOError" || runErr.Message != "disk full" {
+			t.Errorf("%s: expected IOError: disk full; got: %s: %s", code, runErr.Class, runErr.Message)
+		}
+	}
+
+	res, err := ctx.LoadStringResult(`
+begin
+  puts "x"
+rescue IOError => e
+  e.message
+end
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != "disk full" {
+		t.Errorf("expected %q; got: %v", "disk full", res)
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2013-2015 Oliver Eilhard.
+// Use of this source code is governed by the MIT LICENSE that
+// can be found in the MIT-LICENSE file included in the project.
+
+package mruby
+
+/*
+#cgo pkg-config: mruby
+#include "mruby_go.h"
+*/
+import "C"
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"unsafe"
+)
+
+// loadPrelude defines LoadError if the linked mruby gems don't.
+const loadPrelude = `
+class LoadError < ScriptError; end unless Object.const_defined?(:LoadError)
+$LOADED_FEATURES = []
+$" = $LOADED_FEATURES
+`
+
+// loader implements require, require_relative, and load for scripts
+// that are stored in a fs.FS.
+type loader struct {
+	fsys    fs.FS
+	paths   []string // load path
+	loading []string // stack of files currently being loaded
+}
+
+// SetLoadFS enables Kernel#require, Kernel#require_relative, and
+// Kernel#load in the context. Files are looked up in fsys, e.g. an
+// embed.FS bundling a library of scripts. Use SetLoadPath to configure
+// the directories that require searches.
+// It is used for configuring a Context (see NewContext for details).
+func SetLoadFS(fsys fs.FS) func(*Context) {
+	return func(ctx *Context) {
+		if ctx.loader == nil {
+			ctx.loader = &loader{paths: []string{"."}}
+		}
+		ctx.loader.fsys = fsys
+	}
+}
+
+// SetLoadPath sets the directories in the file system given to SetLoadFS
+// that Kernel#require searches, in order (default: "."). Paths use
+// forward slashes and are relative to the root of the file system.
+// It is used for configuring a Context (see NewContext for details).
+func SetLoadPath(paths ...string) func(*Context) {
+	return func(ctx *Context) {
+		if ctx.loader == nil {
+			ctx.loader = &loader{}
+		}
+		ctx.loader.paths = paths
+	}
+}
+
+// setupLoader defines require, require_relative, and load in Kernel.
+func (ctx *Context) setupLoader() error {
+	if err := ctx.loadInternal(loadPrelude); err != nil {
+		return err
+	}
+
+	kernel := ctx.KernelModule()
+	kernel.DefineMethod("require", func(ctx *Context) (Value, error) {
+		name, err := ctx.loaderArg("require")
+		if err != nil {
+			return NilValue(ctx), err
+		}
+		filename, found := ctx.loader.resolve(name, "")
+		if !found {
+			return NilValue(ctx), newRaiseError(ctx, "LoadError", "cannot load such file -- "+name)
+		}
+		return ctx.require(filename)
+	})
+	kernel.DefineMethod("require_relative", func(ctx *Context) (Value, error) {
+		name, err := ctx.loaderArg("require_relative")
+		if err != nil {
+			return NilValue(ctx), err
+		}
+		filename, found := ctx.loader.resolve(name, ctx.loader.currentDir())
+		if !found {
+			return NilValue(ctx), newRaiseError(ctx, "LoadError", "cannot load such file -- "+name)
+		}
+		return ctx.require(filename)
+	})
+	kernel.DefineMethod("load", func(ctx *Context) (Value, error) {
+		name, err := ctx.loaderArg("load")
+		if err != nil {
+			return NilValue(ctx), err
+		}
+		filename, found := ctx.loader.resolve(name, "")
+		if !found {
+			return NilValue(ctx), newRaiseError(ctx, "LoadError", "cannot load such file -- "+name)
+		}
+		if err := ctx.loadFile(filename); err != nil {
+			return NilValue(ctx), err
+		}
+		return ctx.ToValue(true)
+	})
+	return nil
+}
+
+// loaderArg returns the single String argument of require and friends.
+func (ctx *Context) loaderArg(method string) (string, error) {
+	args, err := ctx.GetArgs()
+	if err != nil {
+		return "", err
+	}
+	if len(args) != 1 || !args[0].IsString() {
+		msg := fmt.Sprintf("%s expects a single String argument", method)
+		return "", newRaiseError(ctx, "ArgumentError", msg)
+	}
+	return args[0].ToString()
+}
+
+// require loads the file unless it is listed in $LOADED_FEATURES.
+// It returns true if the file has been loaded, and false if it was
+// loaded before.
+func (ctx *Context) require(filename string) (Value, error) {
+	cname := C.CString("$LOADED_FEATURES")
+	defer C.free(unsafe.Pointer(cname))
+	features := Value{ctx: ctx, v: C.mrb_gv_get(ctx.mrb, C.mrb_intern_cstr(ctx.mrb, cname))}
+	if !features.IsArray() {
+		return NilValue(ctx), newRaiseError(ctx, "LoadError", "$LOADED_FEATURES is not an Array")
+	}
+
+	feature, err := ctx.ToValue(filename)
+	if err != nil {
+		return NilValue(ctx), err
+	}
+	loaded, err := features.funcall("include?", feature)
+	if err != nil {
+		return NilValue(ctx), err
+	}
+	if b, _ := loaded.ToBool(); b {
+		return ctx.ToValue(false)
+	}
+
+	if err := ctx.loadFile(filename); err != nil {
+		return NilValue(ctx), err
+	}
+	C.mrb_ary_push(ctx.mrb, features.v, feature.v)
+	return ctx.ToValue(true)
+}
+
+// loadFile compiles and runs the file with the given name, using the
+// name as the filename in error messages, backtraces, and __FILE__.
+func (ctx *Context) loadFile(filename string) error {
+	for _, f := range ctx.loader.loading {
+		if f == filename {
+			chain := strings.Join(append(ctx.loader.loading, filename), " -> ")
+			return newRaiseError(ctx, "LoadError", "circular require: "+chain)
+		}
+	}
+
+	code, err := fs.ReadFile(ctx.loader.fsys, filename)
+	if err != nil {
+		return newRaiseError(ctx, "LoadError", err.Error())
+	}
+
+	ctx.loader.loading = append(ctx.loader.loading, filename)
+	defer func() {
+		ctx.loader.loading = ctx.loader.loading[:len(ctx.loader.loading)-1]
+	}()
+
+	proc, err := compile(ctx.mrb, string(code), filename, false)
+	if perr, ok := err.(*ParseError); ok {
+		return newRaiseError(ctx, "SyntaxError", fmt.Sprintf("%s:%d: %s", filename, perr.Line, perr.Message))
+	}
+	if err != nil {
+		return newRaiseError(ctx, "ScriptError", "cannot compile "+filename)
+	}
+	C.my_run_protected(ctx.mrb, proc)
+	if C.has_exception(ctx.mrb) != 0 {
+		return newRaiseErrorFromException(ctx)
+	}
+	return nil
+}
+
+// resolve returns the name of the file in the file system for the given
+// feature name. If dir is not empty, the name is resolved relative to
+// dir. Otherwise names starting with "./" or "../" are resolved relative
+// to the root of the file system, and all other names are searched in
+// the load path. The ".rb" extension is optional.
+func (l *loader) resolve(name, dir string) (string, bool) {
+	if !strings.HasSuffix(name, ".rb") {
+		name += ".rb"
+	}
+
+	var candidates []string
+	switch {
+	case dir != "":
+		candidates = []string{path.Join(dir, name)}
+	case strings.HasPrefix(name, "/"):
+		candidates = []string{path.Clean(strings.TrimPrefix(name, "/"))}
+	case strings.HasPrefix(name, "./"), strings.HasPrefix(name, "../"):
+		candidates = []string{path.Clean(name)}
+	default:
+		for _, p := range l.paths {
+			candidates = append(candidates, path.Join(p, name))
+		}
+	}
+
+	for _, candidate := range candidates {
+		if !fs.ValidPath(candidate) {
+			continue
+		}
+		if fi, err := fs.Stat(l.fsys, candidate); err == nil && !fi.IsDir() {
+			return candidate, true
+		}
+	}
+	return "", false
+}
+
+// currentDir returns the directory of the file currently being loaded,
+// or "." for scripts that have not been loaded via require.
+func (l *loader) currentDir() string {
+	if len(l.loading) == 0 {
+		return "."
+	}
+	return path.Dir(l.loading[len(l.loading)-1])
+}
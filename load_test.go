@@ -0,0 +1,130 @@
+// Copyright 2013-2015 Oliver Eilhard.
+// Use of this source code is governed by the MIT LICENSE that
+// can be found in the MIT-LICENSE file included in the project.
+
+package mruby
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestRequire(t *testing.T) {
+	fsys := fstest.MapFS{
+		"lib/greeter.rb": {Data: []byte(`
+require_relative "greeter/format"
+
+module Greeter
+  def self.greet(name)
+    Greeter::Format.wrap("Hello " + name)
+  end
+end
+`)},
+		"lib/greeter/format.rb": {Data: []byte(`
+module Greeter
+  module Format
+    def self.wrap(s)
+      "<" + s + ">"
+    end
+  end
+end
+`)},
+	}
+	ctx := NewContext(SetLoadFS(fsys), SetLoadPath("lib"))
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	res, err := ctx.LoadStringResult(`[require("greeter"), require("greeter.rb"), Greeter.greet("Oliver")]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []interface{}{true, false, "<Hello Oliver>"}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %v; got: %v", expected, res)
+	}
+
+	res, err = ctx.LoadStringResult(`$LOADED_FEATURES`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []interface{}{"lib/greeter/format.rb", "lib/greeter.rb"}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %v; got: %v", expected, res)
+	}
+}
+
+func TestRequireMissingFile(t *testing.T) {
+	ctx := NewContext(SetLoadFS(fstest.MapFS{}))
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	res, err := ctx.LoadStringResult(`
+begin
+  require "missing"
+rescue LoadError => e
+  e.message
+end
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != "cannot load such file -- missing" {
+		t.Errorf("expected LoadError; got: %v", res)
+	}
+}
+
+func TestRequireCircular(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.rb": {Data: []byte(`require "b"`)},
+		"b.rb": {Data: []byte(`require "a"`)},
+	}
+	ctx := NewContext(SetLoadFS(fsys))
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	_, err := ctx.LoadString(`require "a"`)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if !strings.Contains(err.Error(), "circular require: a.rb -> b.rb -> a.rb") {
+		t.Errorf("expected circular require error; got: %v", err)
+	}
+}
+
+func TestRequireErrorsReportFilename(t *testing.T) {
+	fsys := fstest.MapFS{
+		"syntax.rb": {Data: []byte("def broken(\n")},
+		"raises.rb": {Data: []byte("\n\nraise 'kaboom'\n")},
+		"file.rb":   {Data: []byte("$file = __FILE__\n")},
+	}
+	ctx := NewContext(SetLoadFS(fsys))
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	_, err := ctx.LoadString(`require "syntax"`)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if !strings.HasPrefix(err.Error(), "syntax.rb:") {
+		t.Errorf("expected error to start with filename; got: %v", err)
+	}
+
+	_, err = ctx.LoadString(`require "raises"`)
+	if err == nil || err.Error() != "kaboom" {
+		t.Errorf("expected error %q; got: %v", "kaboom", err)
+	}
+
+	res, err := ctx.LoadStringResult(`load "file"; $file`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != "file.rb" {
+		t.Errorf("expected __FILE__ to be %q; got: %v", "file.rb", res)
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright 2013-2015 Oliver Eilhard.
+// Use of this source code is governed by the MIT LICENSE that
+// can be found in the MIT-LICENSE file included in the project.
+
+package mruby
+
+/*
+#cgo pkg-config: mruby
+#include "mruby_go.h"
+*/
+import "C"
+
+// Locals returns the top-level local variables kept between calls of
+// LoadString, by name. It returns an empty map unless the context has
+// been configured with SetKeepLocals.
+func (ctx *Context) Locals() map[string]Value {
+	ctx.enter()
+	defer ctx.leave()
+
+	locals := make(map[string]Value)
+	n := int(C.my_session_locals_len(ctx.mrb, ctx.ctx))
+	for i := 0; i < n; i++ {
+		var sym C.mrb_sym
+		var v C.mrb_value
+		if C.my_session_local(ctx.mrb, ctx.ctx, C.int(i), &sym, &v) == C.mrb_bool(0) {
+			continue
+		}
+		var size C.mrb_int
+		name := C.GoStringN(C.mrb_sym2name_len(ctx.mrb, sym, &size), C.int(size))
+		locals[name] = Value{ctx: ctx, v: v}
+	}
+	return locals
+}
+
+// preserveLocals protects the top-level local variables kept by
+// SetKeepLocals from scripts that run without them, e.g. those loaded
+// by LoadReader, as these reuse the bottom of the VM stack. Call the
+// returned function when the script has finished.
+func (ctx *Context) preserveLocals() func() {
+	if !ctx.keepLocals || C.my_vm_running(ctx.mrb) != C.mrb_bool(0) {
+		return func() {}
+	}
+	saved := C.my_session_locals_save(ctx.mrb, ctx.ctx)
+	C.mrb_gc_register(ctx.mrb, saved)
+	return func() {
+		C.my_session_locals_restore(ctx.mrb, ctx.ctx, saved)
+		C.mrb_gc_unregister(ctx.mrb, saved)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2013-2015 Oliver Eilhard.
+// Use of this source code is governed by the MIT LICENSE that
+// can be found in the MIT-LICENSE file included in the project.
+
+package mruby
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestKeepLocals(t *testing.T) {
+	ctx := NewContext(SetKeepLocals(true))
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	if _, err := ctx.LoadString(`x = 1`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ctx.LoadString(`name = "mruby"; y = x + 1`); err != nil {
+		t.Fatal(err)
+	}
+	res, err := ctx.LoadStringResult(`[x, y, name]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := res.([]interface{}); !ok || len(got) != 3 || got[0] != 1 || got[1] != 2 || got[2] != "mruby" {
+		t.Errorf("expected %v; got: %v", []interface{}{1, 2, "mruby"}, res)
+	}
+
+	locals := ctx.Locals()
+	if len(locals) != 3 {
+		t.Errorf("expected %d locals; got: %d", 3, len(locals))
+	}
+	if v, found := locals["y"]; !found {
+		t.Errorf("expected local %q", "y")
+	} else if y, err := v.ToInt(); err != nil || y != 2 {
+		t.Errorf("expected %d; got: %d (err=%v)", 2, y, err)
+	}
+	if v, found := locals["name"]; !found {
+		t.Errorf("expected local %q", "name")
+	} else if name, err := v.ToString(); err != nil || name != "mruby" {
+		t.Errorf("expected %q; got: %q (err=%v)", "mruby", name, err)
+	}
+
+	// Scripts run without the session must not clobber its locals
+	if _, err := ctx.LoadReader("other.rb", strings.NewReader(`a = 100; b = 200; c = 300; a + b + c`)); err != nil {
+		t.Fatal(err)
+	}
+	res, err = ctx.LoadStringResult(`x + y`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != 3 {
+		t.Errorf("expected %d; got: %v", 3, res)
+	}
+
+	// Locals survive exceptions
+	if _, err := ctx.LoadString(`z = 3; raise "kaboom"`); err == nil {
+		t.Fatal("expected error")
+	}
+	res, err = ctx.LoadStringResult(`x`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != 1 {
+		t.Errorf("expected %d; got: %v", 1, res)
+	}
+}
+
+func TestLocalsAreNotKeptByDefault(t *testing.T) {
+	ctx := NewContext()
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	if _, err := ctx.LoadString(`x = 1`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ctx.LoadString(`x`); err == nil {
+		t.Error("expected NameError for local of a previous script")
+	}
+	if locals := ctx.Locals(); len(locals) != 0 {
+		t.Errorf("expected no locals; got: %v", locals)
+	}
+}
@@ -23,6 +23,11 @@ type Module struct {
 // NewModule defines a new module with the given name under outer.
 // If outer is nil, the registered module is a top-level module.
 func NewModule(ctx *Context, name string, outer RClass) (*Module, error) {
+	ctx.enter()
+	defer ctx.leave()
+
+	ctx.recordNewModule(name, outer)
+
 	cname := C.CString(name)
 	defer C.free(unsafe.Pointer(cname))
 	if outer == nil {
@@ -45,6 +50,9 @@ func (ctx *Context) DefineModule(name string, outer RClass) (*Module, error) {
 
 // HasModule tests if the context has a module with the given name.
 func (ctx *Context) HasModule(name string, outer RClass) bool {
+	ctx.enter()
+	defer ctx.leave()
+
 	cname := C.CString(name)
 	defer C.free(unsafe.Pointer(cname))
 	var klass *C.struct_RClass
@@ -57,6 +65,9 @@ func (ctx *Context) HasModule(name string, outer RClass) bool {
 
 // GetModule returns the given module.
 func (ctx *Context) GetModule(name string, outer RClass) (*Module, bool) {
+	ctx.enter()
+	defer ctx.leave()
+
 	if !ctx.HasModule(name, outer) {
 		return nil, false
 	}
@@ -78,6 +89,10 @@ func (ctx *Context) GetModule(name string, outer RClass) (*Module, bool) {
 // DefineMethod registers a method with the name in the module.
 // The function is called when executed in Ruby.
 func (m *Module) DefineMethod(name string, f Function) {
+	m.ctx.enter()
+	defer m.ctx.leave()
+
+	m.ctx.recordMethod(m.module, true, false, name, f)
 	m.ctx.addMethod(m.module, name, f)
 
 	cname := C.CString(name)
@@ -96,6 +111,10 @@ func (m *Module) DefineMethod(name string, f Function) {
 // DefineClassMethod registers a class method with the name in the module.
 // The function is called when executed in Ruby.
 func (m *Module) DefineClassMethod(name string, f Function) {
+	m.ctx.enter()
+	defer m.ctx.leave()
+
+	m.ctx.recordMethod(m.module, true, true, name, f)
 	m.ctx.addMethod(m.module.c, name, f)
 
 	cname := C.CString(name)
@@ -15,7 +15,10 @@
 #include <mruby/proc.h>
 #include <mruby/data.h>
 #include <mruby/compile.h>
+#include <mruby/dump.h>
+#include <mruby/irep.h>
 #include <mruby/string.h>
+#include <mruby/throw.h>
 #include <mruby/value.h>
 #include <mruby/variable.h>
 
@@ -31,6 +34,51 @@ static inline struct mrbc_context *my_context_new(mrb_state *mrb, const char *fi
 	return ctx;
 }
 
+// Session locals, see locals.go. Top-level local variables of scripts
+// run with keep_lv live at the bottom of the VM stack, after self.
+
+static inline void my_context_keep_locals(mrbc_context *cxt) {
+	cxt->keep_lv = TRUE;
+}
+
+// my_session_locals_len returns the number of top-level local variables
+// kept by cxt.
+static inline int my_session_locals_len(mrb_state *mrb, mrbc_context *cxt) {
+	int n;
+
+	if (!cxt->keep_lv || mrb->c->stbase == NULL) {
+		return 0;
+	}
+	n = cxt->slen;
+	if (n + 1 > mrb->c->stend - mrb->c->stbase) {
+		n = (int)(mrb->c->stend - mrb->c->stbase) - 1;
+	}
+	return n;
+}
+
+static inline mrb_bool my_session_local(mrb_state *mrb, mrbc_context *cxt, int i, mrb_sym *name, mrb_value *value) {
+	*name = cxt->syms[i];
+	*value = mrb->c->stbase[i + 1];
+	return *name != 0;
+}
+
+// my_session_locals_save returns the values of the top-level local
+// variables kept by cxt, so that scripts run without cxt can't clobber
+// them, see my_session_locals_restore.
+static inline mrb_value my_session_locals_save(mrb_state *mrb, mrbc_context *cxt) {
+	int n = my_session_locals_len(mrb, cxt);
+	return mrb_ary_new_from_values(mrb, n, mrb->c->stbase + 1);
+}
+
+static inline void my_session_locals_restore(mrb_state *mrb, mrbc_context *cxt, mrb_value saved) {
+	int n = my_session_locals_len(mrb, cxt);
+	mrb_int i;
+
+	for (i = 0; i < RARRAY_LEN(saved) && i < n; i++) {
+		mrb->c->stbase[i + 1] = RARRAY_PTR(saved)[i];
+	}
+}
+
 static inline struct mrb_parser_state *my_parse(mrb_state *mrb, mrbc_context *ctx, char *ruby_code) {
 	struct mrb_parser_state *parser = mrb_parser_new(mrb);
 
@@ -50,6 +98,10 @@ static inline struct mrb_parser_state *my_parse(mrb_state *mrb, mrbc_context *ct
 //	);
 //}
 
+static inline mrb_value my_proc_value(struct RProc *proc) {
+	return mrb_obj_value(proc);
+}
+
 static inline mrb_value my_run(mrb_state *mrb, struct RProc *proc) {
 	return mrb_context_run(mrb,
 		proc,
@@ -58,10 +110,211 @@ static inline mrb_value my_run(mrb_state *mrb, struct RProc *proc) {
 	);
 }
 
+// my_ci_unwind pops the frames above the frame with index nth_ci, as
+// the VM does when an exception is not caught by a script.
+static inline void my_ci_unwind(mrb_state *mrb, ptrdiff_t nth_ci) {
+	while (mrb->c->ci - mrb->c->cibase > nth_ci) {
+		struct REnv *env = mrb->c->ci->env;
+		mrb->c->stack = mrb->c->ci->stackent;
+		mrb->c->ci--;
+		if (env) {
+			mrb_env_unshare(mrb, env);
+		}
+	}
+}
+
+// my_run_protected_keep runs proc as a top-level script, keeping the
+// first stack_keep registers, e.g. the top-level local variables of a
+// session. Other than my_run, it may be called while the VM is running,
+// e.g. from a Go function. If the script raises, the exception is
+// caught and left in mrb->exc, so it never unwinds through Go stack
+// frames.
+static inline mrb_value my_run_protected_keep(mrb_state *mrb, struct RProc *proc, unsigned int stack_keep) {
+	struct mrb_jmpbuf *prev_jmp = mrb->jmp;
+	struct mrb_jmpbuf c_jmp;
+	ptrdiff_t nth_ci = mrb->c->ci - mrb->c->cibase;
+	mrb_value result = mrb_nil_value();
+
+	MRB_TRY(&c_jmp) {
+		mrb->jmp = &c_jmp;
+		result = mrb_toplevel_run_keep(mrb, proc, stack_keep);
+		mrb->jmp = prev_jmp;
+	} MRB_CATCH(&c_jmp) {
+		my_ci_unwind(mrb, nth_ci);
+		mrb->jmp = prev_jmp;
+		result = mrb_nil_value();
+	} MRB_END_EXC(&c_jmp);
+
+	return result;
+}
+
+// my_run_protected runs proc like my_run_protected_keep, without
+// keeping registers.
+static inline mrb_value my_run_protected(mrb_state *mrb, struct RProc *proc) {
+	return my_run_protected_keep(mrb, proc, 0);
+}
+
+// my_context_stack_keep returns the number of registers to keep when
+// running a script compiled with cxt: self and the top-level local
+// variables if cxt keeps them, as mrb_load_string_cxt does.
+static inline unsigned int my_context_stack_keep(mrbc_context *cxt) {
+	return cxt->keep_lv ? cxt->slen + 1 : 0;
+}
+
+// Scopes
+
+// my_vm_running returns true while the VM runs a script, e.g. when
+// called from a Go function.
+static inline mrb_bool my_vm_running(mrb_state *mrb) {
+	return mrb->c->ci != mrb->c->cibase;
+}
+
+// my_scope_new returns a new object of a new anonymous class, to be
+// used as self of the scripts run in a scope, see scope.go.
+static inline mrb_value my_scope_new(mrb_state *mrb) {
+	struct RClass *klass = mrb_class_new(mrb, mrb->object_class);
+	return mrb_obj_new(mrb, klass, 0, NULL);
+}
+
+// my_run_scoped runs proc like my_run_protected, but with self as the
+// top-level object, and klass receiving the methods, classes, and
+// constants defined at the top level. The VM must not be running.
+static inline mrb_value my_run_scoped(mrb_state *mrb, struct RProc *proc, mrb_value self, struct RClass *klass) {
+	struct mrb_jmpbuf *prev_jmp = mrb->jmp;
+	struct mrb_jmpbuf c_jmp;
+	struct RClass *prev_class = mrb->c->cibase->target_class;
+	mrb_value result = mrb_nil_value();
+
+	proc->target_class = klass;
+	mrb->c->cibase->target_class = klass;
+	MRB_TRY(&c_jmp) {
+		mrb->jmp = &c_jmp;
+		result = mrb_context_run(mrb, proc, self, 0);
+		mrb->jmp = prev_jmp;
+	} MRB_CATCH(&c_jmp) {
+		mrb->jmp = prev_jmp;
+		result = mrb_nil_value();
+	} MRB_END_EXC(&c_jmp);
+	mrb->c->cibase->target_class = prev_class;
+
+	return result;
+}
+
+// my_user_global_p returns true for globals visible to scripts, i.e.
+// names starting with "$". Internal entries of mruby and gems are not
+// user globals, nor are $1 to $9, which are always listed by
+// global_variables.
+static inline mrb_bool my_user_global_p(mrb_state *mrb, mrb_value name) {
+	mrb_int len;
+	const char *s = mrb_sym2name_len(mrb, mrb_symbol(name), &len);
+	if (len < 2 || s[0] != '$') {
+		return FALSE;
+	}
+	return !(len == 2 && s[1] >= '1' && s[1] <= '9');
+}
+
+// my_globals_save returns a hash with the values of all user globals.
+static inline mrb_value my_globals_save(mrb_state *mrb) {
+	mrb_value names = mrb_f_global_variables(mrb, mrb_top_self(mrb));
+	mrb_value saved = mrb_hash_new(mrb);
+	mrb_int i;
+
+	for (i = 0; i < RARRAY_LEN(names); i++) {
+		mrb_value name = RARRAY_PTR(names)[i];
+		if (my_user_global_p(mrb, name)) {
+			mrb_hash_set(mrb, saved, name, mrb_gv_get(mrb, mrb_symbol(name)));
+		}
+	}
+	return saved;
+}
+
+// my_globals_restore restores the user globals saved by
+// my_globals_save, and removes the user globals defined since.
+static inline void my_globals_restore(mrb_state *mrb, mrb_value saved) {
+	mrb_value names = mrb_f_global_variables(mrb, mrb_top_self(mrb));
+	mrb_value keys;
+	mrb_int i;
+
+	for (i = 0; i < RARRAY_LEN(names); i++) {
+		mrb_value name = RARRAY_PTR(names)[i];
+		if (my_user_global_p(mrb, name) && mrb_undef_p(mrb_hash_fetch(mrb, saved, name, mrb_undef_value()))) {
+			mrb_gv_remove(mrb, mrb_symbol(name));
+		}
+	}
+	keys = mrb_hash_keys(mrb, saved);
+	for (i = 0; i < RARRAY_LEN(keys); i++) {
+		mrb_value name = RARRAY_PTR(keys)[i];
+		mrb_gv_set(mrb, mrb_symbol(name), mrb_hash_get(mrb, saved, name));
+	}
+}
+
+// Bytecode
+
+// my_open_core opens a mruby state without gems, e.g. for compiling.
+static inline mrb_state *my_open_core() {
+	return mrb_open_core(mrb_default_allocf, NULL);
+}
+
+static inline int my_dump_irep(mrb_state *mrb, struct RProc *proc, uint8_t **bin, size_t *bin_size) {
+	return mrb_dump_irep(mrb, proc->body.irep, DUMP_DEBUG_INFO, bin, bin_size);
+}
+
+static inline int my_dump_ok() {
+	return MRB_DUMP_OK;
+}
+
+static inline size_t my_rite_header_size() {
+	return sizeof(struct rite_binary_header);
+}
+
+static inline const char *my_rite_ident() {
+	return RITE_BINARY_IDENT;
+}
+
+static inline const char *my_rite_version() {
+	return RITE_BINARY_FORMAT_VER;
+}
+
+static inline struct RProc *my_read_irep(mrb_state *mrb, const uint8_t *bin) {
+	mrb_irep *irep = mrb_read_irep(mrb, bin);
+	struct RProc *proc;
+
+	if (irep == NULL) {
+		return NULL;
+	}
+	proc = mrb_proc_new(mrb, irep);
+	mrb_irep_decref(mrb, irep);
+	return proc;
+}
+
 static inline int has_exception(mrb_state *mrb) {
 	return mrb->exc != 0;
 }
 
+static inline const char *get_exception_file(mrb_state *mrb) {
+	mrb_value file = mrb_iv_get(mrb, mrb_obj_value(mrb->exc), mrb_intern_lit(mrb, "file"));
+	if (!mrb_string_p(file)) {
+		return NULL;
+	}
+	return mrb_string_value_ptr(mrb, file);
+}
+
+static inline mrb_int get_exception_line(mrb_state *mrb) {
+	mrb_value line = mrb_iv_get(mrb, mrb_obj_value(mrb->exc), mrb_intern_lit(mrb, "line"));
+	if (!mrb_fixnum_p(line)) {
+		return 0;
+	}
+	return mrb_fixnum(line);
+}
+
+static inline mrb_value get_exception_backtrace(mrb_state *mrb) {
+	return mrb_exc_backtrace(mrb, mrb_obj_value(mrb->exc));
+}
+
+static inline mrb_value get_exception(mrb_state *mrb) {
+	return mrb_obj_value(mrb->exc);
+}
+
 static inline void reset_exception(mrb_state *mrb) {
 	mrb->exc = 0;
 }
@@ -93,6 +346,14 @@ static inline mrb_int get_fixnum(mrb_value v) {
 	return mrb_fixnum(v);
 }
 
+static inline mrb_int get_int_max() {
+	return MRB_INT_MAX;
+}
+
+static inline mrb_int get_int_min() {
+	return MRB_INT_MIN;
+}
+
 static inline mrb_sym get_symbol(mrb_value v) {
 	return mrb_symbol(v);
 }
@@ -145,6 +406,75 @@ static inline struct RProc *my_mrb_proc_ptr(mrb_value v) {
 	return mrb_proc_ptr(v);
 }
 
+static inline struct RClass *my_mrb_class_ptr(mrb_value v) {
+	return mrb_class_ptr(v);
+}
+
+static inline mrb_value my_mrb_class_value(struct RClass *klass) {
+	return mrb_obj_value(klass);
+}
+
+// my_argv_set makes ARGV refer to argv and returns the array it
+// referred to before, or nil, see setArgv in context.go.
+static inline mrb_value my_argv_set(mrb_state *mrb, mrb_value argv) {
+	mrb_value object = mrb_obj_value(mrb->object_class);
+	mrb_sym sym = mrb_intern_lit(mrb, "ARGV");
+	mrb_value prev = mrb_iv_get(mrb, object, sym);
+
+	mrb_iv_set(mrb, object, sym, argv);
+	return prev;
+}
+
+static inline struct RClass *my_singleton_class(mrb_state *mrb, mrb_value v) {
+	return mrb_class_ptr(mrb_singleton_class(mrb, v));
+}
+
+static inline const char *my_str_ptr(mrb_value v) {
+	return RSTRING_PTR(v);
+}
+
+static inline mrb_int my_str_len(mrb_value v) {
+	return RSTRING_LEN(v);
+}
+
+static inline mrb_bool my_respond_to(mrb_state *mrb, mrb_value v, const char *name) {
+	return mrb_respond_to(mrb, v, mrb_intern_cstr(mrb, name));
+}
+
+// my_obj_ptr returns the object referenced by v, e.g. to detect cycles
+// when converting it to Go.
+static inline void *my_obj_ptr(mrb_value v) {
+	return mrb_ptr(v);
+}
+
+// my_funcall_argv calls the method with the given name like
+// mrb_funcall_argv. If the method raises, the exception is caught and
+// left in mrb->exc, like in my_run_protected. Other than
+// mrb_funcall_argv, this also holds when called from a Go function,
+// where mrb->jmp is set and the exception would otherwise unwind
+// through Go stack frames.
+static inline mrb_value my_funcall_argv(mrb_state *mrb, mrb_value self, const char *name, mrb_int argc, const mrb_value *argv) {
+	struct mrb_jmpbuf *prev_jmp = mrb->jmp;
+	struct mrb_jmpbuf c_jmp;
+	ptrdiff_t nth_ci = mrb->c->ci - mrb->c->cibase;
+	mrb_sym mid = mrb_intern_cstr(mrb, name);
+	mrb_value result = mrb_nil_value();
+
+	MRB_TRY(&c_jmp) {
+		mrb->jmp = &c_jmp;
+		result = mrb_funcall_argv(mrb, self, mid, argc, argv);
+		mrb->jmp = prev_jmp;
+	} MRB_CATCH(&c_jmp) {
+		// Pop the frames of the method, as mrb_funcall_argv does when
+		// called without mrb->jmp
+		my_ci_unwind(mrb, nth_ci);
+		mrb->jmp = prev_jmp;
+		result = mrb_nil_value();
+	} MRB_END_EXC(&c_jmp);
+
+	return result;
+}
+
 static inline mrb_bool my_mrb_const_defined_at(mrb_state *mrb, const char *name) {
 	mrb_sym id = mrb_intern_cstr(mrb, name);
 	return mrb_const_defined_at(mrb, mrb_obj_value(mrb->object_class), id);
@@ -172,12 +502,165 @@ static inline mrb_bool my_mrb_has_module(mrb_state *mrb, struct RClass *klass, c
 	return mrb_const_defined_at(mrb, mrb_obj_value(mrb->object_class), mrb_symbol(sym));
 }
 
+// Introspection
+
+// my_class_superclass returns the superclass of klass, skipping the
+// classes that represent included modules, or NULL for BasicObject.
+static inline struct RClass *my_class_superclass(struct RClass *klass) {
+	struct RClass *c = klass->super;
+
+	while (c != NULL && c->tt == MRB_TT_ICLASS) {
+		c = c->super;
+	}
+	return c;
+}
+
+// Variables and constants
+
+static inline void my_gv_set(mrb_state *mrb, const char *name, mrb_value v) {
+	mrb_gv_set(mrb, mrb_intern_cstr(mrb, name), v);
+}
+
+static inline mrb_value my_gv_get(mrb_state *mrb, const char *name) {
+	mrb_value sym = mrb_check_intern_cstr(mrb, name);
+	if (mrb_nil_p(sym)) {
+		return mrb_nil_value();
+	}
+	return mrb_gv_get(mrb, mrb_symbol(sym));
+}
+
+static inline void my_const_set_at(mrb_state *mrb, struct RClass *outer, const char *name, mrb_value v) {
+	mrb_const_set(mrb, mrb_obj_value(outer), mrb_intern_cstr(mrb, name), v);
+}
+
+// my_iv_p returns true if v can have instance variables.
+static inline mrb_bool my_iv_p(mrb_value v) {
+	switch (mrb_type(v)) {
+	case MRB_TT_OBJECT:
+	case MRB_TT_CLASS:
+	case MRB_TT_MODULE:
+	case MRB_TT_SCLASS:
+	case MRB_TT_HASH:
+	case MRB_TT_DATA:
+	case MRB_TT_EXCEPTION:
+		return TRUE;
+	default:
+		return FALSE;
+	}
+}
+
+static inline void my_iv_set(mrb_state *mrb, mrb_value obj, const char *name, mrb_value v) {
+	mrb_iv_set(mrb, obj, mrb_intern_cstr(mrb, name), v);
+}
+
+static inline mrb_value my_iv_get(mrb_state *mrb, mrb_value obj, const char *name) {
+	mrb_value sym = mrb_check_intern_cstr(mrb, name);
+	if (mrb_nil_p(sym)) {
+		return mrb_nil_value();
+	}
+	return mrb_iv_get(mrb, obj, mrb_symbol(sym));
+}
+
+// Sandbox
+
+static inline mrb_bool my_const_get_at(mrb_state *mrb, struct RClass *outer, const char *name, mrb_value *out) {
+	mrb_value sym = mrb_check_intern_cstr(mrb, name);
+	if (mrb_nil_p(sym)) {
+		return FALSE;
+	}
+	if (!mrb_const_defined_at(mrb, mrb_obj_value(outer), mrb_symbol(sym))) {
+		return FALSE;
+	}
+	*out = mrb_const_get(mrb, mrb_obj_value(outer), mrb_symbol(sym));
+	return TRUE;
+}
+
+static inline mrb_bool my_const_remove_at(mrb_state *mrb, struct RClass *outer, const char *name) {
+	mrb_value sym = mrb_check_intern_cstr(mrb, name);
+	if (mrb_nil_p(sym)) {
+		return FALSE;
+	}
+	if (!mrb_const_defined_at(mrb, mrb_obj_value(outer), mrb_symbol(sym))) {
+		return FALSE;
+	}
+	mrb_const_remove(mrb, mrb_obj_value(outer), mrb_symbol(sym));
+	return TRUE;
+}
+
+static inline mrb_bool my_undef_method(mrb_state *mrb, struct RClass *klass, const char *name) {
+	mrb_value sym = mrb_check_intern_cstr(mrb, name);
+	if (mrb_nil_p(sym)) {
+		return FALSE;
+	}
+	if (!mrb_obj_respond_to(mrb, klass, mrb_symbol(sym))) {
+		return FALSE;
+	}
+	mrb_undef_method(mrb, klass, name);
+	return TRUE;
+}
+
+static inline mrb_bool my_class_inherits(struct RClass *klass, struct RClass *super) {
+	while (klass) {
+		if (klass == super) {
+			return TRUE;
+		}
+		klass = klass->super;
+	}
+	return FALSE;
+}
+
+static inline int is_class_or_module(mrb_value v) {
+	switch (mrb_type(v)) {
+	case MRB_TT_CLASS:
+	case MRB_TT_MODULE:
+	case MRB_TT_SCLASS:
+		return TRUE;
+	default:
+		return FALSE;
+	}
+}
+
+static inline mrb_value my_exc_new(mrb_state *mrb, struct RClass *klass, const char *msg, size_t len) {
+	return mrb_exc_new(mrb, klass, msg, len);
+}
+
+// my_class_display_name returns the name of klass. For singleton classes,
+// it returns the name of the class or module they are attached to, and
+// sets singleton to TRUE.
+static inline const char *my_class_display_name(mrb_state *mrb, struct RClass *klass, mrb_bool *singleton) {
+	*singleton = FALSE;
+	if (klass->tt == MRB_TT_SCLASS) {
+		mrb_value attached = mrb_iv_get(mrb, mrb_obj_value(klass), mrb_intern_lit(mrb, "__attached__"));
+		if (is_class_or_module(attached)) {
+			*singleton = TRUE;
+			return mrb_class_name(mrb, mrb_class_ptr(attached));
+		}
+	}
+	return mrb_class_name(mrb, klass);
+}
+
+static inline struct RClass *my_runtime_error_class(mrb_state *mrb) {
+	return E_RUNTIME_ERROR;
+}
+
 // Ruby -> Go
 
-extern mrb_value my_mrb_func_call(mrb_state *, mrb_value);
+extern mrb_value my_mrb_func_call(mrb_state *, mrb_value, mrb_value *);
+
+// my_mrb_func_call_raise calls the Go function and raises the exception
+// it returns, if any. Raising is done here, after the Go function has
+// returned, as the VM must not unwind through Go stack frames.
+static inline mrb_value my_mrb_func_call_raise(mrb_state *mrb, mrb_value self) {
+	mrb_value exc = mrb_nil_value();
+	mrb_value result = my_mrb_func_call(mrb, self, &exc);
+	if (!mrb_nil_p(exc)) {
+		mrb_exc_raise(mrb, exc);
+	}
+	return result;
+}
 
 static inline mrb_func_t my_mrb_func_call_t() {
-	return &my_mrb_func_call;
+	return &my_mrb_func_call_raise;
 }
 
 /*
@@ -243,4 +726,394 @@ static inline int my_get_args_all(mrb_state *mrb) {
 	return count;
 }
 
+// Hooks
+
+// Events reported to Go by my_code_fetch_hook, see hook.go.
+#define MY_HOOK_LINE   1
+#define MY_HOOK_CALL   2
+#define MY_HOOK_RETURN 4
+#define MY_HOOK_RAISE  8
+#define MY_HOOK_IREP   16
+#define MY_HOOK_SAMPLE 32
+
+// Declared in hook.go
+extern void go_hook_event(mrb_state*, int, char*, int, mrb_sym, struct RClass*);
+
+// Declared in profile.go
+extern void go_hook_sample(mrb_state*, mrb_code*, int);
+
+// Declared in coverage.go
+extern void go_hook_irep(mrb_state*, struct mrb_irep*);
+extern void go_hook_line_found(mrb_state*, char*, int);
+
+#ifdef MRB_ENABLE_DEBUG_HOOK
+
+#include <mruby/debug.h>
+#include <mruby/opcode.h>
+
+// my_hook_state is the state of the hooks of a mrb_state.
+typedef struct my_hook_state {
+	mrb_state *mrb;           // state the hooks are installed in
+	struct my_hook_state *next;
+	int mask;                 // events to report
+	int busy;                 // set while Go handles an event
+	struct mrb_irep *irep;    // irep of the last line event
+	int32_t line;             // line of the last line event
+	struct RObject *exc;      // last exception reported
+	int samples;              // samples to take, incremented by my_hooks_tick
+	mrb_code *pc;             // instruction about to be executed
+	int abort;                // raise to abort the script, see my_hooks_abort
+} my_hook_state;
+
+// Defined in hook.c
+extern my_hook_state *my_hooks_state(mrb_state *mrb);
+extern my_hook_state *my_hooks_state_new(mrb_state *mrb);
+extern void my_hooks_state_free(mrb_state *mrb);
+
+static inline int my_hooks_available() {
+	return TRUE;
+}
+
+static inline void my_hook_event(mrb_state *mrb, my_hook_state *st, int kind, const char *file, int32_t line, mrb_sym mid, struct RClass *klass) {
+	st->busy = TRUE;
+	go_hook_event(mrb, kind, (char *)file, line, mid, klass);
+	st->busy = FALSE;
+	if (st->abort) {
+		// Raised here, after Go has returned, see my_mrb_func_call_raise
+		st->abort = FALSE;
+		mrb_raise(mrb, mrb->eException_class, "aborted by debugger");
+	}
+}
+
+static inline struct RClass *my_ci_target_class(mrb_state *mrb) {
+	mrb_callinfo *ci = mrb->c->ci;
+	return ci->proc ? ci->proc->target_class : NULL;
+}
+
+// my_code_fetch_hook is called by the VM before every instruction.
+// It calls into Go only for the events requested in the mask, and
+// for line events only if the line has changed.
+static inline void my_code_fetch_hook(mrb_state *mrb, mrb_irep *irep, mrb_code *pc, mrb_value *regs) {
+	my_hook_state *st = my_hooks_state(mrb);
+	uint32_t off;
+	const char *file;
+	int32_t line;
+	mrb_code i;
+
+	if (st == NULL || st->mask == 0 || st->busy) {
+		return;
+	}
+	st->pc = pc;
+
+	if (st->mask & MY_HOOK_SAMPLE) {
+		int n = __atomic_exchange_n(&st->samples, 0, __ATOMIC_RELAXED);
+		if (n > 0) {
+			st->busy = TRUE;
+			go_hook_sample(mrb, pc, n);
+			st->busy = FALSE;
+		}
+		if ((st->mask & ~MY_HOOK_SAMPLE) == 0) {
+			return;
+		}
+	}
+
+	off = (uint32_t)(pc - irep->iseq);
+	file = mrb_debug_get_filename(irep, off);
+	line = mrb_debug_get_line(irep, off);
+
+	if ((st->mask & MY_HOOK_RAISE) && mrb->exc && mrb->exc != st->exc) {
+		// An exception raised by a C function, e.g. Kernel#raise,
+		// is seen when the VM runs the rescue or ensure clause
+		st->exc = mrb->exc;
+		my_hook_event(mrb, st, MY_HOOK_RAISE, file, line, 0, mrb_obj_class(mrb, mrb_obj_value(mrb->exc)));
+	}
+	if ((st->mask & MY_HOOK_IREP) && irep != st->irep) {
+		st->busy = TRUE;
+		go_hook_irep(mrb, irep);
+		st->busy = FALSE;
+	}
+	if ((st->mask & MY_HOOK_LINE) && line >= 0 && (irep != st->irep || line != st->line)) {
+		st->irep = irep;
+		st->line = line;
+		my_hook_event(mrb, st, MY_HOOK_LINE, file, line, mrb->c->ci->mid, my_ci_target_class(mrb));
+	}
+
+	i = *pc;
+	switch (GET_OPCODE(i)) {
+	case OP_SEND:
+	case OP_SENDB:
+		if (st->mask & MY_HOOK_CALL) {
+			my_hook_event(mrb, st, MY_HOOK_CALL, file, line, irep->syms[GETARG_B(i)], mrb_class(mrb, regs[GETARG_A(i)]));
+		}
+		break;
+	case OP_RETURN:
+		if (st->mask & MY_HOOK_RETURN) {
+			my_hook_event(mrb, st, MY_HOOK_RETURN, file, line, mrb->c->ci->mid, my_ci_target_class(mrb));
+		}
+		break;
+	case OP_RAISE:
+		if ((st->mask & MY_HOOK_RAISE) && mrb_obj_ptr(regs[GETARG_A(i)]) != st->exc) {
+			st->exc = mrb_obj_ptr(regs[GETARG_A(i)]);
+			my_hook_event(mrb, st, MY_HOOK_RAISE, file, line, 0, mrb_obj_class(mrb, regs[GETARG_A(i)]));
+		}
+		break;
+	}
+}
+
+// my_irep_walk_lines reports all lines of irep and its children that
+// have instructions to Go.
+static inline void my_irep_walk_lines(mrb_state *mrb, mrb_irep *irep) {
+	uint32_t pc;
+	int i;
+	int32_t line, last = -1;
+	const char *file;
+
+	for (pc = 0; pc < irep->ilen; pc++) {
+		line = mrb_debug_get_line(irep, pc);
+		if (line < 0 || line == last) {
+			continue;
+		}
+		file = mrb_debug_get_filename(irep, pc);
+		if (file != NULL) {
+			go_hook_line_found(mrb, (char *)file, line);
+		}
+		last = line;
+	}
+	for (i = 0; i < irep->rlen; i++) {
+		my_irep_walk_lines(mrb, irep->reps[i]);
+	}
+}
+
+// my_irep_lines returns the file and the range of lines of irep, without
+// its children. file is NULL if irep has no debug info.
+static inline void my_irep_lines(mrb_irep *irep, const char **file, int32_t *first, int32_t *last) {
+	uint32_t pc;
+	int32_t line;
+
+	*file = NULL;
+	*first = -1;
+	*last = -1;
+	for (pc = 0; pc < irep->ilen; pc++) {
+		line = mrb_debug_get_line(irep, pc);
+		if (line < 0) {
+			continue;
+		}
+		if (*file == NULL) {
+			*file = mrb_debug_get_filename(irep, pc);
+		}
+		if (*first < 0 || line < *first) {
+			*first = line;
+		}
+		if (line > *last) {
+			*last = line;
+		}
+	}
+}
+
+// my_hooks_set_mask installs the hook, if necessary, and sets the
+// events to report.
+static inline void my_hooks_set_mask(mrb_state *mrb, int mask) {
+	my_hook_state *st = my_hooks_state(mrb);
+
+	if (st == NULL) {
+		if (mask == 0) {
+			return;
+		}
+		st = my_hooks_state_new(mrb);
+		mrb->code_fetch_hook = my_code_fetch_hook;
+	}
+	st->mask = mask;
+	st->irep = NULL;
+	st->line = -1;
+}
+
+// my_hooks_tick requests a sample of the call stack at the next
+// instruction. It may be called from any thread.
+static inline void my_hooks_tick(mrb_state *mrb) {
+	my_hook_state *st = my_hooks_state(mrb);
+
+	if (st != NULL) {
+		__atomic_add_fetch(&st->samples, 1, __ATOMIC_RELAXED);
+	}
+}
+
+// my_hooks_reset_samples drops the samples requested by my_hooks_tick
+// while no script was running.
+static inline void my_hooks_reset_samples(mrb_state *mrb) {
+	my_hook_state *st = my_hooks_state(mrb);
+
+	if (st != NULL) {
+		__atomic_store_n(&st->samples, 0, __ATOMIC_RELAXED);
+	}
+}
+
+// my_stack_depth returns the number of frames on the call stack.
+static inline int my_stack_depth(mrb_state *mrb) {
+	return (int)(mrb->c->ci - mrb->c->cibase) + 1;
+}
+
+// my_stack_frame returns the method, class, file, and line of the frame
+// with index i on the call stack, with 0 being the outermost frame. pc0
+// is the instruction currently executed by the innermost frame. File and
+// line are only available for frames of Ruby methods and blocks.
+static inline mrb_bool my_stack_frame(mrb_state *mrb, int i, mrb_code *pc0, const char **file, int32_t *line, mrb_sym *mid, struct RClass **klass) {
+	int ciidx = (int)(mrb->c->ci - mrb->c->cibase);
+	mrb_callinfo *ci = &mrb->c->cibase[i];
+	mrb_irep *irep;
+	mrb_code *pc;
+
+	*file = NULL;
+	*line = -1;
+	*mid = ci->mid;
+	*klass = NULL;
+	if (ci->proc == NULL) {
+		return FALSE;
+	}
+	*klass = ci->proc->target_class;
+	if (MRB_PROC_CFUNC_P(ci->proc)) {
+		return TRUE;
+	}
+
+	irep = ci->proc->body.irep;
+	if (i < ciidx) {
+		if (mrb->c->cibase[i+1].pc == NULL) {
+			return TRUE;
+		}
+		pc = mrb->c->cibase[i+1].pc - 1;
+	} else {
+		pc = pc0;
+	}
+	if (pc < irep->iseq || pc >= irep->iseq + irep->ilen) {
+		return TRUE;
+	}
+	*file = mrb_debug_get_filename(irep, (uint32_t)(pc - irep->iseq));
+	*line = mrb_debug_get_line(irep, (uint32_t)(pc - irep->iseq));
+	return TRUE;
+}
+
+// my_hooks_abort makes the hook raise an exception after the current
+// event has been handled, which terminates the script unless rescued.
+static inline void my_hooks_abort(mrb_state *mrb) {
+	my_hook_state *st = my_hooks_state(mrb);
+
+	if (st != NULL) {
+		st->abort = TRUE;
+	}
+}
+
+// my_hooks_pc returns the instruction about to be executed.
+static inline mrb_code *my_hooks_pc(mrb_state *mrb) {
+	my_hook_state *st = my_hooks_state(mrb);
+
+	return st != NULL ? st->pc : NULL;
+}
+
+// my_local_count returns the number of local variables of the current
+// method or block, or 0 for C functions.
+static inline int my_local_count(mrb_state *mrb) {
+	struct RProc *proc = mrb->c->ci->proc;
+
+	if (proc == NULL || MRB_PROC_CFUNC_P(proc) || proc->body.irep->lv == NULL) {
+		return 0;
+	}
+	return proc->body.irep->nlocals - 1;
+}
+
+// my_local_get returns the name and value of the local variable with
+// index i of the current method or block.
+static inline mrb_bool my_local_get(mrb_state *mrb, int i, mrb_sym *name, mrb_value *value) {
+	mrb_irep *irep = mrb->c->ci->proc->body.irep;
+
+	if (irep->lv[i].name == 0) {
+		return FALSE;
+	}
+	*name = irep->lv[i].name;
+	*value = mrb->c->stack[irep->lv[i].r];
+	return TRUE;
+}
+
+// my_stack_self returns self of the current method or block.
+static inline mrb_value my_stack_self(mrb_state *mrb) {
+	return mrb->c->stack[0];
+}
+
+// my_hooks_take_raise returns TRUE if the pending exception has not been
+// reported yet, and marks it as reported.
+static inline mrb_bool my_hooks_take_raise(mrb_state *mrb) {
+	my_hook_state *st = my_hooks_state(mrb);
+
+	if (st == NULL || !(st->mask & MY_HOOK_RAISE) || st->busy || mrb->exc == NULL || mrb->exc == st->exc) {
+		return FALSE;
+	}
+	st->exc = mrb->exc;
+	return TRUE;
+}
+
+static inline void my_hooks_free(mrb_state *mrb) {
+	if (my_hooks_state(mrb) != NULL) {
+		mrb->code_fetch_hook = NULL;
+		my_hooks_state_free(mrb);
+	}
+}
+
+#else
+
+static inline int my_hooks_available() {
+	return FALSE;
+}
+
+static inline void my_hooks_set_mask(mrb_state *mrb, int mask) {
+}
+
+static inline mrb_bool my_hooks_take_raise(mrb_state *mrb) {
+	return FALSE;
+}
+
+static inline void my_hooks_free(mrb_state *mrb) {
+}
+
+static inline void my_irep_walk_lines(mrb_state *mrb, struct mrb_irep *irep) {
+}
+
+static inline void my_irep_lines(struct mrb_irep *irep, const char **file, int32_t *first, int32_t *last) {
+	*file = NULL;
+	*first = -1;
+	*last = -1;
+}
+
+static inline void my_hooks_tick(mrb_state *mrb) {
+}
+
+static inline void my_hooks_reset_samples(mrb_state *mrb) {
+}
+
+static inline int my_stack_depth(mrb_state *mrb) {
+	return 0;
+}
+
+static inline void my_hooks_abort(mrb_state *mrb) {
+}
+
+static inline mrb_code *my_hooks_pc(mrb_state *mrb) {
+	return NULL;
+}
+
+static inline int my_local_count(mrb_state *mrb) {
+	return 0;
+}
+
+static inline mrb_bool my_local_get(mrb_state *mrb, int i, mrb_sym *name, mrb_value *value) {
+	return FALSE;
+}
+
+static inline mrb_value my_stack_self(mrb_state *mrb) {
+	return mrb_nil_value();
+}
+
+static inline mrb_bool my_stack_frame(mrb_state *mrb, int i, mrb_code *pc0, const char **file, int32_t *line, mrb_sym *mid, struct RClass **klass) {
+	return FALSE;
+}
+
+#endif // MRB_ENABLE_DEBUG_HOOK
+
 #endif
@@ -11,6 +11,7 @@ package mruby
 import "C"
 
 import (
+	"errors"
 	"unsafe"
 )
 
@@ -24,50 +25,78 @@ type Parser struct {
 // Parse parses a string into parsed Ruby code. An error is
 // returned if compilation failes.
 func (ctx *Context) Parse(code string) (*Parser, error) {
-	p := &Parser{ctx: ctx}
+	ctx.enter()
+	defer ctx.leave()
 
-	ccode := C.CString(code)
-	defer C.free(unsafe.Pointer(ccode))
-
-	parser := C.my_parse(p.ctx.mrb, p.ctx.ctx, ccode)
-	defer C.mrb_parser_free(parser)
-
-	if parser.nerr > 0 {
-		line := int(parser.error_buffer[0].lineno)
-		msg := C.GoString(parser.error_buffer[0].message)
-		return nil, &ParseError{Line: line, Message: msg}
+	proc, err := compileWith(ctx.mrb, ctx.ctx, code, "")
+	if err != nil {
+		return nil, err
 	}
-
-	p.proc = C.mrb_generate_code(p.ctx.mrb, parser)
-	return p, nil
+	return &Parser{ctx: ctx, proc: proc}, nil
 }
 
 // Run runs a previously compiled Ruby code and returns its output.
 // An error is returned if the Ruby code raises an exception.
 func (p *Parser) Run(args ...interface{}) (Value, error) {
+	p.ctx.enter()
+	defer p.ctx.leave()
+
 	ai := C.mrb_gc_arena_save(p.ctx.mrb)
 	defer C.mrb_gc_arena_restore(p.ctx.mrb, ai)
 
-	// Create ARGV global variable and push the args into it
-	argvAry := C.mrb_ary_new_capa(p.ctx.mrb, C.mrb_int(len(args)))
-	for i := 0; i < len(args); i++ {
-		val, err := p.ctx.ToValue(args[i])
-		if err != nil {
-			return NilValue(p.ctx), err
-		}
-		C.mrb_ary_push(p.ctx.mrb, argvAry, val.v)
+	restoreArgv, err := p.ctx.setArgv(args)
+	if err != nil {
+		return NilValue(p.ctx), err
 	}
-	argv := C.CString("ARGV")
-	defer C.free(unsafe.Pointer(argv))
-	C.mrb_define_global_const(p.ctx.mrb, argv, argvAry)
+	defer restoreArgv()
 
 	// Run the code
-	result := C.my_run(p.ctx.mrb, p.proc)
+	result := C.my_run_protected_keep(p.ctx.mrb, p.proc, C.my_context_stack_keep(p.ctx.ctx))
 
 	// Check for exception
 	if C.has_exception(p.ctx.mrb) != 0 {
-		return NilValue(p.ctx), newRunError(p.ctx, true)
+		return NilValue(p.ctx), newScriptError(p.ctx)
 	}
 
 	return Value{ctx: p.ctx, v: result}, nil
 }
+
+// compile parses code and generates a proc for it in mrb, with filename
+// for error messages and debug info. A ParseError is returned if the
+// code has syntax errors. The proc is protected by the GC arena.
+func compile(mrb *C.mrb_state, code, filename string, noExec bool) (*C.struct_RProc, error) {
+	cfilename := C.CString(filename)
+	defer C.free(unsafe.Pointer(cfilename))
+
+	cnoExec := C.mrb_bool(0)
+	if noExec {
+		cnoExec = C.mrb_bool(1)
+	}
+	cxt := C.my_context_new(mrb, cfilename, C.mrb_bool(1), cnoExec)
+	defer C.mrbc_context_free(mrb, cxt)
+
+	return compileWith(mrb, cxt, code, filename)
+}
+
+// compileWith parses code like compile, but with the compiler context
+// cxt, e.g. the one of a Context that keeps top-level local variables.
+// filename is only used for the ParseError.
+func compileWith(mrb *C.mrb_state, cxt *C.struct_mrbc_context, code, filename string) (*C.struct_RProc, error) {
+	ccode := C.CString(code)
+	defer C.free(unsafe.Pointer(ccode))
+
+	parser := C.my_parse(mrb, cxt, ccode)
+	defer C.mrb_parser_free(parser)
+
+	if parser.nerr > 0 {
+		line := int(parser.error_buffer[0].lineno)
+		msg := C.GoString(parser.error_buffer[0].message)
+		return nil, &ParseError{Filename: filename, Line: line, Message: msg}
+	}
+
+	proc := C.mrb_generate_code(mrb, parser)
+	if proc == nil {
+		return nil, errors.New("cannot generate code")
+	}
+	return proc, nil
+}
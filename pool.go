@@ -0,0 +1,259 @@
+// Copyright 2013-2015 Oliver Eilhard.
+// Use of this source code is governed by the MIT LICENSE that
+// can be found in the MIT-LICENSE file included in the project.
+
+package mruby
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrPoolClosed is returned by Pool.Get after the pool has been closed.
+	ErrPoolClosed = errors.New("pool closed")
+)
+
+// Pool manages a set of prepared contexts. As a Context must not be used
+// by more than one goroutine at a time, a Pool is the way to run scripts
+// concurrently, e.g. one per HTTP request, without setting up a new
+// Context for each of them.
+//
+// Get returns an idle Context or creates a new one, running the setup
+// function once per Context. Put returns the Context to the pool after
+// use. Contexts that failed, i.e. where a script raised an exception, or
+// that don't pass the health check, are discarded in Put.
+//
+// A Pool is safe for concurrent use. Call Close when done with it.
+type Pool struct {
+	setup       func(*Context) error
+	options     []func(*Context)
+	maxSize     int
+	idleTimeout time.Duration
+	healthCheck func(*Context) error
+
+	sem  chan struct{} // limits the number of contexts, if maxSize > 0
+	stop chan struct{} // closed by Close to stop evicting idle contexts
+
+	mu     sync.Mutex // guards the next variables
+	idle   []pooledContext
+	closed bool
+}
+
+// pooledContext is an idle Context in a Pool.
+type pooledContext struct {
+	ctx   *Context
+	since time.Time
+}
+
+// NewPool creates a new pool of contexts. The setup function is called
+// for every new Context, e.g. to define modules and load libraries.
+// It may be nil. Use the options to configure the pool.
+//
+// Example:
+//
+//	pool := mruby.NewPool(setup, mruby.SetPoolMaxSize(32))
+func NewPool(setup func(*Context) error, options ...func(*Pool)) *Pool {
+	p := &Pool{
+		setup: setup,
+	}
+	for _, option := range options {
+		option(p)
+	}
+	if p.maxSize > 0 {
+		p.sem = make(chan struct{}, p.maxSize)
+	}
+	if p.idleTimeout > 0 {
+		p.stop = make(chan struct{})
+		go p.reap()
+	}
+	return p
+}
+
+// SetPoolMaxSize limits the number of contexts in the pool, both in use
+// and idle. Get blocks while all contexts are in use. The default of 0
+// doesn't limit the number of contexts.
+// It is used for configuring a Pool (see NewPool for details).
+func SetPoolMaxSize(n int) func(*Pool) {
+	return func(p *Pool) {
+		p.maxSize = n
+	}
+}
+
+// SetPoolIdleTimeout discards contexts that have been idle for longer
+// than d. Idle contexts are checked periodically, so that they are
+// closed even if the pool is not used anymore, until the pool is closed.
+// The default of 0 keeps idle contexts until the pool is closed.
+// It is used for configuring a Pool (see NewPool for details).
+func SetPoolIdleTimeout(d time.Duration) func(*Pool) {
+	return func(p *Pool) {
+		p.idleTimeout = d
+	}
+}
+
+// SetPoolContextOptions sets the options passed to NewContext when the
+// pool creates a new Context.
+// It is used for configuring a Pool (see NewPool for details).
+func SetPoolContextOptions(options ...func(*Context)) func(*Pool) {
+	return func(p *Pool) {
+		p.options = options
+	}
+}
+
+// SetPoolHealthCheck sets a function that is called in Put. If it returns
+// an error, the Context is discarded instead of being reused. Contexts
+// where a script raised an exception are always discarded.
+// It is used for configuring a Pool (see NewPool for details).
+func SetPoolHealthCheck(check func(*Context) error) func(*Pool) {
+	return func(p *Pool) {
+		p.healthCheck = check
+	}
+}
+
+// Get returns an idle Context from the pool, or creates a new one if no
+// Context is idle. If the pool has a maximum size, Get blocks until a
+// Context is available. The Context must be given back via Put or
+// Discard after use.
+func (p *Pool) Get() (*Context, error) {
+	return p.GetContext(context.Background())
+}
+
+// GetContext is like Get, but stops waiting for a Context when c is
+// done, e.g. when the request that needs the Context times out. It
+// returns the error of c in that case.
+func (p *Pool) GetContext(c context.Context) (*Context, error) {
+	if p.sem != nil {
+		select {
+		case p.sem <- struct{}{}:
+		case <-c.Done():
+			return nil, c.Err()
+		}
+	}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		p.release()
+		return nil, ErrPoolClosed
+	}
+	p.evictLocked(time.Now())
+	if n := len(p.idle); n > 0 {
+		ctx := p.idle[n-1].ctx
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return ctx, nil
+	}
+	p.mu.Unlock()
+
+	ctx, err := OpenContext(p.options...)
+	if err != nil {
+		p.release()
+		return nil, err
+	}
+	if p.setup != nil {
+		if err := p.setup(ctx); err != nil {
+			ctx.Close()
+			p.release()
+			return nil, err
+		}
+	}
+	ctx.failed = false
+	return ctx, nil
+}
+
+// Put returns a Context retrieved via Get to the pool. The Context is
+// discarded if it failed or does not pass the health check.
+func (p *Pool) Put(ctx *Context) {
+	if ctx.failed || ctx.mrb == nil {
+		p.Discard(ctx)
+		return
+	}
+	if p.healthCheck != nil {
+		if err := p.healthCheck(ctx); err != nil {
+			p.Discard(ctx)
+			return
+		}
+	}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		p.Discard(ctx)
+		return
+	}
+	now := time.Now()
+	p.idle = append(p.idle, pooledContext{ctx: ctx, since: now})
+	p.evictLocked(now)
+	p.mu.Unlock()
+	p.release()
+}
+
+// Discard closes a Context retrieved via Get instead of returning it
+// to the pool, e.g. after a script has been aborted.
+func (p *Pool) Discard(ctx *Context) {
+	ctx.Close()
+	p.release()
+}
+
+// Close closes all idle contexts. Contexts in use are closed when they
+// are given back via Put. Get returns ErrPoolClosed afterwards.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	if !p.closed && p.stop != nil {
+		close(p.stop)
+	}
+	p.closed = true
+	p.mu.Unlock()
+
+	for _, pc := range idle {
+		pc.ctx.Close()
+	}
+}
+
+// reap evicts idle contexts periodically until the pool is closed.
+func (p *Pool) reap() {
+	interval := p.idleTimeout / 2
+	if interval <= 0 {
+		interval = p.idleTimeout
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			p.mu.Lock()
+			p.evictLocked(now)
+			p.mu.Unlock()
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// evictLocked closes the contexts that have been idle for too long.
+// The caller must hold p.mu.
+func (p *Pool) evictLocked(now time.Time) {
+	if p.idleTimeout <= 0 {
+		return
+	}
+	// Idle contexts are ordered by the time they were put back
+	var i int
+	for i < len(p.idle) && now.Sub(p.idle[i].since) > p.idleTimeout {
+		p.idle[i].ctx.Close()
+		i++
+	}
+	if i > 0 {
+		p.idle = append(p.idle[:0], p.idle[i:]...)
+	}
+}
+
+// release frees a slot in the pool, if the pool has a maximum size.
+func (p *Pool) release() {
+	if p.sem != nil {
+		<-p.sem
+	}
+}
@@ -0,0 +1,359 @@
+// Copyright 2013-2015 Oliver Eilhard.
+// Use of this source code is governed by the MIT LICENSE that
+// can be found in the MIT-LICENSE file included in the project.
+
+package mruby
+
+import (
+	"context"
+	"errors"
+	"html"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPool(t *testing.T) {
+	var setups int32
+	setup := func(ctx *Context) error {
+		atomic.AddInt32(&setups, 1)
+		_, err := ctx.LoadString("def greet(name); \"Hello, #{name}\"; end")
+		return err
+	}
+	pool := NewPool(setup)
+	defer pool.Close()
+
+	for i := 0; i < 3; i++ {
+		ctx, err := pool.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ctx.LoadStringResult("greet(ARGV[0])", "Oliver")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != "Hello, Oliver" {
+			t.Errorf("expected %q; got: %v", "Hello, Oliver", got)
+		}
+		pool.Put(ctx)
+	}
+
+	if n := atomic.LoadInt32(&setups); n != 1 {
+		t.Errorf("expected setup to run %d time(s); got: %d", 1, n)
+	}
+}
+
+func TestPoolSetupError(t *testing.T) {
+	pool := NewPool(func(ctx *Context) error {
+		_, err := ctx.LoadString("raise 'kaboom'")
+		return err
+	}, SetPoolMaxSize(1))
+	defer pool.Close()
+
+	for i := 0; i < 2; i++ {
+		if _, err := pool.Get(); err == nil {
+			t.Fatal("expected error")
+		}
+	}
+}
+
+func TestPoolDiscardsFailedContexts(t *testing.T) {
+	pool := NewPool(nil)
+	defer pool.Close()
+
+	ctx, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ctx.LoadString("raise 'kaboom'"); err == nil {
+		t.Fatal("expected error")
+	}
+	pool.Put(ctx)
+
+	other, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Put(other)
+	if other == ctx {
+		t.Error("expected failed context to be discarded")
+	}
+}
+
+func TestPoolHealthCheck(t *testing.T) {
+	pool := NewPool(nil, SetPoolHealthCheck(func(ctx *Context) error {
+		ok, err := ctx.LoadStringResult("$healthy != false")
+		if err != nil {
+			return err
+		}
+		if ok != true {
+			return errors.New("unhealthy")
+		}
+		return nil
+	}))
+	defer pool.Close()
+
+	ctx, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.Put(ctx)
+
+	again, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != ctx {
+		t.Error("expected healthy context to be reused")
+	}
+	if _, err := again.LoadString("$healthy = false"); err != nil {
+		t.Fatal(err)
+	}
+	pool.Put(again)
+
+	other, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Put(other)
+	if other == ctx {
+		t.Error("expected unhealthy context to be discarded")
+	}
+}
+
+func TestPoolMaxSize(t *testing.T) {
+	pool := NewPool(nil, SetPoolMaxSize(1))
+	defer pool.Close()
+
+	ctx, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(chan *Context, 1)
+	go func() {
+		other, err := pool.Get()
+		if err != nil {
+			t.Error(err)
+		}
+		got <- other
+	}()
+
+	select {
+	case <-got:
+		t.Fatal("expected Get to block while the pool is exhausted")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	pool.Put(ctx)
+
+	select {
+	case other := <-got:
+		if other != ctx {
+			t.Error("expected context to be reused")
+		}
+		pool.Put(other)
+	case <-time.After(1 * time.Second):
+		t.Fatal("expected Get to return after Put")
+	}
+}
+
+func TestPoolIdleTimeout(t *testing.T) {
+	pool := NewPool(nil, SetPoolIdleTimeout(10*time.Millisecond))
+	defer pool.Close()
+
+	ctx, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.Put(ctx)
+
+	time.Sleep(50 * time.Millisecond)
+
+	other, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Put(other)
+	if other == ctx {
+		t.Error("expected idle context to be evicted")
+	}
+	if ctx.mrb != nil {
+		t.Error("expected evicted context to be closed")
+	}
+}
+
+func TestPoolEvictsIdleContextsWithoutUse(t *testing.T) {
+	pool := NewPool(nil, SetPoolIdleTimeout(10*time.Millisecond))
+	defer pool.Close()
+
+	ctx, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.Put(ctx)
+
+	deadline := time.Now().Add(1 * time.Second)
+	for {
+		pool.mu.Lock()
+		n := len(pool.idle)
+		pool.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected idle context to be evicted without calling Get or Put")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPoolGetContext(t *testing.T) {
+	pool := NewPool(nil, SetPoolMaxSize(1))
+	defer pool.Close()
+
+	ctx, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Put(ctx)
+
+	c, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	other, err := pool.GetContext(c)
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected %v; got: %v", context.DeadlineExceeded, err)
+	}
+	if other != nil {
+		t.Error("expected no context")
+	}
+}
+
+func TestPoolKeepsContextsAfterInternalErrors(t *testing.T) {
+	pool := NewPool(nil)
+	defer pool.Close()
+
+	ctx, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Converting the object to Go calls to_h, which raises
+	val, err := ctx.LoadString(`
+		class Broken
+		  def to_h; raise "kaboom"; end
+		end
+		Broken.new
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := val.ToInterface(); err == nil {
+		t.Fatal("expected error")
+	}
+	pool.Put(ctx)
+
+	other, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Put(other)
+	if other != ctx {
+		t.Error("expected context to be reused after an error of an internal method call")
+	}
+}
+
+func TestPoolClose(t *testing.T) {
+	pool := NewPool(nil)
+
+	ctx, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.Close()
+
+	if _, err := pool.Get(); err != ErrPoolClosed {
+		t.Errorf("expected ErrPoolClosed; got: %v", err)
+	}
+	pool.Put(ctx)
+	if ctx.mrb != nil {
+		t.Error("expected context to be closed when put back into a closed pool")
+	}
+}
+
+func TestPoolConcurrentUse(t *testing.T) {
+	pool := NewPool(func(ctx *Context) error {
+		_, err := ctx.LoadString("def double(x); x * 2; end")
+		return err
+	}, SetPoolMaxSize(4))
+	defer pool.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx, err := pool.Get()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer pool.Put(ctx)
+			got, err := ctx.LoadStringResult("double(ARGV[0])", i)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if got != 2*i {
+				t.Errorf("expected %d; got: %v", 2*i, got)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func BenchmarkPoolFunctionCallsInParallel(b *testing.B) {
+	// Same as BenchmarkFunctionCallsInParallel, but with a Pool
+	pool := NewPool(func(ctx *Context) error {
+		module, err := ctx.DefineModule("Helpers", nil)
+		if err != nil {
+			return err
+		}
+		module.DefineClassMethod("escape_html", func(ctx *Context) (Value, error) {
+			args, err := ctx.GetArgs()
+			if err != nil {
+				return NilValue(ctx), err
+			}
+			if len(args) == 1 {
+				s, err := args[0].ToString()
+				if err != nil {
+					return NilValue(ctx), err
+				}
+				return ctx.ToValue(html.EscapeString(s))
+			}
+			return NilValue(ctx), nil
+		})
+		return nil
+	})
+	defer pool.Close()
+
+	input := "<test&go>"
+	expected := html.EscapeString(input)
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			ctx, err := pool.Get()
+			if err != nil {
+				b.Fatal(err)
+			}
+			got, err := ctx.LoadStringResult("Helpers.escape_html(ARGV[0])", input)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if expected != got {
+				b.Fatalf("expected %q; got: %q", expected, got)
+			}
+			pool.Put(ctx)
+		}
+	})
+}
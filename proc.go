@@ -0,0 +1,23 @@
+// Copyright 2013-2015 Oliver Eilhard.
+// Use of this source code is governed by the MIT LICENSE that
+// can be found in the MIT-LICENSE file included in the project.
+
+package mruby
+
+// Proc is a Ruby Proc, e.g. a block or lambda returned from a script,
+// that can be called from Go.
+type Proc struct {
+	v Value
+}
+
+// Value returns the underlying Ruby value of the Proc.
+func (p *Proc) Value() Value {
+	return p.v
+}
+
+// Call invokes the Proc with the given arguments and returns its result.
+// The arguments are converted to Ruby with Context.ToValue.
+// An error is returned if the Proc raises an exception.
+func (p *Proc) Call(args ...interface{}) (Value, error) {
+	return p.v.Call("call", args...)
+}
@@ -0,0 +1,45 @@
+// Copyright 2013-2015 Oliver Eilhard.
+// Use of this source code is governed by the MIT LICENSE that
+// can be found in the MIT-LICENSE file included in the project.
+
+package mruby
+
+import (
+	"testing"
+)
+
+func TestProcValue(t *testing.T) {
+	ctx := NewContext()
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	val, err := ctx.LoadString("lambda { |x, y| x * y }")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := val.ToInterface()
+	if err != nil {
+		t.Fatal(err)
+	}
+	proc, ok := got.(*Proc)
+	if !ok {
+		t.Fatalf("expected *Proc; got: %T", got)
+	}
+	res, err := proc.Call(6, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := res.ToInt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != 42 {
+		t.Errorf("expected %d; got: %d", 42, i)
+	}
+
+	_, err = proc.Call(1)
+	if err == nil {
+		t.Fatal("expected error for wrong number of arguments")
+	}
+}
@@ -0,0 +1,343 @@
+// Copyright 2013-2015 Oliver Eilhard.
+// Use of this source code is governed by the MIT LICENSE that
+// can be found in the MIT-LICENSE file included in the project.
+
+package mruby
+
+/*
+#cgo pkg-config: mruby
+#include "mruby_go.h"
+*/
+import "C"
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// profileInterval is the time between two samples of the call stack.
+const profileInterval = 10 * time.Millisecond
+
+// profiler samples the call stack of a context, see StartProfile.
+type profiler struct {
+	start   time.Time
+	stop    chan struct{}
+	stopped chan struct{}
+	samples map[string]*profileSample // by stack
+}
+
+// profileSample is a call stack and the number of times it was seen.
+type profileSample struct {
+	stack []stackFrame // innermost frame first
+	count int64
+}
+
+// stackFrame is a frame on the call stack of a context.
+type stackFrame struct {
+	Function string // e.g. "Greeter#greet" or "Helpers.escape"
+	Filename string // Name of the file, if available
+	Line     int    // Line, if available
+}
+
+// StartProfile starts sampling the call stack of the scripts running
+// in the context, 100 times per second. Samples are taken when the VM
+// executes an instruction, so time spent in Go or C functions is
+// attributed to the line calling them. The profile records wall time
+// while scripts run; time between scripts is not sampled. Call
+// StopProfile to stop sampling and write the profile.
+//
+// ErrHooksUnavailable is returned if mruby-go has been built without
+// the mruby_debug_hook tag.
+func (ctx *Context) StartProfile() error {
+	ctx.enter()
+	defer ctx.leave()
+
+	if C.my_hooks_available() == 0 {
+		return ErrHooksUnavailable
+	}
+	if ctx.profiler != nil {
+		return errors.New("profile already started")
+	}
+
+	p := &profiler{
+		start:   time.Now(),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		samples: make(map[string]*profileSample),
+	}
+	ctx.profiler = p
+	ctx.updateHooks()
+
+	mrb := ctx.mrb
+	go func() {
+		defer close(p.stopped)
+		ticker := time.NewTicker(profileInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				C.my_hooks_tick(mrb)
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// StopProfile stops sampling started with StartProfile, and writes the
+// profile to w. The profile is written in the format of pprof, so it
+// can be analyzed with "go tool pprof".
+func (ctx *Context) StopProfile(w io.Writer) error {
+	ctx.enter()
+	defer ctx.leave()
+
+	p := ctx.profiler
+	if p == nil {
+		return errors.New("profile not started")
+	}
+	close(p.stop)
+	<-p.stopped
+	ctx.profiler = nil
+	ctx.updateHooks()
+
+	return p.write(w, time.Since(p.start))
+}
+
+// enter is called when the context starts running Ruby code. As the
+// ticker requests samples whether or not a script is running, the
+// requests made while the VM was idle are dropped at the start of
+// each top-level script.
+func (p *profiler) enter(ctx *Context) {
+	if C.my_vm_running(ctx.mrb) == C.mrb_bool(0) {
+		C.my_hooks_reset_samples(ctx.mrb)
+	}
+}
+
+//export go_hook_sample
+func go_hook_sample(mrb *C.mrb_state, pc *C.mrb_code, n C.int) {
+	ctx, found := hookContext(mrb)
+	if !found || ctx.profiler == nil {
+		return
+	}
+
+	stack := ctx.callStack(pc)
+	key := make([]string, len(stack))
+	for i, frame := range stack {
+		key[i] = frame.Function + "\x00" + frame.Filename + "\x00" + strconv.Itoa(frame.Line)
+	}
+	k := strings.Join(key, "\x01")
+	sample, found := ctx.profiler.samples[k]
+	if !found {
+		sample = &profileSample{stack: stack}
+		ctx.profiler.samples[k] = sample
+	}
+	sample.count += int64(n)
+}
+
+// callStack returns the frames on the call stack of the context, with
+// the innermost frame first. pc is the instruction currently executed.
+func (ctx *Context) callStack(pc *C.mrb_code) []stackFrame {
+	depth := int(C.my_stack_depth(ctx.mrb))
+	stack := make([]stackFrame, 0, depth)
+	for i := depth - 1; i >= 0; i-- {
+		var file *C.char
+		var line C.int32_t
+		var mid C.mrb_sym
+		var class *C.struct_RClass
+		if C.my_stack_frame(ctx.mrb, C.int(i), pc, &file, &line, &mid, &class) == C.mrb_bool(0) {
+			continue
+		}
+		frame := stackFrame{
+			Function: ctx.functionName(mid, class),
+			Line:     int(line),
+		}
+		if file != nil {
+			frame.Filename = C.GoString(file)
+		}
+		if frame.Line < 0 {
+			frame.Line = 0
+		}
+		stack = append(stack, frame)
+	}
+	return stack
+}
+
+// functionName returns the name of a method for display, e.g.
+// "Greeter#greet" for instance methods, "Helpers.escape" for class
+// methods, and "<main>" for top-level code.
+func (ctx *Context) functionName(mid C.mrb_sym, class *C.struct_RClass) string {
+	if mid == 0 {
+		return "<main>"
+	}
+	method := C.GoString(C.mrb_sym2name(ctx.mrb, mid))
+	if class == nil {
+		return method
+	}
+	var singleton C.mrb_bool
+	name := C.GoString(C.my_class_display_name(ctx.mrb, class, &singleton))
+	if singleton != C.mrb_bool(0) {
+		return name + "." + method
+	}
+	return name + "#" + method
+}
+
+// write writes the profile in the pprof format, i.e. a gzipped protocol
+// buffer as defined in github.com/google/pprof/proto/profile.proto.
+func (p *profiler) write(w io.Writer, duration time.Duration) error {
+	var strs []string
+	strIndex := make(map[string]int64)
+	str := func(s string) int64 {
+		if i, found := strIndex[s]; found {
+			return i
+		}
+		strIndex[s] = int64(len(strs))
+		strs = append(strs, s)
+		return int64(len(strs) - 1)
+	}
+	str("")
+
+	var prof protoBuffer
+	valueType := func(typ, unit string) []byte {
+		var b protoBuffer
+		b.int64Field(1, str(typ))
+		b.int64Field(2, str(unit))
+		return b.Bytes()
+	}
+	prof.messageField(1, valueType("samples", "count"))
+	prof.messageField(1, valueType("wall", "nanoseconds"))
+
+	type functionKey struct{ name, filename string }
+	type locationKey struct {
+		function uint64
+		line     int
+	}
+	functions := make(map[functionKey]uint64)
+	locations := make(map[locationKey]uint64)
+	var functionMsgs, locationMsgs [][]byte
+
+	for _, sample := range p.samples {
+		ids := make([]uint64, 0, len(sample.stack))
+		for _, frame := range sample.stack {
+			fk := functionKey{frame.Function, frame.Filename}
+			fid, found := functions[fk]
+			if !found {
+				fid = uint64(len(functions) + 1)
+				functions[fk] = fid
+				var b protoBuffer
+				b.uint64Field(1, fid)
+				b.int64Field(2, str(frame.Function))
+				b.int64Field(3, str(frame.Function))
+				b.int64Field(4, str(frame.Filename))
+				functionMsgs = append(functionMsgs, b.Bytes())
+			}
+			lk := locationKey{fid, frame.Line}
+			lid, found := locations[lk]
+			if !found {
+				lid = uint64(len(locations) + 1)
+				locations[lk] = lid
+				var line protoBuffer
+				line.uint64Field(1, fid)
+				line.int64Field(2, int64(frame.Line))
+				var b protoBuffer
+				b.uint64Field(1, lid)
+				b.messageField(4, line.Bytes())
+				locationMsgs = append(locationMsgs, b.Bytes())
+			}
+			ids = append(ids, lid)
+		}
+
+		var b protoBuffer
+		b.packedUint64Field(1, ids)
+		b.packedInt64Field(2, []int64{sample.count, sample.count * int64(profileInterval)})
+		prof.messageField(2, b.Bytes())
+	}
+	for _, msg := range locationMsgs {
+		prof.messageField(4, msg)
+	}
+	for _, msg := range functionMsgs {
+		prof.messageField(5, msg)
+	}
+	prof.int64Field(9, p.start.UnixNano())
+	prof.int64Field(10, int64(duration))
+	prof.messageField(11, valueType("wall", "nanoseconds"))
+	prof.int64Field(12, int64(profileInterval))
+	// The string table must be written last, as the fields above add to it
+	for _, s := range strs {
+		prof.stringField(6, s)
+	}
+
+	zw := gzip.NewWriter(w)
+	if _, err := zw.Write(prof.Bytes()); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// protoBuffer encodes protocol buffer messages.
+type protoBuffer struct {
+	bytes.Buffer
+}
+
+func (b *protoBuffer) varint(x uint64) {
+	for x >= 0x80 {
+		b.WriteByte(byte(x) | 0x80)
+		x >>= 7
+	}
+	b.WriteByte(byte(x))
+}
+
+func (b *protoBuffer) key(field, wireType int) {
+	b.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+func (b *protoBuffer) uint64Field(field int, x uint64) {
+	if x == 0 {
+		return
+	}
+	b.key(field, 0)
+	b.varint(x)
+}
+
+func (b *protoBuffer) int64Field(field int, x int64) {
+	if x == 0 {
+		return
+	}
+	b.key(field, 0)
+	b.varint(uint64(x))
+}
+
+func (b *protoBuffer) stringField(field int, s string) {
+	// Strings are written even if empty, as the string table relies on
+	// the position of each entry
+	b.key(field, 2)
+	b.varint(uint64(len(s)))
+	b.WriteString(s)
+}
+
+func (b *protoBuffer) messageField(field int, msg []byte) {
+	b.key(field, 2)
+	b.varint(uint64(len(msg)))
+	b.Write(msg)
+}
+
+func (b *protoBuffer) packedUint64Field(field int, xs []uint64) {
+	var p protoBuffer
+	for _, x := range xs {
+		p.varint(x)
+	}
+	b.messageField(field, p.Bytes())
+}
+
+func (b *protoBuffer) packedInt64Field(field int, xs []int64) {
+	var p protoBuffer
+	for _, x := range xs {
+		p.varint(uint64(x))
+	}
+	b.messageField(field, p.Bytes())
+}
@@ -0,0 +1,325 @@
+// Copyright 2013-2015 Oliver Eilhard.
+// Use of this source code is governed by the MIT LICENSE that
+// can be found in the MIT-LICENSE file included in the project.
+
+package mruby
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProfile(t *testing.T) {
+	ctx := newHookContext(t)
+
+	if err := ctx.StartProfile(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.StartProfile(); err == nil {
+		t.Error("expected error when starting a profile twice")
+	}
+
+	code := strings.Join([]string{
+		"class Worker",
+		"  def busy",
+		"    i = 0",
+		"    while i < 10_000_000",
+		"      i += 1",
+		"    end",
+		"  end",
+		"end",
+		"Worker.new.busy",
+	}, "\n")
+	if _, err := ctx.LoadReader("worker.rb", strings.NewReader(code)); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := ctx.StopProfile(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.StopProfile(&buf); err == nil {
+		t.Error("expected error when stopping a profile that is not running")
+	}
+
+	prof, err := parseTestProfile(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prof.sampleTypes) != 2 || prof.sampleTypes[1] != "wall/nanoseconds" {
+		t.Errorf("expected sample types samples/count and wall/nanoseconds; got: %v", prof.sampleTypes)
+	}
+	if len(prof.samples) == 0 {
+		t.Fatal("expected samples")
+	}
+
+	// The loop must show up in Worker#busy, called from the top level
+	var busy int64
+	for _, sample := range prof.samples {
+		if len(sample.stack) < 2 {
+			continue
+		}
+		inner, outer := sample.stack[0], sample.stack[len(sample.stack)-1]
+		if inner.Function == "Worker#busy" && inner.Filename == "worker.rb" &&
+			inner.Line >= 3 && inner.Line <= 6 &&
+			outer.Function == "<main>" && outer.Line == 9 {
+			busy += sample.count
+		}
+	}
+	if busy == 0 {
+		t.Errorf("expected samples in %q at worker.rb:3-6 called from %q at line %d; got: %v", "Worker#busy", "<main>", 9, prof.samples)
+	}
+}
+
+func TestProfileIgnoresTimeBetweenScripts(t *testing.T) {
+	ctx := newHookContext(t)
+
+	if err := ctx.StartProfile(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ctx.LoadReader("first.rb", strings.NewReader("1 + 2")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if _, err := ctx.LoadReader("second.rb", strings.NewReader("3 + 4")); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := ctx.StopProfile(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	prof, err := parseTestProfile(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int64
+	for _, sample := range prof.samples {
+		count += sample.count
+	}
+	// 500ms would be 50 samples
+	if count > 10 {
+		t.Errorf("expected idle time not to be sampled; got %d samples: %v", count, prof.samples)
+	}
+}
+
+// testProfile is the part of a pprof profile checked by the tests.
+type testProfile struct {
+	sampleTypes []string // "type/unit"
+	samples     []profileSample
+}
+
+// parseTestProfile decodes a gzipped pprof profile as written by
+// StopProfile. It only decodes the fields written by the package.
+func parseTestProfile(r io.Reader) (*testProfile, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+
+	type function struct{ name, filename int64 }
+	type location struct{ function, line int64 }
+	var (
+		strs        []string
+		sampleTypes [][2]int64
+		samples     []struct{ ids, values []int64 }
+		functions   = make(map[int64]function)
+		locations   = make(map[int64]location)
+	)
+	err = decodeTestProto(data, func(field int, v int64, b []byte) error {
+		switch field {
+		case 1: // sample_type
+			var st [2]int64
+			err := decodeTestProto(b, func(field int, v int64, _ []byte) error {
+				if field == 1 || field == 2 {
+					st[field-1] = v
+				}
+				return nil
+			})
+			sampleTypes = append(sampleTypes, st)
+			return err
+		case 2: // sample
+			var s struct{ ids, values []int64 }
+			err := decodeTestProto(b, func(field int, _ int64, b []byte) error {
+				xs, err := decodeTestPacked(b)
+				switch field {
+				case 1:
+					s.ids = xs
+				case 2:
+					s.values = xs
+				}
+				return err
+			})
+			samples = append(samples, s)
+			return err
+		case 4: // location
+			var id int64
+			var loc location
+			err := decodeTestProto(b, func(field int, v int64, b []byte) error {
+				switch field {
+				case 1:
+					id = v
+				case 4:
+					return decodeTestProto(b, func(field int, v int64, _ []byte) error {
+						switch field {
+						case 1:
+							loc.function = v
+						case 2:
+							loc.line = v
+						}
+						return nil
+					})
+				}
+				return nil
+			})
+			locations[id] = loc
+			return err
+		case 5: // function
+			var id int64
+			var fn function
+			err := decodeTestProto(b, func(field int, v int64, _ []byte) error {
+				switch field {
+				case 1:
+					id = v
+				case 2:
+					fn.name = v
+				case 4:
+					fn.filename = v
+				}
+				return nil
+			})
+			functions[id] = fn
+			return err
+		case 6: // string_table
+			strs = append(strs, string(b))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	str := func(i int64) (string, error) {
+		if i < 0 || i >= int64(len(strs)) {
+			return "", errors.New("invalid string index")
+		}
+		return strs[i], nil
+	}
+	prof := &testProfile{}
+	for _, st := range sampleTypes {
+		typ, err := str(st[0])
+		if err != nil {
+			return nil, err
+		}
+		unit, err := str(st[1])
+		if err != nil {
+			return nil, err
+		}
+		prof.sampleTypes = append(prof.sampleTypes, typ+"/"+unit)
+	}
+	for _, s := range samples {
+		if len(s.values) != len(sampleTypes) {
+			return nil, errors.New("number of values does not match the sample types")
+		}
+		sample := profileSample{count: s.values[0]}
+		for _, id := range s.ids {
+			loc, found := locations[id]
+			if !found {
+				return nil, errors.New("unknown location")
+			}
+			fn, found := functions[loc.function]
+			if !found {
+				return nil, errors.New("unknown function")
+			}
+			name, err := str(fn.name)
+			if err != nil {
+				return nil, err
+			}
+			filename, err := str(fn.filename)
+			if err != nil {
+				return nil, err
+			}
+			sample.stack = append(sample.stack, stackFrame{Function: name, Filename: filename, Line: int(loc.line)})
+		}
+		prof.samples = append(prof.samples, sample)
+	}
+	return prof, nil
+}
+
+// decodeTestProto calls f for each field of the protocol buffer message
+// in data, with the value of varint fields or the bytes of
+// length-delimited fields.
+func decodeTestProto(data []byte, f func(field int, v int64, b []byte) error) error {
+	for len(data) > 0 {
+		key, n := decodeTestVarint(data)
+		if n == 0 {
+			return errors.New("invalid key")
+		}
+		data = data[n:]
+		field := int(key >> 3)
+		switch key & 7 {
+		case 0:
+			v, n := decodeTestVarint(data)
+			if n == 0 {
+				return errors.New("invalid varint")
+			}
+			data = data[n:]
+			if err := f(field, int64(v), nil); err != nil {
+				return err
+			}
+		case 2:
+			l, n := decodeTestVarint(data)
+			if n == 0 || uint64(len(data)-n) < l {
+				return errors.New("invalid length")
+			}
+			b := data[n : n+int(l)]
+			data = data[n+int(l):]
+			if err := f(field, 0, b); err != nil {
+				return err
+			}
+		default:
+			return errors.New("unexpected wire type")
+		}
+	}
+	return nil
+}
+
+// decodeTestPacked decodes a packed repeated varint field.
+func decodeTestPacked(data []byte) ([]int64, error) {
+	var xs []int64
+	for len(data) > 0 {
+		x, n := decodeTestVarint(data)
+		if n == 0 {
+			return nil, errors.New("invalid varint")
+		}
+		xs = append(xs, int64(x))
+		data = data[n:]
+	}
+	return xs, nil
+}
+
+// decodeTestVarint decodes a varint and returns it with the number of
+// bytes read, or 0 if data is invalid.
+func decodeTestVarint(data []byte) (uint64, int) {
+	var x uint64
+	for i, b := range data {
+		if i == 10 {
+			return 0, 0
+		}
+		x |= uint64(b&0x7f) << (7 * uint(i))
+		if b < 0x80 {
+			return x, i + 1
+		}
+	}
+	return 0, 0
+}
@@ -0,0 +1,132 @@
+// Copyright 2013-2015 Oliver Eilhard.
+// Use of this source code is governed by the MIT LICENSE that
+// can be found in the MIT-LICENSE file included in the project.
+
+package mruby
+
+/*
+#cgo pkg-config: mruby
+#include "mruby_go.h"
+*/
+import "C"
+
+import (
+	"errors"
+	"unsafe"
+)
+
+// Program is compiled Ruby code that is not tied to a Context.
+// Other than a Parser, a Program can be compiled once and then run in
+// any number of contexts, e.g. in all contexts of a pool.
+// A Program is immutable and safe for concurrent use.
+type Program struct {
+	filename string
+	bytecode []byte
+}
+
+// Compile compiles Ruby code into a Program. The filename is used in
+// error messages, backtraces, and __FILE__. A *ParseError is returned
+// if the code cannot be compiled.
+func Compile(code, filename string) (*Program, error) {
+	mrb := C.my_open_core()
+	if mrb == nil {
+		return nil, errors.New("cannot create mruby state")
+	}
+	defer C.mrb_close(mrb)
+
+	proc, err := compile(mrb, code, filename, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var bin *C.uint8_t
+	var size C.size_t
+	if C.my_dump_irep(mrb, proc, &bin, &size) != C.my_dump_ok() {
+		return nil, errors.New("cannot dump bytecode")
+	}
+	defer C.mrb_free(mrb, unsafe.Pointer(bin))
+
+	return &Program{
+		filename: filename,
+		bytecode: C.GoBytes(unsafe.Pointer(bin), C.int(size)),
+	}, nil
+}
+
+// NewProgram creates a Program from mruby bytecode, e.g. as returned by
+// Program.Bytecode or Parser.Bytecode. An error wrapping
+// ErrInvalidBytecode is returned if the header of the bytecode is invalid.
+func NewProgram(bytecode []byte) (*Program, error) {
+	if err := checkBytecode(bytecode); err != nil {
+		return nil, err
+	}
+	bin := make([]byte, len(bytecode))
+	copy(bin, bytecode)
+	return &Program{bytecode: bin}, nil
+}
+
+// Filename returns the filename given to Compile. It is empty for
+// programs created with NewProgram.
+func (p *Program) Filename() string {
+	return p.filename
+}
+
+// Bytecode returns the program as mruby bytecode (RITE binary).
+func (p *Program) Bytecode() []byte {
+	bin := make([]byte, len(p.bytecode))
+	copy(bin, p.bytecode)
+	return bin
+}
+
+// Run runs the program in the context and returns its output.
+// The instructions are loaded into the context only the first time a
+// program is run; subsequent runs reuse them until Forget is called.
+//
+// If the context has been configured with SetNoExec, the program is
+// not run and a Proc is returned instead.
+func (ctx *Context) Run(prog *Program, args ...interface{}) (Value, error) {
+	if ctx.isRecording() {
+		return ctx.recordLoad(setupStep{prog: prog, args: args}, func() (Value, error) {
+			return ctx.Run(prog, args...)
+		})
+	}
+
+	ctx.enter()
+	defer ctx.leave()
+
+	ai := C.mrb_gc_arena_save(ctx.mrb)
+	defer C.mrb_gc_arena_restore(ctx.mrb, ai)
+
+	proc, found := ctx.programs[prog]
+	if !found {
+		cbin := C.CBytes(prog.bytecode)
+		defer C.free(cbin)
+
+		proc = C.my_read_irep(ctx.mrb, (*C.uint8_t)(cbin))
+		if proc == nil {
+			return NilValue(ctx), errors.New("cannot load program")
+		}
+		// Keep the instructions alive for as long as the context lives
+		C.mrb_gc_register(ctx.mrb, C.my_proc_value(proc))
+		if ctx.programs == nil {
+			ctx.programs = make(map[*Program]*C.struct_RProc)
+		}
+		ctx.programs[prog] = proc
+	}
+	return ctx.runProc(proc, args)
+}
+
+// Forget releases the instructions of the program loaded into the
+// context by Run. Call it for programs that are not run again, e.g.
+// when a long-lived context runs many different programs. The program
+// is loaded again if it is run afterwards.
+func (ctx *Context) Forget(prog *Program) {
+	ctx.enter()
+	defer ctx.leave()
+
+	proc, found := ctx.programs[prog]
+	if !found {
+		return
+	}
+	delete(ctx.programs, prog)
+	C.mrb_gc_unregister(ctx.mrb, C.my_proc_value(proc))
+}
@@ -0,0 +1,160 @@
+// Copyright 2013-2015 Oliver Eilhard.
+// Use of this source code is governed by the MIT LICENSE that
+// can be found in the MIT-LICENSE file included in the project.
+
+package mruby
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestProgram(t *testing.T) {
+	prog, err := Compile("$runs = ($runs || 0) + 1\n[__FILE__, ARGV[0], $runs]", "count.rb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prog.Filename() != "count.rb" {
+		t.Errorf("expected filename %q; got: %q", "count.rb", prog.Filename())
+	}
+
+	for i := 0; i < 3; i++ {
+		ctx := NewContext()
+		if ctx == nil {
+			t.Fatal("expected NewContext() to be != nil")
+		}
+		for run := 1; run <= 2; run++ {
+			val, err := ctx.Run(prog, "arg")
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := val.ToArray()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(res) != 3 {
+				t.Fatalf("expected %d elements; got: %v", 3, res)
+			}
+			if res[0] != "count.rb" {
+				t.Errorf("expected __FILE__ %q; got: %v", "count.rb", res[0])
+			}
+			if res[1] != "arg" {
+				t.Errorf("expected ARGV[0] %q; got: %v", "arg", res[1])
+			}
+			if res[2] != run {
+				t.Errorf("expected run %d; got: %v", run, res[2])
+			}
+		}
+	}
+}
+
+func TestProgramRunError(t *testing.T) {
+	prog, err := Compile("\nraise ArgumentError, 'kaboom'", "raise.rb")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := NewContext()
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+	_, err = ctx.Run(prog)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	runErr, ok := err.(*RunError)
+	if !ok {
+		t.Fatalf("expected RunError; got: %T", err)
+	}
+	if runErr.Filename != "raise.rb" || runErr.Line != 2 {
+		t.Errorf("expected error in %s:%d; got: %s:%d", "raise.rb", 2, runErr.Filename, runErr.Line)
+	}
+}
+
+func TestCompileError(t *testing.T) {
+	_, err := Compile("1 +\n.fail here!", "broken.rb")
+	if err == nil {
+		t.Fatal("expected parse error")
+	}
+	parseErr, ok := err.(*ParseError)
+	if !ok {
+		t.Fatalf("expected ParseError; got: %T", err)
+	}
+	if parseErr.Filename != "broken.rb" {
+		t.Errorf("expected filename %q; got: %q", "broken.rb", parseErr.Filename)
+	}
+}
+
+func TestNewProgram(t *testing.T) {
+	prog, err := Compile("6 * 7", "answer.rb")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := NewProgram(prog.Bytecode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := NewContext()
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+	val, err := ctx.Run(loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := val.ToInt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != 42 {
+		t.Errorf("expected %d; got: %d", 42, i)
+	}
+
+	if _, err := NewProgram([]byte("not bytecode")); !errors.Is(err, ErrInvalidBytecode) {
+		t.Errorf("expected ErrInvalidBytecode; got: %v", err)
+	}
+}
+
+func TestForgetProgram(t *testing.T) {
+	ctx := NewContext()
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	progs := make([]*Program, 10)
+	for i := range progs {
+		prog, err := Compile(fmt.Sprintf("%d * 2", i), "double.rb")
+		if err != nil {
+			t.Fatal(err)
+		}
+		progs[i] = prog
+		if _, err := ctx.Run(prog); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(ctx.programs); n != len(progs) {
+		t.Fatalf("expected %d loaded programs; got: %d", len(progs), n)
+	}
+
+	for _, prog := range progs[1:] {
+		ctx.Forget(prog)
+	}
+	ctx.Forget(progs[1]) // no-op
+	if n := len(ctx.programs); n != 1 {
+		t.Fatalf("expected %d loaded program; got: %d", 1, n)
+	}
+	ctx.GC()
+
+	// Forgotten programs are loaded again when run
+	for i, prog := range progs {
+		val, err := ctx.Run(prog)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := val.ToInt(); err != nil || got != i*2 {
+			t.Errorf("expected %d; got: %d (err=%v)", i*2, got, err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2013-2015 Oliver Eilhard.
+// Use of this source code is governed by the MIT LICENSE that
+// can be found in the MIT-LICENSE file included in the project.
+
+package mruby
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// Range is the Go representation of a Ruby Range, e.g. 1..10 or 1...10.
+type Range struct {
+	Begin     interface{} // First element of the range
+	End       interface{} // Last element of the range
+	Exclusive bool        // true if End is excluded from the range (...)
+}
+
+// String returns a representation of the range in Ruby syntax.
+func (r Range) String() string {
+	if r.Exclusive {
+		return fmt.Sprintf("%v...%v", r.Begin, r.End)
+	}
+	return fmt.Sprintf("%v..%v", r.Begin, r.End)
+}
+
+// mrbRangeToRange takes the value (which has to be a Ruby Range) and
+// returns it as a Range.
+func (v Value) mrbRangeToRange(seen map[unsafe.Pointer]bool) (Range, error) {
+	var r Range
+
+	seen, leave, err := v.visit(seen)
+	if err != nil {
+		return r, err
+	}
+	defer leave()
+
+	beg, err := v.funcall("begin")
+	if err != nil {
+		return r, err
+	}
+	if r.Begin, err = beg.toInterface(seen); err != nil {
+		return r, err
+	}
+
+	end, err := v.funcall("end")
+	if err != nil {
+		return r, err
+	}
+	if r.End, err = end.toInterface(seen); err != nil {
+		return r, err
+	}
+
+	excl, err := v.funcall("exclude_end?")
+	if err != nil {
+		return r, err
+	}
+	if r.Exclusive, err = excl.ToBool(); err != nil {
+		return r, err
+	}
+	return r, nil
+}
@@ -0,0 +1,43 @@
+// Copyright 2013-2015 Oliver Eilhard.
+// Use of this source code is governed by the MIT LICENSE that
+// can be found in the MIT-LICENSE file included in the project.
+
+package mruby
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRangeType(t *testing.T) {
+	ctx := NewContext()
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	tests := []struct {
+		Input    string
+		Expected Range
+	}{
+		{`1..10`, Range{Begin: 1, End: 10, Exclusive: false}},
+		{`1...10`, Range{Begin: 1, End: 10, Exclusive: true}},
+		{`'a'..'z'`, Range{Begin: "a", End: "z", Exclusive: false}},
+	}
+
+	for _, test := range tests {
+		val, err := ctx.LoadString(test.Input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !val.IsRange() {
+			t.Errorf("expected type Range; got: %v", val.Type())
+		}
+		got, err := val.ToInterface()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, test.Expected) {
+			t.Errorf("expected %v; got: %v", test.Expected, got)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright 2013-2015 Oliver Eilhard.
+// Use of this source code is governed by the MIT LICENSE that
+// can be found in the MIT-LICENSE file included in the project.
+
+// Package repl implements an interactive Ruby shell, similar to irb,
+// for a mruby Context. To debug Go bindings, create the Context in your
+// own program, define your modules in it, and pass it to New.
+package repl
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	mruby "github.com/olivere/mruby-go"
+)
+
+// REPL reads Ruby code line by line, evaluates it in a Context, and
+// prints the results. Input that is not a complete expression yet,
+// e.g. the first line of a method definition, is continued on the
+// next line.
+type REPL struct {
+	ctx          *mruby.Context
+	prompt       string
+	continuation string
+	historyFile  string
+	history      []string
+}
+
+// New creates a new REPL that evaluates code in ctx.
+// Use the options to handle configuration.
+func New(ctx *mruby.Context, options ...func(*REPL)) *REPL {
+	r := &REPL{
+		ctx:          ctx,
+		prompt:       "mruby> ",
+		continuation: "mruby* ",
+	}
+	for _, option := range options {
+		option(r)
+	}
+	return r
+}
+
+// SetPrompt sets the prompt for new expressions (default: "mruby> "),
+// and the prompt for continued lines (default: "mruby* ").
+// It is used for configuring a REPL (see New for details).
+func SetPrompt(prompt, continuation string) func(*REPL) {
+	return func(r *REPL) {
+		r.prompt = prompt
+		r.continuation = continuation
+	}
+}
+
+// SetHistoryFile loads the history from the file with the given name,
+// and appends every evaluated expression to it.
+// It is used for configuring a REPL (see New for details).
+func SetHistoryFile(filename string) func(*REPL) {
+	return func(r *REPL) {
+		r.historyFile = filename
+	}
+}
+
+// History returns the expressions evaluated so far, including those
+// loaded from the history file.
+func (r *REPL) History() []string {
+	return r.history
+}
+
+// Run reads expressions from in and writes results to out until in is
+// exhausted or the user enters "exit" or "quit". Enter ":history" to
+// print the history, and ":locals" to print the local variables if the
+// Context has been created with mruby.SetKeepLocals.
+func (r *REPL) Run(in io.Reader, out io.Writer) error {
+	if err := r.loadHistory(); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(in)
+	var lines []string
+	for {
+		if len(lines) == 0 {
+			fmt.Fprint(out, r.prompt)
+		} else {
+			fmt.Fprint(out, r.continuation)
+		}
+		if !scanner.Scan() {
+			fmt.Fprintln(out)
+			return scanner.Err()
+		}
+		line := scanner.Text()
+
+		if len(lines) == 0 {
+			switch strings.TrimSpace(line) {
+			case "":
+				continue
+			case "exit", "quit":
+				return nil
+			case ":history":
+				for i, entry := range r.history {
+					fmt.Fprintf(out, "%4d  %s\n", i+1, entry)
+				}
+				continue
+			case ":locals":
+				r.printLocals(out)
+				continue
+			}
+		}
+
+		lines = append(lines, line)
+		code := strings.Join(lines, "\n")
+		parser, err := r.ctx.Parse(code)
+		if err != nil && isIncomplete(err) {
+			continue
+		}
+		lines = nil
+		if err := r.addHistory(code); err != nil {
+			fmt.Fprintf(out, "cannot write history: %v\n", err)
+		}
+		if err != nil {
+			printError(out, err)
+			continue
+		}
+
+		val, err := parser.Run()
+		if err != nil {
+			printError(out, err)
+			continue
+		}
+		inspected, err := val.Call("inspect")
+		if err != nil {
+			printError(out, err)
+			continue
+		}
+		s, err := inspected.ToString()
+		if err != nil {
+			printError(out, err)
+			continue
+		}
+		fmt.Fprintf(out, "=> %s\n", s)
+	}
+}
+
+// printLocals prints the local variables kept by the Context, sorted
+// by name.
+func (r *REPL) printLocals(out io.Writer) {
+	locals := r.ctx.Locals()
+	names := make([]string, 0, len(locals))
+	for name := range locals {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		inspected, err := locals[name].Call("inspect")
+		if err != nil {
+			printError(out, err)
+			continue
+		}
+		s, err := inspected.ToString()
+		if err != nil {
+			printError(out, err)
+			continue
+		}
+		fmt.Fprintf(out, "%s = %s\n", name, s)
+	}
+}
+
+// isIncomplete returns true if err indicates that the parser reached
+// the end of the input before the expression was complete. Depending
+// on the version of mruby, the parser reports "$end" or "end of file".
+// This is best-effort: mruby doesn't report incomplete input as such,
+// so it relies on the message of the parser. If the message changes,
+// multi-line input is reported as a syntax error instead.
+func isIncomplete(err error) bool {
+	parseErr, ok := err.(*mruby.ParseError)
+	if !ok {
+		return false
+	}
+	msg := parseErr.Message
+	return strings.Contains(msg, "$end") ||
+		strings.Contains(msg, "end of file") ||
+		strings.Contains(msg, "end-of-input")
+}
+
+// printError prints an error raised while parsing or evaluating an
+// expression.
+func printError(out io.Writer, err error) {
+	switch e := err.(type) {
+	case *mruby.ParseError:
+		fmt.Fprintf(out, "SyntaxError: line %d: %s\n", e.Line, e.Message)
+	case *mruby.RunError:
+		fmt.Fprintf(out, "%s: %s\n", e.Class, e.Message)
+	default:
+		fmt.Fprintf(out, "Error: %v\n", err)
+	}
+}
+
+// loadHistory reads the history file, if configured and present.
+func (r *REPL) loadHistory() error {
+	if r.historyFile == "" {
+		return nil
+	}
+	f, err := os.Open(r.historyFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			r.history = append(r.history, historyUnescaper.Replace(line))
+		}
+	}
+	return scanner.Err()
+}
+
+// The history file has one expression per line. Newlines of multi-line
+// expressions are escaped as \n, and backslashes as \\.
+var (
+	historyEscaper   = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	historyUnescaper = strings.NewReplacer(`\\`, `\`, `\n`, "\n")
+)
+
+// addHistory adds an expression to the history, and appends it to the
+// history file, if configured.
+func (r *REPL) addHistory(code string) error {
+	r.history = append(r.history, code)
+	if r.historyFile == "" {
+		return nil
+	}
+	f, err := os.OpenFile(r.historyFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(f, historyEscaper.Replace(code)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
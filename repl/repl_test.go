@@ -0,0 +1,157 @@
+// Copyright 2013-2015 Oliver Eilhard.
+// Use of this source code is governed by the MIT LICENSE that
+// can be found in the MIT-LICENSE file included in the project.
+
+package repl
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	mruby "github.com/olivere/mruby-go"
+)
+
+func TestREPL(t *testing.T) {
+	ctx := mruby.NewContext()
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	input := strings.Join([]string{
+		"1 + 2",
+		"def greet(name)",
+		"  'Hello, ' + name",
+		"end",
+		"greet('Oliver')",
+		"raise ArgumentError, 'kaboom'",
+		"1 + )",
+		":history",
+		"exit",
+		"'not evaluated'",
+	}, "\n")
+	var out bytes.Buffer
+	r := New(ctx, SetPrompt("> ", "* "))
+	if err := r.Run(strings.NewReader(input), &out); err != nil {
+		t.Fatal(err)
+	}
+
+	got := out.String()
+	expected := []string{
+		"> => 3\n",
+		"> * * => ",
+		`=> "Hello, Oliver"`,
+		"ArgumentError: kaboom\n",
+		"SyntaxError: line 1: ",
+		"   1  1 + 2\n",
+		"   2  def greet(name)\n  'Hello, ' + name\nend\n",
+	}
+	for _, s := range expected {
+		if !strings.Contains(got, s) {
+			t.Errorf("expected output to contain %q; got:\n%s", s, got)
+		}
+	}
+	if strings.Contains(got, "not evaluated") {
+		t.Errorf("expected REPL to stop at exit; got:\n%s", got)
+	}
+	if n := len(r.History()); n != 5 {
+		t.Errorf("expected %d history entries; got: %d", 5, n)
+	}
+}
+
+func TestREPLHistoryFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mruby-go-repl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "history")
+
+	for i := 0; i < 2; i++ {
+		ctx := mruby.NewContext()
+		if ctx == nil {
+			t.Fatal("expected NewContext() to be != nil")
+		}
+		r := New(ctx, SetHistoryFile(filename))
+		if err := r.Run(strings.NewReader("40 + 2\n"), ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+		if n := len(r.History()); n != i+1 {
+			t.Errorf("expected %d history entries; got: %d", i+1, n)
+		}
+	}
+}
+
+func TestREPLHistoryFileMultiLine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mruby-go-repl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "history")
+
+	ctx := mruby.NewContext()
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+	input := strings.Join([]string{
+		"def greet(name)",
+		`  "Hello,\n" + name`,
+		"end",
+		`'C:\tmp\n'`,
+	}, "\n")
+	r := New(ctx, SetHistoryFile(filename))
+	if err := r.Run(strings.NewReader(input), ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"def greet(name)\n  \"Hello,\\n\" + name\nend",
+		`'C:\tmp\n'`,
+	}
+	if got := r.History(); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected history %q; got: %q", expected, got)
+	}
+
+	// Load the history again
+	r = New(ctx, SetHistoryFile(filename))
+	if err := r.Run(strings.NewReader(""), ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.History(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected history %q; got: %q", expected, got)
+	}
+}
+
+func TestREPLKeepsLocals(t *testing.T) {
+	ctx := mruby.NewContext(mruby.SetKeepLocals(true))
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	input := strings.Join([]string{
+		"x = 40",
+		"name = 'mruby'",
+		"x + 2",
+		":locals",
+	}, "\n")
+	var out bytes.Buffer
+	r := New(ctx, SetPrompt("> ", "* "))
+	if err := r.Run(strings.NewReader(input), &out); err != nil {
+		t.Fatal(err)
+	}
+
+	got := out.String()
+	expected := []string{
+		"> => 42\n",
+		"name = \"mruby\"\nx = 40\n",
+	}
+	for _, s := range expected {
+		if !strings.Contains(got, s) {
+			t.Errorf("expected output to contain %q; got:\n%s", s, got)
+		}
+	}
+}
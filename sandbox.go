@@ -0,0 +1,267 @@
+// Copyright 2013-2015 Oliver Eilhard.
+// Use of this source code is governed by the MIT LICENSE that
+// can be found in the MIT-LICENSE file included in the project.
+
+package mruby
+
+/*
+#cgo pkg-config: mruby
+#include "mruby_go.h"
+*/
+import "C"
+
+import (
+	"strings"
+	"unsafe"
+)
+
+// Sandbox is a policy that restricts the classes, modules, and methods
+// available to scripts running in a Context. Names of classes and modules
+// may be nested, e.g. "Process::Status". Names that do not exist in the
+// context, e.g. because the mruby gem defining them is not linked, are
+// ignored.
+//
+// Use SetSandbox to apply a policy to a new Context.
+type Sandbox struct {
+	// AllowConstants lists the only top-level classes and modules that
+	// remain available. If empty, all classes and modules are allowed
+	// unless listed in DenyConstants. Core classes like Object, Kernel,
+	// and all exception classes are always kept.
+	AllowConstants []string
+
+	// DenyConstants lists classes and modules that are removed. As
+	// instances of a removed class may still be reachable, e.g. STDOUT
+	// for IO, its class methods (or module functions), new, and
+	// allocate are removed as well, so that STDOUT.class.popen fails.
+	DenyConstants []string
+
+	// AllowMethods maps the name of a class or module to the only
+	// instance methods it keeps. All other instance methods defined
+	// directly in that class or module are removed.
+	AllowMethods map[string][]string
+
+	// DenyMethods maps the name of a class or module to instance methods
+	// that are removed.
+	DenyMethods map[string][]string
+
+	// DenyClassMethods maps the name of a class or module to class
+	// methods (or module functions) that are removed.
+	DenyClassMethods map[string][]string
+}
+
+// sandboxEssentials are top-level constants that are never removed
+// by Sandbox.AllowConstants, as mruby itself relies on them.
+var sandboxEssentials = []string{
+	"BasicObject", "Object", "Module", "Class", "Kernel",
+	"NilClass", "TrueClass", "FalseClass",
+	"Comparable", "Enumerable", "MrubyGo",
+}
+
+// kernelDenied lists the methods of Kernel that are removed by
+// PureComputationSandbox.
+var kernelDenied = []string{
+	"eval", "instance_eval", "instance_exec",
+	"system", "exec", "spawn", "fork", "`", "open", "syscall", "trap",
+	"sleep", "usleep", "exit", "exit!", "abort",
+	"require", "require_relative", "load",
+}
+
+// ioDenied lists the methods of IO that are removed by
+// PureComputationSandbox. The standard streams remain writable.
+var ioDenied = []string{
+	"initialize", "initialize_copy", "reopen",
+	"read", "sysread", "read_nonblock", "gets", "readline", "readlines",
+	"getc", "getbyte", "readchar", "readbyte", "ungetc",
+	"each", "each_line", "each_byte", "each_char",
+	"seek", "sysseek", "pos=", "rewind",
+	"close", "close_read", "close_write", "close_on_exec=",
+	"fileno", "to_i", "pid",
+}
+
+// PureComputationSandbox returns a policy for scripts that only compute
+// results, e.g. customer-supplied rules. It removes access to files,
+// processes, sockets, and ObjectSpace, as well as methods that evaluate
+// strings as code, spawn processes, sleep, or terminate the process.
+// The standard streams, e.g. STDOUT and $stdout, can only be written to.
+func PureComputationSandbox() *Sandbox {
+	return &Sandbox{
+		DenyConstants: []string{
+			"File", "FileTest", "IO", "Dir",
+			"Process", "Signal", "ObjectSpace", "ENV",
+			"Socket", "BasicSocket", "IPSocket", "TCPSocket", "TCPServer",
+			"UDPSocket", "UNIXSocket", "UNIXServer", "Addrinfo",
+			"Thread", "Mutex", "Queue",
+		},
+		DenyMethods: map[string][]string{
+			"Kernel":      kernelDenied,
+			"IO":          ioDenied,
+			"BasicObject": {"instance_eval", "instance_exec"},
+			"Module":      {"class_eval", "module_eval", "class_exec", "module_exec"},
+		},
+		DenyClassMethods: map[string][]string{
+			"Kernel": kernelDenied,
+		},
+	}
+}
+
+// SetSandbox applies the policy to the context before any user code runs.
+// Methods defined by Go code are not affected, e.g. those defined after
+// NewContext returns, or require and load as enabled by SetLoadFS.
+// It is used for configuring a Context (see NewContext for details).
+func SetSandbox(policy *Sandbox) func(*Context) {
+	return func(ctx *Context) {
+		ctx.sandbox = policy
+	}
+}
+
+// applySandbox removes all classes, modules, and methods from the context
+// that are not allowed by the policy.
+func (ctx *Context) applySandbox(policy *Sandbox) error {
+	ai := C.mrb_gc_arena_save(ctx.mrb)
+	defer C.mrb_gc_arena_restore(ctx.mrb, ai)
+
+	for name, methods := range policy.DenyMethods {
+		if class, found := ctx.lookupClassPath(name); found {
+			for _, method := range methods {
+				ctx.undefMethod(class, method)
+			}
+		}
+	}
+	for name, methods := range policy.DenyClassMethods {
+		if class, found := ctx.lookupClassPath(name); found {
+			singleton := C.my_singleton_class(ctx.mrb, C.my_mrb_class_value(class))
+			for _, method := range methods {
+				ctx.undefMethod(singleton, method)
+			}
+		}
+	}
+	for name, methods := range policy.AllowMethods {
+		class, found := ctx.lookupClassPath(name)
+		if !found {
+			continue
+		}
+		allowed := make(map[string]bool)
+		for _, method := range methods {
+			allowed[method] = true
+		}
+		classv := Value{ctx: ctx, v: C.my_mrb_class_value(class)}
+		defined, err := classv.funcall("instance_methods", Value{ctx: ctx, v: C.mrb_false_value()})
+		if err != nil {
+			return err
+		}
+		names, err := defined.ToArray()
+		if err != nil {
+			return err
+		}
+		for _, method := range names {
+			if s, ok := method.(string); ok && !allowed[s] {
+				ctx.undefMethod(class, s)
+			}
+		}
+	}
+
+	for _, name := range policy.DenyConstants {
+		if class, found := ctx.lookupClassPath(name); found {
+			if err := ctx.undefClassMethods(class); err != nil {
+				return err
+			}
+		}
+		ctx.removeConstPath(name)
+	}
+	if len(policy.AllowConstants) > 0 {
+		allowed := make(map[string]bool)
+		for _, name := range sandboxEssentials {
+			allowed[name] = true
+		}
+		for _, name := range policy.AllowConstants {
+			allowed[name] = true
+		}
+		object := Value{ctx: ctx, v: C.my_mrb_class_value(ctx.mrb.object_class)}
+		constants, err := object.funcall("constants")
+		if err != nil {
+			return err
+		}
+		names, err := constants.ToArray()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			s, ok := name.(string)
+			if !ok || allowed[s] {
+				continue
+			}
+			class, found := ctx.lookupClassPath(s)
+			if !found {
+				// Not a class or module, e.g. ARGV
+				continue
+			}
+			if C.my_class_inherits(class, ctx.mrb.eException_class) != C.mrb_bool(0) {
+				continue
+			}
+			ctx.removeConstPath(s)
+		}
+	}
+	return nil
+}
+
+// lookupClassPath returns the class or module with the given name,
+// e.g. "Kernel" or "Process::Status".
+func (ctx *Context) lookupClassPath(path string) (*C.struct_RClass, bool) {
+	class := ctx.mrb.object_class
+	for _, name := range strings.Split(path, "::") {
+		cname := C.CString(name)
+		var v C.mrb_value
+		found := C.my_const_get_at(ctx.mrb, class, cname, &v)
+		C.free(unsafe.Pointer(cname))
+		if found == C.mrb_bool(0) || C.is_class_or_module(v) == 0 {
+			return nil, false
+		}
+		class = C.my_mrb_class_ptr(v)
+	}
+	return class, true
+}
+
+// removeConstPath removes the constant with the given name,
+// e.g. "File" or "Process::Status".
+func (ctx *Context) removeConstPath(path string) bool {
+	outer := ctx.mrb.object_class
+	name := path
+	if i := strings.LastIndex(path, "::"); i >= 0 {
+		class, found := ctx.lookupClassPath(path[:i])
+		if !found {
+			return false
+		}
+		outer, name = class, path[i+2:]
+	}
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	return C.my_const_remove_at(ctx.mrb, outer, cname) != C.mrb_bool(0)
+}
+
+// undefClassMethods removes the class methods (or module functions)
+// defined in class, as well as new and allocate.
+func (ctx *Context) undefClassMethods(class *C.struct_RClass) error {
+	classv := Value{ctx: ctx, v: C.my_mrb_class_value(class)}
+	defined, err := classv.funcall("singleton_methods", Value{ctx: ctx, v: C.mrb_false_value()})
+	if err != nil {
+		return err
+	}
+	names, err := defined.ToArray()
+	if err != nil {
+		return err
+	}
+	singleton := C.my_singleton_class(ctx.mrb, classv.v)
+	for _, method := range append(names, "new", "allocate") {
+		if s, ok := method.(string); ok {
+			ctx.undefMethod(singleton, s)
+		}
+	}
+	return nil
+}
+
+// undefMethod removes the method with the given name from class.
+func (ctx *Context) undefMethod(class *C.struct_RClass, name string) bool {
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	return C.my_undef_method(ctx.mrb, class, cname) != C.mrb_bool(0)
+}
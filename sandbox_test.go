@@ -0,0 +1,187 @@
+// Copyright 2013-2015 Oliver Eilhard.
+// Use of this source code is governed by the MIT LICENSE that
+// can be found in the MIT-LICENSE file included in the project.
+
+package mruby
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSandboxDenyMethods(t *testing.T) {
+	ctx := NewContext(SetSandbox(&Sandbox{
+		DenyMethods: map[string][]string{
+			"BasicObject": {"instance_eval"},
+			"String":      {"upcase", "no_such_method"},
+		},
+	}))
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	if _, err := ctx.LoadString("'abc'.upcase"); err == nil {
+		t.Error("expected String#upcase to be removed")
+	}
+	if _, err := ctx.LoadString("Object.new.instance_eval { 1 }"); err == nil {
+		t.Error("expected BasicObject#instance_eval to be removed")
+	}
+	res, err := ctx.LoadStringResult("'abc'.downcase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != "abc" {
+		t.Errorf("expected %q; got: %v", "abc", res)
+	}
+}
+
+func TestSandboxAllowMethods(t *testing.T) {
+	ctx := NewContext(SetSandbox(&Sandbox{
+		AllowMethods: map[string][]string{
+			"String": {"size", "+", "==", "to_s"},
+		},
+	}))
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	res, err := ctx.LoadStringResult("('ab' + 'c').size")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != 3 {
+		t.Errorf("expected %d; got: %v", 3, res)
+	}
+	if _, err := ctx.LoadString("'abc'.reverse"); err == nil {
+		t.Error("expected String#reverse to be removed")
+	}
+}
+
+func TestSandboxConstants(t *testing.T) {
+	ctx := NewContext(SetSandbox(&Sandbox{
+		DenyConstants: []string{"Comparable", "DoesNotExist"},
+	}))
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+	if ctx.HasModule("Comparable", nil) {
+		t.Error("expected module Comparable to be removed")
+	}
+
+	ctx = NewContext(SetSandbox(&Sandbox{
+		AllowConstants: []string{"String", "Array", "Fixnum", "Integer", "Numeric"},
+	}))
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+	if ctx.HasClass("Hash", nil) {
+		t.Error("expected class Hash to be removed")
+	}
+	if !ctx.HasClass("String", nil) {
+		t.Error("expected class String to be kept")
+	}
+	if !ctx.HasClass("RuntimeError", nil) {
+		t.Error("expected class RuntimeError to be kept")
+	}
+	_, err := ctx.LoadString("raise 'kaboom'")
+	if err == nil || err.Error() != "kaboom" {
+		t.Errorf("expected error %q; got: %v", "kaboom", err)
+	}
+}
+
+func TestPureComputationSandbox(t *testing.T) {
+	ctx := NewContext(SetSandbox(PureComputationSandbox()))
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	res, err := ctx.LoadStringResult("[1, 2, 3].map { |x| x * 2 }.inject(:+)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != 12 {
+		t.Errorf("expected %d; got: %v", 12, res)
+	}
+
+	denied := []string{
+		"Object.new.instance_eval { 1 }",
+		"String.class_eval { }",
+		"exit",
+		"ObjectSpace",
+	}
+	for _, code := range denied {
+		if _, err := ctx.LoadString(code); err == nil {
+			t.Errorf("expected %q to fail in sandbox", code)
+		}
+	}
+}
+
+func TestSandboxDeniedClassesReachableThroughInstances(t *testing.T) {
+	ctx := NewContext(SetSandbox(&Sandbox{
+		DenyConstants: []string{"Range"},
+	}))
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+	if _, err := ctx.LoadString("Range"); err == nil {
+		t.Error("expected class Range to be removed")
+	}
+	for _, code := range []string{
+		"(1..2).class.new(1, 3)",
+		"(1..2).class.allocate",
+	} {
+		if _, err := ctx.LoadString(code); err == nil {
+			t.Errorf("expected %q to fail in sandbox", code)
+		}
+	}
+	// Instances remain usable
+	res, err := ctx.LoadStringResult("(1..3).to_a.size")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != 3 {
+		t.Errorf("expected %d; got: %v", 3, res)
+	}
+}
+
+func TestPureComputationSandboxStandardStreams(t *testing.T) {
+	ctx := NewContext(SetSandbox(PureComputationSandbox()))
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	// Without mruby-io, STDOUT is undefined and these fail, too.
+	denied := []string{
+		`STDOUT.class.popen("echo pwned")`,
+		`STDOUT.class.new(1)`,
+		`STDERR.class.for_fd(2)`,
+		`STDIN.class.sysopen("/etc/passwd")`,
+		`$stdout.class.open("/etc/passwd")`,
+		`$stdout.class.popen("echo pwned")`,
+		`$stderr.class.for_fd(2)`,
+		`$stdin.read`,
+		`STDOUT.reopen("/tmp/out")`,
+	}
+	for _, code := range denied {
+		if _, err := ctx.LoadString(code); err == nil {
+			t.Errorf("expected %q to fail in sandbox", code)
+		}
+	}
+
+	var stdout bytes.Buffer
+	ctx = NewContext(SetStdout(&stdout), SetSandbox(PureComputationSandbox()))
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+	for _, code := range denied {
+		if _, err := ctx.LoadString(code); err == nil {
+			t.Errorf("expected %q to fail in sandbox with Go-backed $stdout", code)
+		}
+	}
+	if _, err := ctx.LoadString(`puts "still works"`); err != nil {
+		t.Fatal(err)
+	}
+	if got := stdout.String(); got != "still works\n" {
+		t.Errorf("expected %q; got: %q", "still works\n", got)
+	}
+}
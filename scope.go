@@ -0,0 +1,132 @@
+// Copyright 2013-2015 Oliver Eilhard.
+// Use of this source code is governed by the MIT LICENSE that
+// can be found in the MIT-LICENSE file included in the project.
+
+package mruby
+
+/*
+#cgo pkg-config: mruby
+#include "mruby_go.h"
+*/
+import "C"
+
+import (
+	"errors"
+)
+
+var (
+	// ErrScopeClosed is returned when using a Scope after Close.
+	ErrScopeClosed = errors.New("scope closed")
+)
+
+// Scope runs scripts in isolation from other scripts of the same
+// Context, e.g. to reuse a warmed-up Context for scripts of different
+// tenants. Create one with Context.NewScope.
+//
+// Scripts run in a scope have a fresh top-level object as self.
+// Methods, classes, and constants they define at the top level belong
+// to the scope and are discarded with it. Globals they set are
+// restored when the scope is closed. Everything defined before the
+// scope was created, e.g. modules defined from Go or library code,
+// is visible in the scope.
+//
+// A scope doesn't protect against scripts that change existing classes
+// or modules, e.g. by reopening String. Combine it with SetSandbox to
+// restrict what scripts can do. Scopes of a context must be used one
+// after the other: create a scope, run scripts, and close it before
+// the next one is created.
+type Scope struct {
+	ctx     *Context
+	self    C.mrb_value // top-level object of the scope
+	globals C.mrb_value // hash of the globals when the scope was created
+	closed  bool
+}
+
+// NewScope creates a new Scope. Call Close when done with it.
+func (ctx *Context) NewScope() *Scope {
+	ctx.enter()
+	defer ctx.leave()
+
+	ai := C.mrb_gc_arena_save(ctx.mrb)
+	defer C.mrb_gc_arena_restore(ctx.mrb, ai)
+
+	s := &Scope{
+		ctx:     ctx,
+		self:    C.my_scope_new(ctx.mrb),
+		globals: C.my_globals_save(ctx.mrb),
+	}
+	C.mrb_gc_register(ctx.mrb, s.self)
+	C.mrb_gc_register(ctx.mrb, s.globals)
+	return s
+}
+
+// Self returns the top-level object of the scripts run in the scope.
+func (s *Scope) Self() Value {
+	return Value{ctx: s.ctx, v: s.self}
+}
+
+// LoadString runs a snippet of Ruby code in the scope and returns its
+// output, like Context.LoadString. Local variables are not kept between
+// calls. An error is returned if a script is running in the context,
+// e.g. when called from a Go function.
+func (s *Scope) LoadString(code string, args ...interface{}) (Value, error) {
+	ctx := s.ctx
+	if s.closed {
+		return NilValue(ctx), ErrScopeClosed
+	}
+	if C.my_vm_running(ctx.mrb) != C.mrb_bool(0) {
+		return NilValue(ctx), errors.New("scope cannot be used while a script is running")
+	}
+
+	ctx.enter()
+	defer ctx.leave()
+
+	ai := C.mrb_gc_arena_save(ctx.mrb)
+	defer C.mrb_gc_arena_restore(ctx.mrb, ai)
+
+	proc, err := compile(ctx.mrb, code, ctx.filename, ctx.noExec)
+	if err != nil {
+		return NilValue(ctx), err
+	}
+	if ctx.noExec {
+		return Value{ctx: ctx, v: C.my_proc_value(proc)}, nil
+	}
+
+	restoreArgv, err := ctx.setArgv(args)
+	if err != nil {
+		return NilValue(ctx), err
+	}
+	defer restoreArgv()
+	defer ctx.preserveLocals()()
+
+	result := C.my_run_scoped(ctx.mrb, proc, s.self, C.mrb_obj_class(ctx.mrb, s.self))
+	if C.has_exception(ctx.mrb) != 0 {
+		return NilValue(ctx), newScriptError(ctx)
+	}
+
+	return Value{ctx: ctx, v: result}, nil
+}
+
+// Close discards the scope and restores the globals of the context as
+// they were when the scope was created.
+func (s *Scope) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	ctx := s.ctx
+	if ctx.mrb == nil {
+		return nil
+	}
+	ctx.enter()
+	defer ctx.leave()
+
+	ai := C.mrb_gc_arena_save(ctx.mrb)
+	defer C.mrb_gc_arena_restore(ctx.mrb, ai)
+
+	C.my_globals_restore(ctx.mrb, s.globals)
+	C.mrb_gc_unregister(ctx.mrb, s.globals)
+	C.mrb_gc_unregister(ctx.mrb, s.self)
+	return nil
+}
@@ -0,0 +1,110 @@
+// Copyright 2013-2015 Oliver Eilhard.
+// Use of this source code is governed by the MIT LICENSE that
+// can be found in the MIT-LICENSE file included in the project.
+
+package mruby
+
+import (
+	"testing"
+)
+
+func TestScope(t *testing.T) {
+	ctx := NewContext()
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+	if _, err := ctx.LoadString(`def shared; "shared"; end; $level = 1`); err != nil {
+		t.Fatal(err)
+	}
+
+	scope := ctx.NewScope()
+	res, err := scope.LoadString(`
+		def helper; "tenant"; end
+		LIMIT = 10
+		$level = 2
+		$tenant = "acme"
+		"#{helper}/#{shared}/#{ARGV[0]}"
+	`, "arg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := res.ToString(); got != "tenant/shared/arg" {
+		t.Errorf("expected %q; got: %q", "tenant/shared/arg", got)
+	}
+
+	// Definitions are kept between scripts of the same scope
+	res, err = scope.LoadString(`[helper, LIMIT, $level]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := res.ToArray(); len(got) != 3 || got[0] != "tenant" || got[1] != 10 || got[2] != 2 {
+		t.Errorf("expected %v; got: %v", []interface{}{"tenant", 10, 2}, got)
+	}
+
+	// ... but do not leak into the context
+	res, err = ctx.LoadString(`[respond_to?(:helper), Object.const_defined?(:LIMIT)]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := res.ToArray(); len(got) != 2 || got[0] != false || got[1] != false {
+		t.Errorf("expected definitions of the scope to be invisible; got: %v", got)
+	}
+
+	if err := scope.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := scope.LoadString(`1`); err != ErrScopeClosed {
+		t.Errorf("expected %v; got: %v", ErrScopeClosed, err)
+	}
+
+	// Globals are restored on Close
+	if v, _ := ctx.GetGlobal("$tenant"); !v.IsNil() {
+		t.Errorf("expected $tenant to be removed; got: %v", v)
+	}
+	v, err := ctx.GetGlobal("$level")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if level, err := v.ToInt(); err != nil || level != 1 {
+		t.Errorf("expected $level to be restored to %d; got: %d (err=%v)", 1, level, err)
+	}
+
+	// A new scope starts fresh
+	next := ctx.NewScope()
+	defer next.Close()
+	if _, err := next.LoadString(`helper`); err == nil {
+		t.Error("expected NoMethodError in a new scope")
+	}
+	res, err = next.LoadString(`shared`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := res.ToString(); got != "shared" {
+		t.Errorf("expected %q; got: %q", "shared", got)
+	}
+}
+
+func TestScopeFromGoFunction(t *testing.T) {
+	ctx := NewContext()
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+	scope := ctx.NewScope()
+	defer scope.Close()
+
+	mod, err := ctx.DefineModule("Nested", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var scopeErr error
+	mod.DefineClassMethod("run", func(ctx *Context) (Value, error) {
+		_, scopeErr = scope.LoadString("1")
+		return NilValue(ctx), nil
+	})
+	if _, err := ctx.LoadString("Nested.run"); err != nil {
+		t.Fatal(err)
+	}
+	if scopeErr == nil {
+		t.Error("expected error when using a scope while a script is running")
+	}
+}
@@ -0,0 +1,439 @@
+// Copyright 2013-2015 Oliver Eilhard.
+// Use of this source code is governed by the MIT LICENSE that
+// can be found in the MIT-LICENSE file included in the project.
+
+package mruby
+
+/*
+#cgo pkg-config: mruby
+#include "mruby_go.h"
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// Snapshot is the recorded setup of a Context, e.g. modules and methods
+// defined in Go and library code loaded into the context. Use
+// Snapshot.NewContext to create new contexts in that state.
+//
+// A Snapshot doesn't copy the state of the context, as mruby cannot
+// clone it. Instead, it replays the recorded setup. Other than the
+// original setup, it doesn't parse Ruby code again: scripts are
+// compiled to bytecode once when the snapshot is taken. Running them
+// and replaying the definitions made from Go still takes the same time,
+// so replaying only saves the time spent parsing (compare
+// BenchmarkSetupReplay and BenchmarkSnapshotNewContext). To take setup
+// off the path of NewContext, use Prepare to replay contexts in advance,
+// e.g. in a background goroutine (see
+// BenchmarkSnapshotPreparedNewContext).
+//
+// A Snapshot is safe for concurrent use.
+type Snapshot struct {
+	options []func(*Context)
+	steps   []setupStep
+
+	mu       sync.Mutex // guards prepared
+	prepared []*Context // contexts replayed by Prepare, not handed out yet
+}
+
+// setupStep is a recorded step of setting up a Context. It either
+// replays a definition made from Go, or runs a script.
+type setupStep struct {
+	replay func(*Context) error // replays a definition, if not nil
+
+	code     string        // source of the script, until compiled
+	filename string        // filename of the script
+	args     []interface{} // arguments of the script
+	prog     *Program      // compiled script
+}
+
+// SetRecordSetup records how the context is set up after NewContext
+// returns, so that it can be captured via Context.Snapshot. Recorded
+// are modules, classes, and methods defined from Go, as well as scripts
+// run via LoadString, LoadFile, LoadReader, LoadBytecode, and Run.
+// Globals and constants set from Go are recorded as well. Values passed
+// as arguments of scripts, globals, or constants, including those in
+// slices and maps, are recorded as converted by Value.ToInterface, as
+// they belong to the recording context; Snapshot returns an error for
+// values that cannot be converted, e.g. classes, procs, or ranges.
+// Definitions and scripts nested in a recorded script, e.g. made by a Go
+// function called from Ruby or loaded via require, are not recorded
+// separately, as they are made again when the script is replayed.
+// Code run via Parse and Parser.Run is not recorded.
+// It is used for configuring a Context (see NewContext for details).
+func SetRecordSetup(record bool) func(*Context) {
+	return func(ctx *Context) {
+		ctx.recordSetup = record
+	}
+}
+
+// Snapshot captures the setup recorded since NewContext and stops
+// recording. The context must have been created with SetRecordSetup.
+//
+// Changes to the context that are not made via the recorded methods,
+// e.g. values passed to Ruby from Go functions that are not called by a
+// recorded script, are not part of the snapshot. Go functions are
+// shared by all contexts created from the snapshot, so they should use
+// the Context passed to them instead of capturing the original one.
+func (ctx *Context) Snapshot() (*Snapshot, error) {
+	if !ctx.recording {
+		return nil, errors.New("setup of the context has not been recorded; use SetRecordSetup")
+	}
+	if ctx.recordErr != nil {
+		return nil, ctx.recordErr
+	}
+
+	steps := make([]setupStep, 0, len(ctx.setupSteps))
+	for _, step := range ctx.setupSteps {
+		if step.replay == nil && step.prog == nil {
+			prog, err := Compile(step.code, step.filename)
+			if err != nil {
+				return nil, err
+			}
+			step.code = ""
+			step.prog = prog
+		}
+		steps = append(steps, step)
+	}
+
+	ctx.recording = false
+	ctx.setupSteps = nil
+
+	return &Snapshot{options: ctx.options, steps: steps}, nil
+}
+
+// NewContext returns a new Context in the state of the snapshot. It
+// returns a context replayed by Prepare, if there is one left.
+// Otherwise it creates a new Context with the same options as the
+// original context and replays the recorded setup: it runs the compiled
+// scripts and makes the definitions recorded from Go again. The new
+// context does not record its setup.
+func (s *Snapshot) NewContext() (*Context, error) {
+	s.mu.Lock()
+	if n := len(s.prepared); n > 0 {
+		ctx := s.prepared[n-1]
+		s.prepared[n-1] = nil
+		s.prepared = s.prepared[:n-1]
+		s.mu.Unlock()
+		return ctx, nil
+	}
+	s.mu.Unlock()
+	return s.replay()
+}
+
+// Prepare replays n contexts and keeps them for NewContext, so that
+// NewContext returns them without running the setup. Prepare may be
+// called from a background goroutine to refill the prepared contexts
+// while others are handed out by NewContext.
+//
+// Example:
+//
+//	go snapshot.Prepare(8)
+func (s *Snapshot) Prepare(n int) error {
+	for i := 0; i < n; i++ {
+		ctx, err := s.replay()
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.prepared = append(s.prepared, ctx)
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// Prepared returns the number of contexts replayed by Prepare that
+// have not been returned by NewContext yet.
+func (s *Snapshot) Prepared() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.prepared)
+}
+
+// Close closes the contexts replayed by Prepare that have not been
+// returned by NewContext. The snapshot can still be used afterwards.
+func (s *Snapshot) Close() {
+	s.mu.Lock()
+	prepared := s.prepared
+	s.prepared = nil
+	s.mu.Unlock()
+	for _, ctx := range prepared {
+		ctx.Close()
+	}
+}
+
+// replay creates a new Context and replays the recorded setup.
+func (s *Snapshot) replay() (*Context, error) {
+	options := make([]func(*Context), 0, len(s.options)+1)
+	options = append(options, s.options...)
+	options = append(options, SetRecordSetup(false))
+
+	ctx, err := OpenContext(options...)
+	if err != nil {
+		return nil, err
+	}
+	for _, step := range s.steps {
+		if step.replay != nil {
+			if err := step.replay(ctx); err != nil {
+				ctx.Close()
+				return nil, err
+			}
+			continue
+		}
+		if _, err := ctx.Run(step.prog, step.args...); err != nil {
+			ctx.Close()
+			return nil, err
+		}
+	}
+	return ctx, nil
+}
+
+// isRecording returns true if setup steps are recorded right now.
+func (ctx *Context) isRecording() bool {
+	return ctx.recording && ctx.recordDepth == 0
+}
+
+// recordLoad runs a script via load and records it, if successful.
+// Scripts loaded while it is running are not recorded.
+func (ctx *Context) recordLoad(step setupStep, load func() (Value, error)) (Value, error) {
+	ctx.recordDepth++
+	args, err := detachValues(step.args)
+	if err != nil {
+		ctx.failRecording(err)
+	}
+	step.args = args
+
+	val, err := load()
+	ctx.recordDepth--
+	if err == nil {
+		ctx.setupSteps = append(ctx.setupSteps, step)
+	}
+	return val, err
+}
+
+// failRecording makes Snapshot return err, e.g. for setup that refers
+// to values of the recording context.
+func (ctx *Context) failRecording(err error) {
+	if ctx.recordErr == nil {
+		ctx.recordErr = fmt.Errorf("cannot record setup: %v", err)
+	}
+}
+
+// detachRecorded is like detachValue, but doesn't record setup made
+// while converting values, e.g. by to_h methods.
+func (ctx *Context) detachRecorded(value interface{}) (interface{}, error) {
+	ctx.recordDepth++
+	defer func() { ctx.recordDepth-- }()
+	return detachValue(value)
+}
+
+// detachValues is like detachValue for all values.
+func detachValues(values []interface{}) ([]interface{}, error) {
+	if values == nil {
+		return nil, nil
+	}
+	detached := make([]interface{}, len(values))
+	for i, value := range values {
+		v, err := detachValue(value)
+		if err != nil {
+			return nil, err
+		}
+		detached[i] = v
+	}
+	return detached, nil
+}
+
+// detachValue returns a copy of value that can be passed to ToValue of
+// another context. Values reachable from value, e.g. in a slice, belong
+// to the recording context and are converted to Go. An error is
+// returned for values that cannot be converted, e.g. procs or ranges.
+func detachValue(value interface{}) (interface{}, error) {
+	switch value := value.(type) {
+	case Value:
+		goval, err := value.ToInterface()
+		if err != nil {
+			return nil, err
+		}
+		return detachValue(goval)
+	case *Class, *Module, *Proc, Range, *Exception:
+		return nil, fmt.Errorf("cannot convert %T to a value of another context", value)
+	}
+
+	valof := reflect.ValueOf(value)
+	switch valof.Kind() {
+	case reflect.Array, reflect.Slice:
+		ary := make([]interface{}, valof.Len())
+		for i := range ary {
+			elem, err := detachValue(valof.Index(i).Interface())
+			if err != nil {
+				return nil, err
+			}
+			ary[i] = elem
+		}
+		return ary, nil
+	case reflect.Map:
+		// ToValue uses the string representation of keys
+		hsh := make(map[string]interface{}, valof.Len())
+		for _, key := range valof.MapKeys() {
+			elem, err := detachValue(valof.MapIndex(key).Interface())
+			if err != nil {
+				return nil, err
+			}
+			hsh[key.String()] = elem
+		}
+		return hsh, nil
+	case reflect.Ptr:
+		if valof.IsNil() {
+			return nil, nil
+		}
+		return detachValue(valof.Elem().Interface())
+	}
+	return value, nil
+}
+
+// recordDefinition records a definition made from Go, if recording.
+func (ctx *Context) recordDefinition(replay func(*Context) error) {
+	if ctx.isRecording() {
+		ctx.setupSteps = append(ctx.setupSteps, setupStep{replay: replay})
+	}
+}
+
+// classPath returns the name of class, including its outer modules,
+// e.g. "Process::Status".
+func (ctx *Context) classPath(class *C.struct_RClass) string {
+	return C.GoString(C.mrb_class_name(ctx.mrb, class))
+}
+
+// snapshotClass finds the class or module with the given path in a
+// context created from a Snapshot.
+func (ctx *Context) snapshotClass(path string) (*C.struct_RClass, error) {
+	class, found := ctx.lookupClassPath(path)
+	if !found {
+		return nil, fmt.Errorf("cannot replay setup: class or module %s not found", path)
+	}
+	return class, nil
+}
+
+// recordNewModule records the definition of a module via NewModule.
+func (ctx *Context) recordNewModule(name string, outer RClass) {
+	if !ctx.isRecording() {
+		return
+	}
+	outerPath := ""
+	if outer != nil {
+		outerPath = ctx.classPath(outer.RClass())
+	}
+	ctx.recordDefinition(func(ctx *Context) error {
+		var outer RClass
+		if outerPath != "" {
+			class, err := ctx.snapshotClass(outerPath)
+			if err != nil {
+				return err
+			}
+			outer = &Module{ctx: ctx, module: class}
+		}
+		_, err := NewModule(ctx, name, outer)
+		return err
+	})
+}
+
+// recordNewClass records the definition of a class via NewClass or
+// NewClassUnder.
+func (ctx *Context) recordNewClass(name string, super *Class, outer RClass) {
+	if !ctx.isRecording() {
+		return
+	}
+	superPath, outerPath := "", ""
+	if super != nil {
+		superPath = ctx.classPath(super.class)
+	}
+	if outer != nil {
+		outerPath = ctx.classPath(outer.RClass())
+	}
+	ctx.recordDefinition(func(ctx *Context) error {
+		var super *Class
+		if superPath != "" {
+			class, err := ctx.snapshotClass(superPath)
+			if err != nil {
+				return err
+			}
+			super = &Class{ctx: ctx, class: class}
+		}
+		if outerPath == "" {
+			_, err := NewClass(ctx, name, super)
+			return err
+		}
+		class, err := ctx.snapshotClass(outerPath)
+		if err != nil {
+			return err
+		}
+		_, err = NewClassUnder(ctx, name, super, &Module{ctx: ctx, module: class})
+		return err
+	})
+}
+
+// recordMethod records the definition of a method via DefineMethod or
+// DefineClassMethod of a Module (if module is true) or a Class.
+func (ctx *Context) recordMethod(class *C.struct_RClass, module, classMethod bool, name string, f Function) {
+	if !ctx.isRecording() {
+		return
+	}
+	path := ctx.classPath(class)
+	ctx.recordDefinition(func(ctx *Context) error {
+		class, err := ctx.snapshotClass(path)
+		if err != nil {
+			return err
+		}
+		switch {
+		case module && classMethod:
+			(&Module{ctx: ctx, module: class}).DefineClassMethod(name, f)
+		case module:
+			(&Module{ctx: ctx, module: class}).DefineMethod(name, f)
+		case classMethod:
+			(&Class{ctx: ctx, class: class}).DefineClassMethod(name, f)
+		default:
+			(&Class{ctx: ctx, class: class}).DefineMethod(name, f)
+		}
+		return nil
+	})
+}
+
+// recordSetGlobal records setting a global variable via SetGlobal.
+func (ctx *Context) recordSetGlobal(name string, value interface{}) {
+	if !ctx.isRecording() {
+		return
+	}
+	value, err := ctx.detachRecorded(value)
+	if err != nil {
+		ctx.failRecording(err)
+		return
+	}
+	ctx.recordDefinition(func(ctx *Context) error {
+		return ctx.SetGlobal(name, value)
+	})
+}
+
+// recordSetConst records setting a constant via SetConst.
+func (ctx *Context) recordSetConst(class *C.struct_RClass, name string, value interface{}) {
+	if !ctx.isRecording() {
+		return
+	}
+	value, err := ctx.detachRecorded(value)
+	if err != nil {
+		ctx.failRecording(err)
+		return
+	}
+	path := ctx.classPath(class)
+	ctx.recordDefinition(func(ctx *Context) error {
+		class, err := ctx.snapshotClass(path)
+		if err != nil {
+			return err
+		}
+		return ctx.setConst(class, name, value)
+	})
+}
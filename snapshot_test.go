@@ -0,0 +1,357 @@
+// Copyright 2013-2015 Oliver Eilhard.
+// Use of this source code is governed by the MIT LICENSE that
+// can be found in the MIT-LICENSE file included in the project.
+
+package mruby
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	ctx := NewContext(SetRecordSetup(true))
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	helpers, err := ctx.DefineModule("Helpers", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	helpers.DefineClassMethod("upcase", func(ctx *Context) (Value, error) {
+		args, err := ctx.GetArgs()
+		if err != nil {
+			return NilValue(ctx), err
+		}
+		s, err := args[0].ToString()
+		if err != nil {
+			return NilValue(ctx), err
+		}
+		return ctx.ToValue(strings.ToUpper(s))
+	})
+	base, err := ctx.DefineClassUnder("Base", nil, helpers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base.DefineMethod("kind", func(ctx *Context) (Value, error) {
+		return ctx.ToValue("base")
+	})
+	if _, err := ctx.LoadString(`
+		class Greeter < Helpers::Base
+		  def greet(name)
+		    "Hello, #{Helpers.upcase(name)} (#{kind})"
+		  end
+		end
+		$setups = ($setups || 0) + 1
+	`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ctx.LoadReader("lib.rb", strings.NewReader("LIB_FILE = __FILE__")); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := ctx.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes after the snapshot are not recorded
+	if _, err := ctx.LoadString("$setups = 42"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		clone, err := snapshot.NewContext()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := clone.LoadStringResult("[Greeter.new.greet('oliver'), $setups, LIB_FILE]")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, ok := got.([]interface{})
+		if !ok || len(res) != 3 {
+			t.Fatalf("expected an array of %d elements; got: %v", 3, got)
+		}
+		if res[0] != "Hello, OLIVER (base)" {
+			t.Errorf("expected %q; got: %v", "Hello, OLIVER (base)", res[0])
+		}
+		if res[1] != 1 {
+			t.Errorf("expected setup to run %d time(s); got: %v", 1, res[1])
+		}
+		if res[2] != "lib.rb" {
+			t.Errorf("expected filename %q; got: %v", "lib.rb", res[2])
+		}
+
+		// Clones are isolated from each other
+		if _, err := clone.LoadString("class Greeter; def greet(name); 'changed'; end; end"); err != nil {
+			t.Fatal(err)
+		}
+		clone.Close()
+	}
+}
+
+func TestSnapshotPrepare(t *testing.T) {
+	ctx := NewContext(SetRecordSetup(true))
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+	if _, err := ctx.LoadString("$setups = ($setups || 0) + 1"); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := ctx.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := snapshot.Prepare(2); err != nil {
+		t.Fatal(err)
+	}
+	if got := snapshot.Prepared(); got != 2 {
+		t.Fatalf("expected %d prepared contexts; got: %d", 2, got)
+	}
+
+	// Prepared contexts first, then replayed ones
+	seen := make(map[*Context]bool)
+	for i := 0; i < 3; i++ {
+		clone, err := snapshot.NewContext()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[clone] {
+			t.Fatal("expected NewContext to return a context only once")
+		}
+		seen[clone] = true
+		got, err := clone.LoadStringResult("$setups")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != 1 {
+			t.Errorf("expected setup to run %d time(s); got: %v", 1, got)
+		}
+		if want := 1 - i; want >= 0 && snapshot.Prepared() != want {
+			t.Errorf("expected %d prepared contexts; got: %d", want, snapshot.Prepared())
+		}
+		clone.Close()
+	}
+
+	if err := snapshot.Prepare(1); err != nil {
+		t.Fatal(err)
+	}
+	snapshot.Close()
+	if got := snapshot.Prepared(); got != 0 {
+		t.Errorf("expected Close to drop the prepared contexts; got: %d", got)
+	}
+}
+
+func TestSnapshotSkipsNestedDefinitions(t *testing.T) {
+	ctx := NewContext(SetRecordSetup(true))
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	ctx.KernelModule().DefineMethod("define_helper", func(ctx *Context) (Value, error) {
+		module, err := ctx.DefineModule("Nested", nil)
+		if err != nil {
+			return NilValue(ctx), err
+		}
+		module.DefineClassMethod("answer", func(ctx *Context) (Value, error) {
+			return ctx.ToValue(42)
+		})
+		return NilValue(ctx), nil
+	})
+	if _, err := ctx.LoadString("define_helper"); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := ctx.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// define_helper, the script calling it
+	if len(snapshot.steps) != 2 {
+		t.Errorf("expected %d steps; got: %d", 2, len(snapshot.steps))
+	}
+
+	clone, err := snapshot.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := clone.LoadStringResult("Nested.answer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 42 {
+		t.Errorf("expected %d; got: %v", 42, got)
+	}
+}
+
+func TestSnapshotWithoutRecording(t *testing.T) {
+	ctx := NewContext()
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+	if _, err := ctx.Snapshot(); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestSnapshotConvertsValues(t *testing.T) {
+	ctx := NewContext(SetRecordSetup(true))
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	name, err := ctx.ToValue("oliver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ary, err := ctx.LoadString(`[1, "two"]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ctx.LoadString(`$args = ARGV.dup`, name, []interface{}{ary}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.SetGlobal("$config", map[string]interface{}{"name": name, "list": ary}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.ObjectModule().SetConst("NAME", name); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := ctx.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx.Close()
+
+	clone, err := snapshot.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clone.Close()
+	got, err := clone.LoadStringResult(`[$args, $config["name"], $config["list"], NAME]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []interface{}{
+		[]interface{}{"oliver", []interface{}{[]interface{}{1, "two"}}},
+		"oliver",
+		[]interface{}{1, "two"},
+		"oliver",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v; got: %v", expected, got)
+	}
+}
+
+func TestSnapshotRejectsContextBoundValues(t *testing.T) {
+	ctx := NewContext(SetRecordSetup(true))
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	proc, err := ctx.LoadString(`lambda { 42 }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.SetGlobal("$handlers", []interface{}{proc}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ctx.Snapshot(); err == nil {
+		t.Fatal("expected error recording a Proc")
+	}
+}
+
+// benchmarkSetup sets up a context like an application would: it
+// defines a module in Go and loads a library of Ruby code.
+func benchmarkSetup(ctx *Context, library string) error {
+	module, err := ctx.DefineModule("App", nil)
+	if err != nil {
+		return err
+	}
+	module.DefineClassMethod("version", func(ctx *Context) (Value, error) {
+		return ctx.ToValue("1.0")
+	})
+	_, err = ctx.LoadString(library)
+	return err
+}
+
+// benchmarkLibrary returns Ruby code with n classes.
+func benchmarkLibrary(n int) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, `
+class Model%d
+  attr_accessor :id, :name
+  def initialize(id, name); @id, @name = id, name; end
+  def to_h; { "id" => id, "name" => name, "version" => App.version }; end
+  def valid?; !name.nil? && name.size > 0 && id > 0; end
+end
+`, i)
+	}
+	return b.String()
+}
+
+func BenchmarkSetupReplay(b *testing.B) {
+	library := benchmarkLibrary(200)
+	for i := 0; i < b.N; i++ {
+		ctx := NewContext()
+		if err := benchmarkSetup(ctx, library); err != nil {
+			b.Fatal(err)
+		}
+		ctx.Close()
+	}
+}
+
+func BenchmarkSnapshotNewContext(b *testing.B) {
+	ctx := NewContext(SetRecordSetup(true))
+	if err := benchmarkSetup(ctx, benchmarkLibrary(200)); err != nil {
+		b.Fatal(err)
+	}
+	snapshot, err := ctx.Snapshot()
+	if err != nil {
+		b.Fatal(err)
+	}
+	ctx.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		clone, err := snapshot.NewContext()
+		if err != nil {
+			b.Fatal(err)
+		}
+		clone.Close()
+	}
+}
+
+func BenchmarkSnapshotPreparedNewContext(b *testing.B) {
+	ctx := NewContext(SetRecordSetup(true))
+	if err := benchmarkSetup(ctx, benchmarkLibrary(200)); err != nil {
+		b.Fatal(err)
+	}
+	snapshot, err := ctx.Snapshot()
+	if err != nil {
+		b.Fatal(err)
+	}
+	ctx.Close()
+
+	b.StopTimer()
+	if err := snapshot.Prepare(b.N); err != nil {
+		b.Fatal(err)
+	}
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		clone, err := snapshot.NewContext()
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StopTimer()
+		clone.Close()
+		b.StartTimer()
+	}
+}
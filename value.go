@@ -13,9 +13,23 @@ import "C"
 import (
 	"errors"
 	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+const (
+	maxUint = uint64(^uint(0))
+	maxInt  = int64(^uint(0) >> 1)
+	minInt  = -maxInt - 1
 )
 
 // Value is used for encoding/decoding data types from MRuby to Go and vice versa.
+//
+// A Value references an object in its Context, but does not keep that
+// object alive. Use Retain if you need to hold on to a Value after the
+// call that returned it has completed.
 type Value struct {
 	ctx *Context
 	v   C.mrb_value
@@ -124,7 +138,6 @@ func (v Value) IsHash() bool {
 	}
 }
 
-/*
 // IsException indicates whether this value is an exception.
 func (v Value) IsException() bool {
 	switch C.my_type(v.v) {
@@ -134,7 +147,16 @@ func (v Value) IsException() bool {
 		return false
 	}
 }
-*/
+
+// IsRange indicates whether this value is a Range.
+func (v Value) IsRange() bool {
+	switch C.my_type(v.v) {
+	case C.MRB_TT_RANGE:
+		return true
+	default:
+		return false
+	}
+}
 
 // IsProc indicates whether this value is a Proc.
 func (v Value) IsProc() bool {
@@ -162,113 +184,184 @@ func (v Value) ToBool() (bool, error) {
 }
 
 // ToInt treats this value as an int and returns its value.
-// If the value is not a Ruby Fixnum, an error is returned.
+// An error is returned if the value is not a Ruby Fixnum, or an
+// integral Float if the Context uses SetLenientIntegers.
+// If the value does not fit into an int, an OverflowError is returned.
 func (v Value) ToInt() (int, error) {
-	switch typ := C.my_type(v.v); typ {
-	case C.MRB_TT_FIXNUM:
-		return int(C.get_fixnum(v.v)), nil
-	default:
-		return 0, fmt.Errorf("value is not an int but %v", v.Type())
+	i, err := v.toInt64("int")
+	if err != nil {
+		return 0, err
 	}
+	if i < minInt || i > maxInt {
+		return 0, &OverflowError{Value: strconv.FormatInt(i, 10), Type: "int"}
+	}
+	return int(i), nil
 }
 
 // ToInt8 treats this value as an int8 and returns its value.
-// If the value is not a Ruby Fixnum, an error is returned.
+// An error is returned if the value is not a Ruby Fixnum, or an
+// integral Float if the Context uses SetLenientIntegers.
+// If the value does not fit into an int8, an OverflowError is returned.
 func (v Value) ToInt8() (int8, error) {
-	switch typ := C.my_type(v.v); typ {
-	case C.MRB_TT_FIXNUM:
-		return int8(C.get_fixnum(v.v)), nil
-	default:
-		return 0, fmt.Errorf("value is not an int8 but %v", v.Type())
+	i, err := v.toInt64("int8")
+	if err != nil {
+		return 0, err
+	}
+	if i < math.MinInt8 || i > math.MaxInt8 {
+		return 0, &OverflowError{Value: strconv.FormatInt(i, 10), Type: "int8"}
 	}
+	return int8(i), nil
 }
 
 // ToInt16 treats this value as an int16 and returns its value.
-// If the value is not a Ruby Fixnum, an error is returned.
+// An error is returned if the value is not a Ruby Fixnum, or an
+// integral Float if the Context uses SetLenientIntegers.
+// If the value does not fit into an int16, an OverflowError is returned.
 func (v Value) ToInt16() (int16, error) {
-	switch typ := C.my_type(v.v); typ {
-	case C.MRB_TT_FIXNUM:
-		return int16(C.get_fixnum(v.v)), nil
-	default:
-		return 0, fmt.Errorf("value is not an int16 but %v", v.Type())
+	i, err := v.toInt64("int16")
+	if err != nil {
+		return 0, err
+	}
+	if i < math.MinInt16 || i > math.MaxInt16 {
+		return 0, &OverflowError{Value: strconv.FormatInt(i, 10), Type: "int16"}
 	}
+	return int16(i), nil
 }
 
 // ToInt32 treats this value as an int32 and returns its value.
-// If the value is not a Ruby Fixnum, an error is returned.
+// An error is returned if the value is not a Ruby Fixnum, or an
+// integral Float if the Context uses SetLenientIntegers.
+// If the value does not fit into an int32, an OverflowError is returned.
 func (v Value) ToInt32() (int32, error) {
-	switch typ := C.my_type(v.v); typ {
-	case C.MRB_TT_FIXNUM:
-		return int32(C.get_fixnum(v.v)), nil
-	default:
-		return 0, fmt.Errorf("value is not an int32 but %v", v.Type())
+	i, err := v.toInt64("int32")
+	if err != nil {
+		return 0, err
+	}
+	if i < math.MinInt32 || i > math.MaxInt32 {
+		return 0, &OverflowError{Value: strconv.FormatInt(i, 10), Type: "int32"}
 	}
+	return int32(i), nil
 }
 
 // ToInt64 treats this value as an int64 and returns its value.
-// If the value is not a Ruby Fixnum, an error is returned.
+// An error is returned if the value is not a Ruby Fixnum, or an
+// integral Float if the Context uses SetLenientIntegers.
 func (v Value) ToInt64() (int64, error) {
-	switch typ := C.my_type(v.v); typ {
-	case C.MRB_TT_FIXNUM:
-		return int64(C.get_fixnum(v.v)), nil
-	default:
-		return 0, fmt.Errorf("value is not an int64 but %v", v.Type())
-	}
+	return v.toInt64("int64")
 }
 
 // ToUint treats this value as an uint and returns its value.
-// If the value is not a Ruby Fixnum, an error is returned.
+// An error is returned if the value is not a Ruby Fixnum, or an
+// integral Float if the Context uses SetLenientIntegers.
+// If the value is negative or does not fit into a uint,
+// an OverflowError is returned.
 func (v Value) ToUint() (uint, error) {
-	switch typ := C.my_type(v.v); typ {
-	case C.MRB_TT_FIXNUM:
-		return uint(C.get_fixnum(v.v)), nil
-	default:
-		return 0, fmt.Errorf("value is not a uint but %v", v.Type())
+	u, err := v.toUint64("uint")
+	if err != nil {
+		return 0, err
+	}
+	if u > maxUint {
+		return 0, &OverflowError{Value: strconv.FormatUint(u, 10), Type: "uint"}
 	}
+	return uint(u), nil
 }
 
 // ToUint8 treats this value as an uint8 and returns its value.
-// If the value is not a Ruby Fixnum, an error is returned.
+// An error is returned if the value is not a Ruby Fixnum, or an
+// integral Float if the Context uses SetLenientIntegers.
+// If the value is negative or does not fit into a uint8,
+// an OverflowError is returned.
 func (v Value) ToUint8() (uint8, error) {
-	switch typ := C.my_type(v.v); typ {
-	case C.MRB_TT_FIXNUM:
-		return uint8(C.get_fixnum(v.v)), nil
-	default:
-		return 0, fmt.Errorf("value is not a uint8 but %v", v.Type())
+	u, err := v.toUint64("uint8")
+	if err != nil {
+		return 0, err
 	}
+	if u > math.MaxUint8 {
+		return 0, &OverflowError{Value: strconv.FormatUint(u, 10), Type: "uint8"}
+	}
+	return uint8(u), nil
 }
 
 // ToUint16 treats this value as an uint16 and returns its value.
-// If the value is not a Ruby Fixnum, an error is returned.
+// An error is returned if the value is not a Ruby Fixnum, or an
+// integral Float if the Context uses SetLenientIntegers.
+// If the value is negative or does not fit into a uint16,
+// an OverflowError is returned.
 func (v Value) ToUint16() (uint16, error) {
-	switch typ := C.my_type(v.v); typ {
-	case C.MRB_TT_FIXNUM:
-		return uint16(C.get_fixnum(v.v)), nil
-	default:
-		return 0, fmt.Errorf("value is not a uint16 but %v", v.Type())
+	u, err := v.toUint64("uint16")
+	if err != nil {
+		return 0, err
+	}
+	if u > math.MaxUint16 {
+		return 0, &OverflowError{Value: strconv.FormatUint(u, 10), Type: "uint16"}
 	}
+	return uint16(u), nil
 }
 
 // ToUint32 treats this value as an uint32 and returns its value.
-// If the value is not a Ruby Fixnum, an error is returned.
+// An error is returned if the value is not a Ruby Fixnum, or an
+// integral Float if the Context uses SetLenientIntegers.
+// If the value is negative or does not fit into a uint32,
+// an OverflowError is returned.
 func (v Value) ToUint32() (uint32, error) {
-	switch typ := C.my_type(v.v); typ {
-	case C.MRB_TT_FIXNUM:
-		return uint32(C.get_fixnum(v.v)), nil
-	default:
-		return 0, fmt.Errorf("value is not a uint32 but %v", v.Type())
+	u, err := v.toUint64("uint32")
+	if err != nil {
+		return 0, err
 	}
+	if u > math.MaxUint32 {
+		return 0, &OverflowError{Value: strconv.FormatUint(u, 10), Type: "uint32"}
+	}
+	return uint32(u), nil
 }
 
 // ToUint64 treats this value as an uint64 and returns its value.
-// If the value is not a Ruby Fixnum, an error is returned.
+// An error is returned if the value is not a Ruby Fixnum, or an
+// integral Float if the Context uses SetLenientIntegers.
+// If the value is negative, an OverflowError is returned.
 func (v Value) ToUint64() (uint64, error) {
-	switch typ := C.my_type(v.v); typ {
+	return v.toUint64("uint64")
+}
+
+// toInt64 returns the value as an int64. It accepts Ruby Fixnums and,
+// if the Context has been configured with SetLenientIntegers, Ruby Floats
+// without a fractional part. The name of the Go type is used in the error
+// or OverflowError if the value cannot be converted.
+func (v Value) toInt64(typ string) (int64, error) {
+	switch C.my_type(v.v) {
 	case C.MRB_TT_FIXNUM:
-		return uint64(C.get_fixnum(v.v)), nil
-	default:
-		return 0, fmt.Errorf("value is not a uint64 but %v", v.Type())
+		return int64(C.get_fixnum(v.v)), nil
+	case C.MRB_TT_FLOAT:
+		if v.ctx == nil || !v.ctx.lenientIntegers {
+			break
+		}
+		f := float64(C.get_float(v.v))
+		if math.IsNaN(f) || math.IsInf(f, 0) || f != math.Trunc(f) {
+			break
+		}
+		// float64(math.MaxInt64) rounds up to 2^63, so compare with >=.
+		if f < math.MinInt64 || f >= math.MaxInt64 {
+			return 0, &OverflowError{Value: strconv.FormatFloat(f, 'g', -1, 64), Type: typ}
+		}
+		return int64(f), nil
+	}
+	article := "a"
+	if strings.HasPrefix(typ, "i") {
+		article = "an"
+	}
+	return 0, fmt.Errorf("value is not %s %s but %v", article, typ, v.Type())
+}
+
+// toUint64 is like toInt64, but returns an OverflowError if the value
+// is negative.
+func (v Value) toUint64(typ string) (uint64, error) {
+	i, err := v.toInt64(typ)
+	if err != nil {
+		return 0, err
 	}
+	if i < 0 {
+		return 0, &OverflowError{Value: strconv.FormatInt(i, 10), Type: typ}
+	}
+	return uint64(i), nil
 }
 
 // ToFloat32 treats this value as a float32 and returns its value.
@@ -296,6 +389,9 @@ func (v Value) ToFloat64() (float64, error) {
 // ToString returns a string for MRuby types String and Symbol.
 // If the value is not a Ruby String or Symbol, an error is returned.
 func (v Value) ToString() (string, error) {
+	v.ctx.enter()
+	defer v.ctx.leave()
+
 	switch typ := C.my_type(v.v); typ {
 	case C.MRB_TT_STRING:
 		return C.GoString(C.mrb_string_value_ptr(v.ctx.mrb, v.v)), nil
@@ -309,9 +405,12 @@ func (v Value) ToString() (string, error) {
 // ToArray treats this value as an array and returns its values.
 // If the value is not a Ruby Array, an error is returned.
 func (v Value) ToArray() ([]interface{}, error) {
+	v.ctx.enter()
+	defer v.ctx.leave()
+
 	switch typ := C.my_type(v.v); typ {
 	case C.MRB_TT_ARRAY:
-		return v.mrbArrayToSlice()
+		return v.mrbArrayToSlice(nil)
 	default:
 		return nil, fmt.Errorf("value is not an array but %v", v.Type())
 	}
@@ -320,19 +419,45 @@ func (v Value) ToArray() ([]interface{}, error) {
 // ToMap treats this value as a hash and returns its values as a map.
 // If the value is not a Ruby Hash, an error is returned.
 func (v Value) ToMap() (map[string]interface{}, error) {
+	v.ctx.enter()
+	defer v.ctx.leave()
+
 	switch typ := C.my_type(v.v); typ {
 	case C.MRB_TT_HASH:
-		return v.mrbHashToMap()
+		return v.mrbHashToMap(nil)
 	default:
 		return nil, fmt.Errorf("value is not a hash but %v", v.Type())
 	}
 }
 
 // ToInterface will return the Go-equivalent of the Ruby value.
-// It will only handle the following Ruby types: TrueClass, FalseClass,
-// NilClass, Fixnum, Float, Symbol, String, Array, and Hash.
-// All other Ruby types return nil.
+//
+// TrueClass, FalseClass, NilClass, Fixnum, Float, Symbol, String, Array,
+// and Hash are converted to the Go types bool, int, float64, string,
+// []interface{}, and map[string]interface{}. In addition:
+//
+//	Range      is returned as a Range
+//	Exception  is returned as an *Exception
+//	Class      is returned as a *Class
+//	Module     is returned as a *Module
+//	Proc       is returned as a *Proc
+//	Object     is returned as map[string]interface{}, either from the
+//	           result of its to_h method, or from its instance variables
+//	           (with the "@" prefix removed)
+//
+// ErrInvalidType is returned for Ruby types that have no Go equivalent,
+// e.g. Fibers or C pointers. ErrCyclicValue is returned if the value
+// references itself, e.g. an Array containing itself.
 func (v Value) ToInterface() (interface{}, error) {
+	v.ctx.enter()
+	defer v.ctx.leave()
+
+	return v.toInterface(nil)
+}
+
+// toInterface implements ToInterface. The arrays, hashes, ranges, and
+// objects being converted are kept in seen to detect cycles.
+func (v Value) toInterface(seen map[unsafe.Pointer]bool) (interface{}, error) {
 	switch C.my_type(v.v) {
 	case C.MRB_TT_FALSE:
 		if C.is_nil(v.v) != 0 {
@@ -353,51 +478,58 @@ func (v Value) ToInterface() (interface{}, error) {
 	case C.MRB_TT_FLOAT:
 		return float64(C.get_float(v.v)), nil
 	case C.MRB_TT_CPTR:
-		return nil, nil
+		return nil, ErrInvalidType
 	case C.MRB_TT_OBJECT:
-		return nil, nil
-	case C.MRB_TT_CLASS:
-		return nil, nil
+		return v.mrbObjectToMap(seen)
+	case C.MRB_TT_CLASS, C.MRB_TT_SCLASS:
+		return &Class{ctx: v.ctx, class: C.my_mrb_class_ptr(v.v)}, nil
 	case C.MRB_TT_MODULE:
-		return nil, nil
+		return &Module{ctx: v.ctx, module: C.my_mrb_class_ptr(v.v)}, nil
 	case C.MRB_TT_ICLASS:
-		return nil, nil
-	case C.MRB_TT_SCLASS:
-		return nil, nil
+		return nil, ErrInvalidType
 	case C.MRB_TT_PROC:
-		return nil, nil
+		return &Proc{v: v}, nil
 	case C.MRB_TT_ARRAY:
-		return v.mrbArrayToSlice()
+		return v.mrbArrayToSlice(seen)
 	case C.MRB_TT_HASH:
-		return v.mrbHashToMap()
+		return v.mrbHashToMap(seen)
 	case C.MRB_TT_STRING:
 		return C.GoString(C.mrb_string_value_ptr(v.ctx.mrb, v.v)), nil
 	case C.MRB_TT_RANGE:
-		return nil, nil
+		return v.mrbRangeToRange(seen)
 	case C.MRB_TT_EXCEPTION:
-		return nil, nil
+		return v.mrbExceptionToException()
 	case C.MRB_TT_FILE:
-		return nil, nil
+		return nil, ErrInvalidType
 	case C.MRB_TT_ENV:
-		return nil, nil
+		return nil, ErrInvalidType
 	case C.MRB_TT_DATA:
-		return nil, nil
+		if v.respondTo("to_h") {
+			return v.mrbObjectToMap(seen)
+		}
+		return nil, ErrInvalidType
 	case C.MRB_TT_FIBER:
-		return nil, nil
+		return nil, ErrInvalidType
 	case C.MRB_TT_MAXDEFINE:
-		return nil, nil
+		return nil, ErrInvalidType
 	}
 	return nil, ErrInvalidType
 }
 
 // mrbArrayToSlice takes the value (which has to be an array) and returns
 // the elements of the Ruby array as an array of Go values.
-func (v Value) mrbArrayToSlice() ([]interface{}, error) {
+func (v Value) mrbArrayToSlice(seen map[unsafe.Pointer]bool) ([]interface{}, error) {
+	seen, leave, err := v.visit(seen)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+
 	goary := make([]interface{}, 0)
 	for i := 0; i < int(C.mrb_ary_len(v.ctx.mrb, v.v)); i++ {
 		mrbval := C.get_ary_entry(v.v, C.int(i))
 		aryval := Value{ctx: v.ctx, v: mrbval}
-		goval, err := aryval.ToInterface()
+		goval, err := aryval.toInterface(seen)
 		if err != nil {
 			return nil, err
 		}
@@ -409,7 +541,13 @@ func (v Value) mrbArrayToSlice() ([]interface{}, error) {
 // mrbHashToMap takes the value (which has to be a Ruby Hash) and returns
 // the key/value pairs as a Go map|string]interface{}. Ruby keys which are
 // symbols are turned into strings.
-func (v Value) mrbHashToMap() (map[string]interface{}, error) {
+func (v Value) mrbHashToMap(seen map[unsafe.Pointer]bool) (map[string]interface{}, error) {
+	seen, leave, err := v.visit(seen)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+
 	gomap := make(map[string]interface{})
 	mrbkeys := C.mrb_hash_keys(v.ctx.mrb, v.v)
 	for i := 0; i < int(C.mrb_ary_len(v.ctx.mrb, mrbkeys)); i++ {
@@ -424,7 +562,7 @@ func (v Value) mrbHashToMap() (map[string]interface{}, error) {
 		}
 
 		val := Value{ctx: v.ctx, v: mrbvalue}
-		goval, err := val.ToInterface()
+		goval, err := val.toInterface(seen)
 		if err != nil {
 			return nil, err
 		}
@@ -433,15 +571,155 @@ func (v Value) mrbHashToMap() (map[string]interface{}, error) {
 	return gomap, nil
 }
 
+// mrbObjectToMap takes the value (which has to be a Ruby Object) and
+// returns it as a Go map[string]interface{}. If the object responds to
+// to_h, the resulting Hash is used. Otherwise the instance variables of
+// the object are returned, with their "@" prefix removed.
+func (v Value) mrbObjectToMap(seen map[unsafe.Pointer]bool) (map[string]interface{}, error) {
+	seen, leave, err := v.visit(seen)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+
+	if v.respondTo("to_h") {
+		hsh, err := v.funcall("to_h")
+		if err != nil {
+			return nil, err
+		}
+		if !hsh.IsHash() {
+			return nil, fmt.Errorf("value is not a hash but %v", hsh.Type())
+		}
+		return hsh.mrbHashToMap(seen)
+	}
+
+	names, err := v.funcall("instance_variables")
+	if err != nil {
+		return nil, err
+	}
+	gomap := make(map[string]interface{})
+	for i := 0; i < int(C.mrb_ary_len(v.ctx.mrb, names.v)); i++ {
+		name := Value{ctx: v.ctx, v: C.get_ary_entry(names.v, C.int(i))}
+		ivar, err := v.funcall("instance_variable_get", name)
+		if err != nil {
+			return nil, err
+		}
+		goval, err := ivar.toInterface(seen)
+		if err != nil {
+			return nil, err
+		}
+		key, err := name.ToString()
+		if err != nil {
+			return nil, err
+		}
+		gomap[strings.TrimPrefix(key, "@")] = goval
+	}
+	return gomap, nil
+}
+
+// visit marks the Ruby object of v as being converted to Go, creating
+// seen if necessary. Call leave once the object has been converted.
+// ErrCyclicValue is returned if the object is being converted already,
+// i.e. it references itself.
+func (v Value) visit(seen map[unsafe.Pointer]bool) (map[unsafe.Pointer]bool, func(), error) {
+	if seen == nil {
+		seen = make(map[unsafe.Pointer]bool)
+	}
+	p := C.my_obj_ptr(v.v)
+	if seen[p] {
+		return nil, nil, ErrCyclicValue
+	}
+	seen[p] = true
+	return seen, func() { delete(seen, p) }, nil
+}
+
+// respondTo indicates whether the value responds to the method with
+// the given name.
+func (v Value) respondTo(name string) bool {
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	return C.my_respond_to(v.ctx.mrb, v.v, cname) != C.mrb_bool(0)
+}
+
+// funcall calls the method with the given name on the value and
+// returns its result. An error is returned if the method raises
+// an exception.
+func (v Value) funcall(name string, args ...Value) (Value, error) {
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+
+	var argv *C.mrb_value
+	cargs := make([]C.mrb_value, len(args))
+	for i, arg := range args {
+		cargs[i] = arg.v
+	}
+	if len(cargs) > 0 {
+		argv = &cargs[0]
+	}
+
+	result := C.my_funcall_argv(v.ctx.mrb, v.v, cname, C.mrb_int(len(cargs)), argv)
+	if C.has_exception(v.ctx.mrb) != 0 {
+		return NilValue(v.ctx), newRunError(v.ctx, true)
+	}
+	return Value{ctx: v.ctx, v: result}, nil
+}
+
+// Call calls the method with the given name on the value, e.g. to call
+// inspect, and returns its output. The arguments are converted with
+// Context.ToValue. An error of type RunError is returned if the method
+// raises an exception.
+func (v Value) Call(method string, args ...interface{}) (Value, error) {
+	v.ctx.enter()
+	defer v.ctx.leave()
+
+	values := make([]Value, len(args))
+	for i, arg := range args {
+		val, err := v.ctx.ToValue(arg)
+		if err != nil {
+			return NilValue(v.ctx), err
+		}
+		values[i] = val
+	}
+	res, err := v.funcall(method, values...)
+	if err != nil {
+		v.ctx.failed = true
+	}
+	return res, err
+}
+
+// Retain registers the value with the garbage collector of its Context,
+// so that it stays alive after the call that returned it has completed,
+// e.g. to cache a Ruby object between calls of LoadString.
+// Every call to Retain must be balanced by a call to Release.
+func (v Value) Retain() Value {
+	v.ctx.enter()
+	defer v.ctx.leave()
+
+	C.mrb_gc_register(v.ctx.mrb, v.v)
+	return v
+}
+
+// Release unregisters a value previously registered with Retain.
+// The garbage collector is free to collect the value afterwards.
+func (v Value) Release() {
+	v.ctx.enter()
+	defer v.ctx.leave()
+
+	C.mrb_gc_unregister(v.ctx.mrb, v.v)
+}
+
 // Run runs the code given that it is a reference to a Proc.
 func (v Value) Run() (Value, error) {
+	v.ctx.enter()
+	defer v.ctx.leave()
+
 	if !v.IsProc() {
 		return NilValue(v.ctx), errors.New("value is not a Proc")
 	}
 	proc := C.my_mrb_proc_ptr(v.v)
 	newv := C.mrb_run(v.ctx.mrb, proc, v.v)
 	if C.has_exception(v.ctx.mrb) != 0 {
-		return NilValue(v.ctx), newRunError(v.ctx, true)
+		return NilValue(v.ctx), newScriptError(v.ctx)
 	}
 	return Value{ctx: v.ctx, v: newv}, nil
 }
@@ -5,6 +5,7 @@
 package mruby
 
 import (
+	"math"
 	"reflect"
 	"testing"
 )
@@ -495,3 +496,406 @@ func TestPointerTypes(t *testing.T) {
 		t.Errorf("expected %d; got: %d", 42, i)
 	}
 }
+
+func TestFixnumOverflow(t *testing.T) {
+	ctx := NewContext()
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	val, err := ctx.LoadString("300")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := val.ToInt8(); err == nil {
+		t.Error("expected overflow error for int8")
+	} else if _, ok := err.(*OverflowError); !ok {
+		t.Errorf("expected OverflowError; got: %T", err)
+	}
+	if _, err := val.ToUint8(); err == nil {
+		t.Error("expected overflow error for uint8")
+	}
+	i16, err := val.ToInt16()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i16 != 300 {
+		t.Errorf("expected %d; got: %d", 300, i16)
+	}
+
+	val, err = ctx.LoadString("-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := val.ToUint(); err == nil {
+		t.Error("expected overflow error for uint")
+	}
+	if _, err := val.ToUint64(); err == nil {
+		t.Error("expected overflow error for uint64")
+	}
+	i8, err := val.ToInt8()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i8 != -1 {
+		t.Errorf("expected %d; got: %d", -1, i8)
+	}
+}
+
+func TestToValueOverflow(t *testing.T) {
+	ctx := NewContext()
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	_, err := ctx.ToValue(uint64(math.MaxUint64))
+	if err == nil {
+		t.Fatal("expected overflow error")
+	}
+	if _, ok := err.(*OverflowError); !ok {
+		t.Errorf("expected OverflowError; got: %T", err)
+	}
+
+	_, err = ctx.LoadString("ARGV[0]", []interface{}{1, uint64(math.MaxUint64)})
+	if err == nil {
+		t.Fatal("expected overflow error")
+	}
+}
+
+func TestLenientIntegers(t *testing.T) {
+	ctx := NewContext()
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+	val, err := ctx.LoadString("3.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := val.ToInt(); err == nil {
+		t.Error("expected error converting a Float without lenient mode")
+	}
+
+	ctx = NewContext(SetLenientIntegers(true))
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+	tests := []struct {
+		Input  string
+		Want   int
+		Failed bool
+	}{
+		{`3`, 3, false},
+		{`3.0`, 3, false},
+		{`-42.0`, -42, false},
+		{`3.5`, 0, true},
+		{`1.0/0`, 0, true},
+		{`'3'`, 0, true},
+	}
+	for _, test := range tests {
+		val, err := ctx.LoadString(test.Input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := val.ToInt()
+		if test.Failed {
+			if err == nil {
+				t.Errorf("%s: expected error; got: %d", test.Input, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", test.Input, err)
+		}
+		if got != test.Want {
+			t.Errorf("%s: expected %d; got: %d", test.Input, test.Want, got)
+		}
+	}
+
+	// Overflows report the requested Go type
+	val, err = ctx.LoadString("1.0e20")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for typ, convert := range map[string]func() error{
+		"int8":   func() error { _, err := val.ToInt8(); return err },
+		"int32":  func() error { _, err := val.ToInt32(); return err },
+		"int64":  func() error { _, err := val.ToInt64(); return err },
+		"uint16": func() error { _, err := val.ToUint16(); return err },
+	} {
+		err := convert()
+		overflow, ok := err.(*OverflowError)
+		if !ok {
+			t.Errorf("%s: expected OverflowError; got: %v", typ, err)
+			continue
+		}
+		if overflow.Type != typ {
+			t.Errorf("expected overflow of %s; got: %s", typ, overflow.Type)
+		}
+	}
+}
+
+func TestExceptionValue(t *testing.T) {
+	ctx := NewContext()
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	val, err := ctx.LoadString("ArgumentError.new('bad argument')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !val.IsException() {
+		t.Errorf("expected type Exception; got: %v", val.Type())
+	}
+	got, err := val.ToInterface()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, ok := got.(*Exception)
+	if !ok {
+		t.Fatalf("expected *Exception; got: %T", got)
+	}
+	if e.Class != "ArgumentError" {
+		t.Errorf("expected class %q; got: %q", "ArgumentError", e.Class)
+	}
+	if e.Message != "bad argument" {
+		t.Errorf("expected message %q; got: %q", "bad argument", e.Message)
+	}
+}
+
+func TestClassAndModuleValues(t *testing.T) {
+	ctx := NewContext()
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	val, err := ctx.LoadString("String")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := val.ToInterface()
+	if err != nil {
+		t.Fatal(err)
+	}
+	class, ok := got.(*Class)
+	if !ok {
+		t.Fatalf("expected *Class; got: %T", got)
+	}
+	if class.RClass() != ctx.mrb.string_class {
+		t.Errorf("expected String class")
+	}
+
+	val, err = ctx.LoadString("Kernel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = val.ToInterface()
+	if err != nil {
+		t.Fatal(err)
+	}
+	module, ok := got.(*Module)
+	if !ok {
+		t.Fatalf("expected *Module; got: %T", got)
+	}
+	if module.RClass() != ctx.mrb.kernel_module {
+		t.Errorf("expected Kernel module")
+	}
+}
+
+func TestObjectValue(t *testing.T) {
+	ctx := NewContext()
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	script := `
+class Person
+  def initialize(name, age)
+    @name = name
+    @age = age
+  end
+end
+Person.new("Oliver", 21)
+`
+	res, err := ctx.LoadStringResult(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"name": "Oliver", "age": 21}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %v; got: %v", expected, res)
+	}
+
+	script = `
+class Point
+  def initialize(x, y)
+    @x, @y = x, y
+  end
+  def to_h
+    { "coords" => [@x, @y] }
+  end
+end
+Point.new(1, 2)
+`
+	res, err = ctx.LoadStringResult(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = map[string]interface{}{"coords": []interface{}{1, 2}}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %v; got: %v", expected, res)
+	}
+}
+
+func TestCyclicObjectValue(t *testing.T) {
+	ctx := NewContext()
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	if _, err := ctx.LoadString(`
+class Node
+  attr_accessor :x
+end
+`); err != nil {
+		t.Fatal(err)
+	}
+	for _, script := range []string{
+		`a = Node.new; b = Node.new; a.x = b; b.x = a; a`,
+		`a = Node.new; a.x = [a]; a`,
+		`a = []; a << a; a`,
+		`h = {}; h["self"] = h; h`,
+	} {
+		_, err := ctx.LoadStringResult(script)
+		if err != ErrCyclicValue {
+			t.Errorf("%s: expected %v; got: %v", script, ErrCyclicValue, err)
+		}
+	}
+
+	// Objects referenced more than once, but without cycles, are fine
+	res, err := ctx.LoadStringResult(`a = Node.new; a.x = 1; [a, a]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []interface{}{map[string]interface{}{"x": 1}, map[string]interface{}{"x": 1}}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %v; got: %v", expected, res)
+	}
+}
+
+func TestRetainValue(t *testing.T) {
+	ctx := NewContext()
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	val, err := ctx.LoadString("'Hello' + ' ' + 'world'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	val.Retain()
+
+	// Generate lots of garbage and collect it
+	for i := 0; i < 10; i++ {
+		_, err := ctx.LoadString("(1..1000).map { |i| i.to_s * 10 }")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx.GC()
+	}
+
+	s, err := val.ToString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "Hello world" {
+		t.Errorf("expected %q; got: %q", "Hello world", s)
+	}
+
+	val.Release()
+	ctx.GC()
+}
+
+func TestCallMethod(t *testing.T) {
+	ctx := NewContext()
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	val, err := ctx.LoadString("'Hello'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inspected, err := val.Call("inspect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := inspected.ToString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != `"Hello"` {
+		t.Errorf("expected %q; got: %q", `"Hello"`, s)
+	}
+
+	joined, err := val.Call("+", " world")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := joined.ToString(); s != "Hello world" {
+		t.Errorf("expected %q; got: %q", "Hello world", s)
+	}
+
+	_, err = val.Call("no_such_method")
+	if _, ok := err.(*RunError); !ok {
+		t.Errorf("expected RunError; got: %v", err)
+	}
+}
+
+func TestCallMethodFromGoFunction(t *testing.T) {
+	ctx := NewContext()
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	obj, err := ctx.LoadString(`
+		class Failing
+		  def fail!; raise ArgumentError, "kaboom"; end
+		end
+		Failing.new
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj.Retain()
+	defer obj.Release()
+
+	mod, err := ctx.DefineModule("Caller", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var callErr error
+	mod.DefineClassMethod("call_failing", func(ctx *Context) (Value, error) {
+		_, callErr = obj.Call("fail!")
+		return ctx.ToValue("survived")
+	})
+	res, err := ctx.LoadStringResult(`Caller.call_failing`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != "survived" {
+		t.Errorf("expected %q; got: %v", "survived", res)
+	}
+	runErr, ok := callErr.(*RunError)
+	if !ok {
+		t.Fatalf("expected RunError; got: %v", callErr)
+	}
+	if runErr.Class != "ArgumentError" || runErr.Message != "kaboom" {
+		t.Errorf("expected ArgumentError: kaboom; got: %s: %s", runErr.Class, runErr.Message)
+	}
+
+	// The VM is still usable
+	if res, err := ctx.LoadStringResult(`1 + 2`); err != nil || res != 3 {
+		t.Errorf("expected %d; got: %v (err=%v)", 3, res, err)
+	}
+}
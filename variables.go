@@ -0,0 +1,194 @@
+// Copyright 2013-2015 Oliver Eilhard.
+// Use of this source code is governed by the MIT LICENSE that
+// can be found in the MIT-LICENSE file included in the project.
+
+package mruby
+
+/*
+#cgo pkg-config: mruby
+#include "mruby_go.h"
+*/
+import "C"
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// SetGlobal sets the global variable with the given name, e.g. "$config".
+// The value is converted with ToValue.
+func (ctx *Context) SetGlobal(name string, value interface{}) error {
+	ctx.enter()
+	defer ctx.leave()
+
+	if !isGlobalName(name) {
+		return fmt.Errorf("invalid global variable name %q", name)
+	}
+	v, err := ctx.ToValue(value)
+	if err != nil {
+		return err
+	}
+	ctx.recordSetGlobal(name, value)
+
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	C.my_gv_set(ctx.mrb, cname, v.v)
+	return nil
+}
+
+// GetGlobal returns the global variable with the given name, e.g.
+// "$config". As in Ruby, undefined globals are nil.
+func (ctx *Context) GetGlobal(name string) (Value, error) {
+	ctx.enter()
+	defer ctx.leave()
+
+	if !isGlobalName(name) {
+		return NilValue(ctx), fmt.Errorf("invalid global variable name %q", name)
+	}
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	return Value{ctx: ctx, v: C.my_gv_get(ctx.mrb, cname)}, nil
+}
+
+// SetConst sets the constant with the given name in the module, e.g.
+// "VERSION". The value is converted with ToValue.
+func (m *Module) SetConst(name string, value interface{}) error {
+	return m.ctx.setConst(m.module, name, value)
+}
+
+// GetConst returns the constant with the given name defined in the
+// module. Constants of outer modules are not searched.
+func (m *Module) GetConst(name string) (Value, bool) {
+	return m.ctx.getConst(m.module, name)
+}
+
+// RemoveConst removes the constant with the given name from the module.
+// It returns false if the module has no such constant.
+func (m *Module) RemoveConst(name string) bool {
+	return m.ctx.removeConst(m.module, name)
+}
+
+// SetConst sets the constant with the given name in the class, e.g.
+// "LIMIT". The value is converted with ToValue.
+func (c *Class) SetConst(name string, value interface{}) error {
+	return c.ctx.setConst(c.class, name, value)
+}
+
+// GetConst returns the constant with the given name defined in the
+// class. Constants of superclasses and outer modules are not searched.
+func (c *Class) GetConst(name string) (Value, bool) {
+	return c.ctx.getConst(c.class, name)
+}
+
+// RemoveConst removes the constant with the given name from the class.
+// It returns false if the class has no such constant.
+func (c *Class) RemoveConst(name string) bool {
+	return c.ctx.removeConst(c.class, name)
+}
+
+func (ctx *Context) setConst(class *C.struct_RClass, name string, value interface{}) error {
+	ctx.enter()
+	defer ctx.leave()
+
+	if !isConstName(name) {
+		return fmt.Errorf("invalid constant name %q", name)
+	}
+	v, err := ctx.ToValue(value)
+	if err != nil {
+		return err
+	}
+	ctx.recordSetConst(class, name, value)
+
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	C.my_const_set_at(ctx.mrb, class, cname, v.v)
+	return nil
+}
+
+func (ctx *Context) getConst(class *C.struct_RClass, name string) (Value, bool) {
+	ctx.enter()
+	defer ctx.leave()
+
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	var v C.mrb_value
+	if C.my_const_get_at(ctx.mrb, class, cname, &v) == C.mrb_bool(0) {
+		return NilValue(ctx), false
+	}
+	return Value{ctx: ctx, v: v}, true
+}
+
+func (ctx *Context) removeConst(class *C.struct_RClass, name string) bool {
+	ctx.enter()
+	defer ctx.leave()
+
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	return C.my_const_remove_at(ctx.mrb, class, cname) != C.mrb_bool(0)
+}
+
+// SetIvar sets the instance variable with the given name, e.g. "@name".
+// The value is converted with ToValue. An error is returned if the value
+// cannot have instance variables, e.g. for Integers or Strings.
+func (v Value) SetIvar(name string, value interface{}) error {
+	v.ctx.enter()
+	defer v.ctx.leave()
+
+	if !isIvarName(name) {
+		return fmt.Errorf("invalid instance variable name %q", name)
+	}
+	if C.my_iv_p(v.v) == C.mrb_bool(0) {
+		return fmt.Errorf("cannot set instance variable %s of %s", name, C.GoString(C.mrb_obj_classname(v.ctx.mrb, v.v)))
+	}
+	val, err := v.ctx.ToValue(value)
+	if err != nil {
+		return err
+	}
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	C.my_iv_set(v.ctx.mrb, v.v, cname, val.v)
+	return nil
+}
+
+// GetIvar returns the instance variable with the given name, e.g.
+// "@name". As in Ruby, undefined instance variables are nil.
+func (v Value) GetIvar(name string) (Value, error) {
+	v.ctx.enter()
+	defer v.ctx.leave()
+
+	if !isIvarName(name) {
+		return NilValue(v.ctx), fmt.Errorf("invalid instance variable name %q", name)
+	}
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	return Value{ctx: v.ctx, v: C.my_iv_get(v.ctx.mrb, v.v, cname)}, nil
+}
+
+// isGlobalName returns true for names like "$config".
+func isGlobalName(name string) bool {
+	return len(name) > 1 && name[0] == '$' && isIdentifier(name[1:])
+}
+
+// isConstName returns true for names like "VERSION" or "Config".
+func isConstName(name string) bool {
+	return len(name) > 0 && name[0] >= 'A' && name[0] <= 'Z' && isIdentifier(name)
+}
+
+// isIvarName returns true for names like "@name".
+func isIvarName(name string) bool {
+	return len(name) > 1 && name[0] == '@' && name[1] != '@' && isIdentifier(name[1:])
+}
+
+// isIdentifier returns true if s consists of letters, digits, and
+// underscores, and doesn't start with a digit.
+func isIdentifier(s string) bool {
+	for i, r := range s {
+		switch {
+		case r == '_', r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= 0x80:
+		case r >= '0' && r <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return s != ""
+}
@@ -0,0 +1,214 @@
+// Copyright 2013-2015 Oliver Eilhard.
+// Use of this source code is governed by the MIT LICENSE that
+// can be found in the MIT-LICENSE file included in the project.
+
+package mruby
+
+import (
+	"testing"
+)
+
+func TestGlobals(t *testing.T) {
+	ctx := NewContext()
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	config := map[string]interface{}{"host": "localhost", "port": 8080}
+	if err := ctx.SetGlobal("$config", config); err != nil {
+		t.Fatal(err)
+	}
+	res, err := ctx.LoadStringResult(`$config["port"] + 1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != 8081 {
+		t.Errorf("expected %d; got: %v", 8081, res)
+	}
+
+	if _, err := ctx.LoadString(`$result = [$config["host"], :ok]`); err != nil {
+		t.Fatal(err)
+	}
+	v, err := ctx.GetGlobal("$result")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ary, err := v.ToArray()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ary) != 2 || ary[0] != "localhost" || ary[1] != "ok" {
+		t.Errorf("expected %v; got: %v", []interface{}{"localhost", "ok"}, ary)
+	}
+
+	if v, err := ctx.GetGlobal("$undefined"); err != nil || !v.IsNil() {
+		t.Errorf("expected nil for undefined global; got: %v (err=%v)", v, err)
+	}
+	for _, name := range []string{"config", "$", "$1abc", ""} {
+		if err := ctx.SetGlobal(name, 1); err == nil {
+			t.Errorf("expected error for global name %q", name)
+		}
+		if _, err := ctx.GetGlobal(name); err == nil {
+			t.Errorf("expected error for global name %q", name)
+		}
+	}
+}
+
+func TestConstants(t *testing.T) {
+	ctx := NewContext()
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	module, err := ctx.DefineModule("App", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := module.SetConst("VERSION", "1.2.3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := module.SetConst("version", "1.2.3"); err == nil {
+		t.Error("expected error for lowercase constant name")
+	}
+	res, err := ctx.LoadStringResult(`App::VERSION`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != "1.2.3" {
+		t.Errorf("expected %q; got: %v", "1.2.3", res)
+	}
+
+	class, err := ctx.DefineClass("Limits", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ctx.LoadString(`class Limits; MAX = 42; end`); err != nil {
+		t.Fatal(err)
+	}
+	v, found := class.GetConst("MAX")
+	if !found {
+		t.Fatalf("expected to find constant %q", "MAX")
+	}
+	if max, err := v.ToInt(); err != nil || max != 42 {
+		t.Errorf("expected %d; got: %d (err=%v)", 42, max, err)
+	}
+	if _, found := class.GetConst("MIN"); found {
+		t.Errorf("expected not to find constant %q", "MIN")
+	}
+
+	if !class.RemoveConst("MAX") {
+		t.Errorf("expected to remove constant %q", "MAX")
+	}
+	if class.RemoveConst("MAX") {
+		t.Errorf("expected constant %q to be removed already", "MAX")
+	}
+	if _, err := ctx.LoadString(`Limits::MAX`); err == nil {
+		t.Error("expected NameError after removing the constant")
+	}
+}
+
+func TestInstanceVariables(t *testing.T) {
+	ctx := NewContext()
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+
+	obj, err := ctx.LoadString(`
+		class Account
+		  def initialize; @balance = 100; end
+		  def owner; @owner; end
+		end
+		Account.new
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := obj.GetIvar("@balance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance, err := v.ToInt(); err != nil || balance != 100 {
+		t.Errorf("expected %d; got: %d (err=%v)", 100, balance, err)
+	}
+
+	if err := obj.SetIvar("@owner", "Oliver"); err != nil {
+		t.Fatal(err)
+	}
+	owner, err := obj.Call("owner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err := owner.ToString(); err != nil || s != "Oliver" {
+		t.Errorf("expected %q; got: %q (err=%v)", "Oliver", s, err)
+	}
+
+	if err := obj.SetIvar("owner", "Oliver"); err == nil {
+		t.Error("expected error for instance variable name without @")
+	}
+	num, err := ctx.ToValue(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := num.SetIvar("@x", 1); err == nil {
+		t.Error("expected error when setting an instance variable of an Integer")
+	}
+}
+
+func TestValuesOfAnotherContext(t *testing.T) {
+	ctx := NewContext()
+	if ctx == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+	other := NewContext()
+	if other == nil {
+		t.Fatal("expected NewContext() to be != nil")
+	}
+	defer other.Close()
+
+	v, err := other.LoadString(`{ "name" => "mruby" }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ctx.ToValue(v); err != ErrForeignValue {
+		t.Errorf("expected ErrForeignValue; got: %v", err)
+	}
+	if _, err := ctx.ToValue([]interface{}{1, v}); err != ErrForeignValue {
+		t.Errorf("expected ErrForeignValue for nested value; got: %v", err)
+	}
+	if err := ctx.SetGlobal("$config", v); err != ErrForeignValue {
+		t.Errorf("expected ErrForeignValue; got: %v", err)
+	}
+	module, err := ctx.DefineModule("App", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := module.SetConst("CONFIG", v); err != ErrForeignValue {
+		t.Errorf("expected ErrForeignValue; got: %v", err)
+	}
+	obj, err := ctx.LoadString(`Object.new`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := obj.SetIvar("@config", v); err != ErrForeignValue {
+		t.Errorf("expected ErrForeignValue; got: %v", err)
+	}
+	if _, err := obj.Call("instance_variable_set", "@config", v); err != ErrForeignValue {
+		t.Errorf("expected ErrForeignValue; got: %v", err)
+	}
+
+	// Values converted to Go can be passed
+	config, err := v.ToInterface()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.SetGlobal("$config", config); err != nil {
+		t.Fatal(err)
+	}
+	res, err := ctx.LoadStringResult(`$config["name"]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != "mruby" {
+		t.Errorf("expected %q; got: %v", "mruby", res)
+	}
+}